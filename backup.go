@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"webpush/config"
+	"webpush/database"
+)
+
+// runBackup implements the backup subcommand: it writes a snapshot of the
+// database, which is safe while the server is running
+func runBackup(args []string) {
+	cfg := config.Load()
+
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir := flags.String("dir", cfg.BackupDir, "directory to write the backup to")
+	keep := flags.Int("keep", cfg.BackupKeep, "number of backups to keep, 0 keeps all")
+	list := flags.Bool("list", false, "list existing backups instead of taking one")
+	flags.Parse(args)
+
+	if *list {
+		backups, err := database.ListBackups(*dir)
+		if err != nil {
+			log.Fatalf("Failed to list backups: %v", err)
+		}
+		for _, b := range backups {
+			fmt.Println(b)
+		}
+		return
+	}
+
+	store, err := database.Open(cfg.DBDriver, cfg.DBDSN)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
+
+	b, ok := store.(database.Backuper)
+	if !ok {
+		log.Fatalf("The %s driver does not support online backup; use the database's own tools (e.g. pg_dump)", cfg.DBDriver)
+	}
+
+	path, err := database.CreateBackup(context.Background(), b, *dir, *keep)
+	if err != nil && path == "" {
+		log.Fatalf("Backup failed: %v", err)
+	}
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	fmt.Printf("Backup written to %s\n", path)
+}
+
+// runRestore implements the restore subcommand: it verifies a backup and
+// replaces the SQLite database with it. The server must be stopped first.
+func runRestore(args []string) {
+	cfg := config.Load()
+
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	verifyOnly := flags.Bool("verify", false, "only check the backup's integrity")
+	force := flags.Bool("force", false, "restore even if the database appears to be in use")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: webpush restore [-verify] [-force] <backup file>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	src := flags.Arg(0)
+
+	if *verifyOnly {
+		info, err := database.VerifySQLiteBackup(src)
+		if err != nil {
+			log.Fatalf("Backup %s is not usable: %v", src, err)
+		}
+		fmt.Printf("Backup OK: schema version %d, %d subscriptions\n", info.SchemaVersion, info.Subscriptions)
+		return
+	}
+
+	if cfg.DBDriver != database.DriverSQLite {
+		log.Fatalf("restore only supports the sqlite driver, not %s", cfg.DBDriver)
+	}
+	dbPath := cfg.DBDSN
+	if dbPath == "" {
+		dbPath = database.DefaultSQLitePath
+	}
+
+	// The WAL file only exists while a server has the database open, or after a crash
+	if _, err := os.Stat(dbPath + "-wal"); err == nil && !*force {
+		log.Fatalf("%s-wal exists: stop the server before restoring, or pass -force if it crashed", dbPath)
+	}
+
+	info, err := database.RestoreSQLite(src, dbPath)
+	if err != nil {
+		log.Fatalf("Restore failed: %v", err)
+	}
+	fmt.Printf("Restored %s to %s: schema version %d, %d subscriptions\n", src, dbPath, info.SchemaVersion, info.Subscriptions)
+}
@@ -0,0 +1,235 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds runtime settings read from the environment
+type Config struct {
+	// DBDriver selects the storage backend: sqlite, postgres or memory
+	DBDriver string
+
+	// DBDSN is the SQLite file path or PostgreSQL connection URL
+	DBDSN string
+
+	// AutoMigrate applies pending schema migrations at startup. When false the
+	// server refuses to start until they are applied with the migrate command.
+	AutoMigrate bool
+
+	// OnlineWindow is how recently a client must have sent a heartbeat to count as online
+	OnlineWindow time.Duration
+
+	// DrainTimeout is how long shutdown waits for HTTP requests and queued deliveries
+	DrainTimeout time.Duration
+
+	// SendWorkers is the number of push deliveries sent at a time across all push service hosts
+	SendWorkers int
+
+	// PushRate is the requests/sec sent to each push service host, 0 for no limit
+	PushRate int
+
+	// PushHostRates overrides PushRate for single hosts, as "host=rate" entries
+	PushHostRates []string
+
+	// PushConcurrency is the number of concurrent requests to each push service host
+	PushConcurrency int
+
+	// IdempotencyTTL is how long responses to requests with an Idempotency-Key
+	// are kept for replay, 0 to ignore the header
+	IdempotencyTTL time.Duration
+
+	// BackupDir is where database snapshots are written
+	BackupDir string
+
+	// BackupInterval is how often a scheduled backup is taken, 0 to disable
+	BackupInterval time.Duration
+
+	// BackupKeep is how many backups to keep, older ones are deleted
+	BackupKeep int
+
+	// EncryptionKey is the base64 master key for encrypting subscription secrets at rest
+	EncryptionKey string
+
+	// EncryptionKeyFile is a file holding the master key, used when EncryptionKey is empty
+	EncryptionKeyFile string
+
+	// AdminToken, when set, must be sent as a bearer token to /admin/ endpoints
+	AdminToken string
+
+	// TrustedProxies lists the CIDRs, IPs, "loopback" or "private" whose
+	// Forwarded, X-Forwarded-For and X-Real-IP headers are believed
+	TrustedProxies []string
+
+	// UARulesFile is a JSON file of User-Agent parsing rules replacing the built-in ones
+	UARulesFile string
+
+	// IPMode is how client IPs are stored: full, truncate, hash or drop
+	IPMode string
+
+	// IPHashSalt is the secret mixed into IP hashes in the hash mode
+	IPHashSalt string
+
+	// IPRetention is how long after subscribing a client's IP is kept, 0 to keep it
+	IPRetention time.Duration
+
+	// DeliveryRetention is how long delivery log entries are kept, 0 to keep them
+	DeliveryRetention time.Duration
+
+	// LogRedactIPs replaces IP addresses in log output with their network
+	LogRedactIPs bool
+
+	// GeoIPProvider selects how client IPs are located: mmdb, ip-api or off
+	GeoIPProvider string
+
+	// GeoIPDB is the MaxMind DB file (City or Country) used by the mmdb provider
+	GeoIPDB string
+
+	// GeoIPASNDB is an optional separate MaxMind DB file with ASN data
+	GeoIPASNDB string
+
+	// GeoIPReloadInterval is how often the mmdb files are checked for updates, 0 to disable
+	GeoIPReloadInterval time.Duration
+
+	// GeoIPWorkers is the number of concurrent background location lookups
+	GeoIPWorkers int
+
+	// GeoIPCacheSize is how many IP lookup results are cached
+	GeoIPCacheSize int
+
+	// GeoIPCacheTTL is how long a cached lookup result is used
+	GeoIPCacheTTL time.Duration
+
+	// GeoIPBackfill looks up subscriptions without a nation at startup
+	GeoIPBackfill bool
+}
+
+// Load reads configuration from WEBPUSH_* environment variables, falling back to defaults
+func Load() Config {
+	return Config{
+		DBDriver:     stringEnv("WEBPUSH_DB_DRIVER", "sqlite"),
+		DBDSN:        os.Getenv("WEBPUSH_DB_DSN"),
+		AutoMigrate:  boolEnv("WEBPUSH_AUTO_MIGRATE", true),
+		OnlineWindow: durationEnv("WEBPUSH_ONLINE_WINDOW", 5*time.Minute),
+		DrainTimeout: durationEnv("WEBPUSH_DRAIN_TIMEOUT", 30*time.Second),
+		SendWorkers:  intEnv("WEBPUSH_SEND_WORKERS", 64),
+
+		PushRate:        limitEnv("WEBPUSH_PUSH_RATE", 100),
+		PushHostRates:   listEnv("WEBPUSH_PUSH_HOST_RATES", "none"),
+		PushConcurrency: intEnv("WEBPUSH_PUSH_CONCURRENCY", 16),
+		IdempotencyTTL:  intervalEnv("WEBPUSH_IDEMPOTENCY_TTL", 24*time.Hour),
+
+		BackupDir:      stringEnv("WEBPUSH_BACKUP_DIR", "data/backups"),
+		BackupInterval: intervalEnv("WEBPUSH_BACKUP_INTERVAL", 24*time.Hour),
+		BackupKeep:     intEnv("WEBPUSH_BACKUP_KEEP", 7),
+		AdminToken:     os.Getenv("WEBPUSH_ADMIN_TOKEN"),
+
+		EncryptionKey:     os.Getenv("WEBPUSH_ENCRYPTION_KEY"),
+		EncryptionKeyFile: os.Getenv("WEBPUSH_ENCRYPTION_KEY_FILE"),
+
+		TrustedProxies: listEnv("WEBPUSH_TRUSTED_PROXIES", "loopback"),
+		UARulesFile:    os.Getenv("WEBPUSH_UA_RULES"),
+
+		IPMode:            stringEnv("WEBPUSH_IP_MODE", "full"),
+		IPHashSalt:        os.Getenv("WEBPUSH_IP_HASH_SALT"),
+		IPRetention:       intervalEnv("WEBPUSH_IP_RETENTION", 0),
+		DeliveryRetention: intervalEnv("WEBPUSH_DELIVERY_RETENTION", 90*24*time.Hour),
+		LogRedactIPs:      boolEnv("WEBPUSH_LOG_REDACT_IPS", true),
+
+		GeoIPProvider:       stringEnv("WEBPUSH_GEOIP_PROVIDER", "mmdb"),
+		GeoIPDB:             stringEnv("WEBPUSH_GEOIP_DB", "data/GeoLite2-City.mmdb"),
+		GeoIPASNDB:          os.Getenv("WEBPUSH_GEOIP_ASN_DB"),
+		GeoIPReloadInterval: intervalEnv("WEBPUSH_GEOIP_RELOAD_INTERVAL", time.Minute),
+		GeoIPWorkers:        intEnv("WEBPUSH_GEOIP_WORKERS", 2),
+		GeoIPCacheSize:      intEnv("WEBPUSH_GEOIP_CACHE_SIZE", 10000),
+		GeoIPCacheTTL:       durationEnv("WEBPUSH_GEOIP_CACHE_TTL", 24*time.Hour),
+		GeoIPBackfill:       boolEnv("WEBPUSH_GEOIP_BACKFILL", true),
+	}
+}
+
+// stringEnv returns an environment variable or def if it is unset
+func stringEnv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// listEnv splits a comma-separated environment variable, or def if it is unset.
+// Set it to "none" for an empty list.
+func listEnv(key, def string) []string {
+	v := stringEnv(key, def)
+	if v == "none" {
+		return nil
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// boolEnv parses a boolean environment variable such as "true" or "0"
+func boolEnv(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %t", v, key, def)
+		return def
+	}
+	return b
+}
+
+// durationEnv parses a duration environment variable such as "90s" or "5m"
+func durationEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid value %q for %s, using default %s", v, key, def)
+		return def
+	}
+	return d
+}
+
+// intervalEnv is like durationEnv but accepts "0" or "off" to disable a scheduled job
+func intervalEnv(key string, def time.Duration) time.Duration {
+	switch os.Getenv(key) {
+	case "0", "off":
+		return 0
+	}
+	return durationEnv(key, def)
+}
+
+// limitEnv is like intEnv but accepts "0" or "off" to disable a limit
+func limitEnv(key string, def int) int {
+	switch os.Getenv(key) {
+	case "0", "off":
+		return 0
+	}
+	return intEnv(key, def)
+}
+
+// intEnv parses a positive integer environment variable
+func intEnv(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid value %q for %s, using default %d", v, key, def)
+		return def
+	}
+	return n
+}
@@ -0,0 +1,238 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backuper is implemented by stores that can write a consistent snapshot of
+// themselves while the server is running
+type Backuper interface {
+	Backup(ctx context.Context, path string) error
+}
+
+// Backup files are named webpush-<UTC timestamp>.db so they sort by age
+const (
+	backupPrefix     = "webpush-"
+	backupSuffix     = ".db"
+	backupTimeFormat = "20060102T150405Z"
+)
+
+// Backup writes a consistent snapshot of the database to path with VACUUM
+// INTO. It runs on a read connection, so in WAL mode writes continue while
+// the snapshot is taken.
+func (s *SQLiteStore) Backup(ctx context.Context, path string) error {
+	conn, err := s.read.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// VACUUM INTO writes a new file, which query_only would otherwise refuse
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = 0"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "PRAGMA query_only = 1")
+
+	_, err = conn.ExecContext(ctx, "VACUUM INTO ?", path)
+	return err
+}
+
+// CreateBackup writes a timestamped snapshot into dir, then deletes all but
+// the newest keep backups. Returns the path of the new backup.
+func CreateBackup(ctx context.Context, b Backuper, dir string, keep int) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	name := backupPrefix + time.Now().UTC().Format(backupTimeFormat) + backupSuffix
+	path := filepath.Join(dir, name)
+
+	// Snapshot under a temporary name so a failed or partial backup is never
+	// mistaken for a complete one
+	tmp := filepath.Join(dir, "."+name+".tmp")
+	os.Remove(tmp)
+	if err := b.Backup(ctx, tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if err := pruneBackups(dir, keep); err != nil {
+		return path, fmt.Errorf("backup written but rotation failed: %w", err)
+	}
+	return path, nil
+}
+
+// ListBackups returns the backup files in dir, newest first
+func ListBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, name))
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups, nil
+}
+
+// pruneBackups deletes all but the newest keep backups in dir
+func pruneBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	backups, err := ListBackups(dir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err := os.Remove(backups[len(backups)-1]); err != nil {
+			return err
+		}
+		backups = backups[:len(backups)-1]
+	}
+	return nil
+}
+
+// BackupInfo describes a verified backup file
+type BackupInfo struct {
+	SchemaVersion int
+	Subscriptions int
+}
+
+// VerifySQLiteBackup opens the backup at path read-only, runs SQLite's
+// integrity check and confirms it holds a webpush database
+func VerifySQLiteBackup(path string) (BackupInfo, error) {
+	var info BackupInfo
+
+	if _, err := os.Stat(path); err != nil {
+		return info, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return info, err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return info, fmt.Errorf("integrity check: %w", err)
+	}
+	if result != "ok" {
+		return info, fmt.Errorf("integrity check failed: %s", result)
+	}
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM subscriptions").Scan(&info.Subscriptions); err != nil {
+		return info, fmt.Errorf("not a webpush database: %w", err)
+	}
+	info.SchemaVersion, err = sqlMigrator{db: db, dialect: DriverSQLite}.SchemaVersion()
+	if err != nil {
+		return info, err
+	}
+	if _, err := (sqlMigrator{dialect: DriverSQLite}).pending(info.SchemaVersion); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// RestoreSQLite verifies the backup at src and replaces the database at
+// dbPath with it. The server must be stopped. The replaced database is kept
+// alongside as <dbPath>.pre-restore-<timestamp>, with its WAL checkpointed
+// into it first.
+func RestoreSQLite(src, dbPath string) (BackupInfo, error) {
+	info, err := VerifySQLiteBackup(src)
+	if err != nil {
+		return info, err
+	}
+
+	tmp := dbPath + ".restore.tmp"
+	if err := copyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return info, err
+	}
+
+	if _, err := os.Stat(dbPath); err == nil {
+		if err := checkpointSQLite(dbPath); err != nil {
+			os.Remove(tmp)
+			return info, fmt.Errorf("checkpoint %s: %w", dbPath, err)
+		}
+		old := dbPath + ".pre-restore-" + time.Now().UTC().Format(backupTimeFormat)
+		// Whatever the checkpoint left of the WAL moves with the database, so
+		// the kept copy stays complete and is not applied to the restored one
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if err := os.Rename(dbPath+suffix, old+suffix); err != nil && (suffix == "" || !errors.Is(err, os.ErrNotExist)) {
+				os.Remove(tmp)
+				return info, err
+			}
+		}
+	} else {
+		// A WAL without its database cannot be applied to anything
+		os.Remove(dbPath + "-wal")
+		os.Remove(dbPath + "-shm")
+	}
+
+	return info, os.Rename(tmp, dbPath)
+}
+
+// checkpointSQLite copies the WAL of the database at path into the database
+// file and truncates it. It fails while another process has the database open.
+func checkpointSQLite(path string) error {
+	db, err := sql.Open("sqlite", sqliteDSN(path, "mode=rw"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var busy, walPages, checkpointed int
+	if err := db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &walPages, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 {
+		return errors.New("the database is in use, stop the server first")
+	}
+	return nil
+}
+
+// copyFile copies src to dst and syncs it to disk
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
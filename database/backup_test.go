@@ -0,0 +1,70 @@
+package database
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRestoreSQLiteKeepsWAL checks that the replaced database is kept with the
+// writes still in its WAL, as after a crash
+func TestRestoreSQLiteKeepsWAL(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSQLite(filepath.Join(dir, "live.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	mustSave(t, s, testSubscription("https://fcm.googleapis.com/fcm/send/a", testTime))
+	backup := filepath.Join(dir, "backup.db")
+	if err := s.Backup(context.Background(), backup); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	mustSave(t, s, testSubscription("https://fcm.googleapis.com/fcm/send/b", testTime))
+
+	// Copy the files while the store is open, so the second save is only in the WAL
+	dbPath := filepath.Join(dir, "webpush.db")
+	for _, suffix := range []string{"", "-wal"} {
+		data, err := os.ReadFile(filepath.Join(dir, "live.db") + suffix)
+		if err != nil {
+			t.Fatalf("read live.db%s: %v", suffix, err)
+		}
+		if err := os.WriteFile(dbPath+suffix, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := RestoreSQLite(backup, dbPath); err != nil {
+		t.Fatalf("RestoreSQLite: %v", err)
+	}
+	if n := countSQLiteSubscriptions(t, dbPath); n != 1 {
+		t.Errorf("restored database has %d subscriptions, want the backup's 1", n)
+	}
+
+	kept, _ := filepath.Glob(dbPath + ".pre-restore-*")
+	if len(kept) != 1 {
+		t.Fatalf("kept databases = %v, want one", kept)
+	}
+	if n := countSQLiteSubscriptions(t, kept[0]); n != 2 {
+		t.Errorf("kept database has %d subscriptions, want 2 including the WAL", n)
+	}
+}
+
+// countSQLiteSubscriptions opens the database at path and counts its subscriptions
+func countSQLiteSubscriptions(t *testing.T, path string) int {
+	t.Helper()
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("OpenSQLite(%s): %v", path, err)
+	}
+	defer s.Close()
+	n, err := s.CountSubscriptions()
+	if err != nil {
+		t.Fatalf("CountSubscriptions(%s): %v", path, err)
+	}
+	return n
+}
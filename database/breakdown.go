@@ -0,0 +1,102 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"webpush/models"
+)
+
+// breakdown returns the SQL expression subscriptions are grouped by for
+// dimension, and the column that must be set for a row to be counted
+func (d sqlDialect) breakdown(dimension string) (group, column string, err error) {
+	switch dimension {
+	case models.BreakdownNation, models.BreakdownBrowser, models.BreakdownOS:
+		return dimension, dimension, nil
+	case models.BreakdownBrowserVersion:
+		return "TRIM(browser || ' ' || " + d.majorVersion("browser_version") + ")", "browser", nil
+	case models.BreakdownOSVersion:
+		return "TRIM(os || ' ' || COALESCE(os_version, ''))", "os", nil
+	case models.BreakdownPushService:
+		return d.pushService, "endpoint", nil
+	case models.BreakdownService:
+		return "push_service", "push_service", nil
+	}
+	return "", "", fmt.Errorf("unknown breakdown %q", dimension)
+}
+
+// countSubscriptionsBy counts the subscriptions in db matching f, grouped by dimension
+func countSubscriptionsBy(db *sql.DB, d sqlDialect, dimension string, f models.SubscriptionFilter) (map[string]int, error) {
+	group, column, err := d.breakdown(dimension)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return d.placeholder(len(args))
+	}
+	where := append([]string{column + " <> ''"}, d.filterConditions(f, arg)...)
+
+	rows, err := db.Query(`
+		SELECT `+group+` AS value, COUNT(*) AS count
+		FROM subscriptions
+		WHERE `+strings.Join(where, " AND ")+`
+		GROUP BY value
+		ORDER BY count DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var value string
+		var count int
+		if err := rows.Scan(&value, &count); err != nil {
+			continue
+		}
+		counts[value] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// breakdownValue returns the value sub is counted under for dimension, matching
+// the SQL expressions of sqlDialect.breakdown; empty if it is not counted.
+// ok is false for an unknown dimension.
+func breakdownValue(sub models.Subscription, dimension string) (value string, ok bool) {
+	switch dimension {
+	case models.BreakdownNation:
+		return sub.Nation, true
+	case models.BreakdownBrowser:
+		return sub.Browser, true
+	case models.BreakdownOS:
+		return sub.OS, true
+	case models.BreakdownBrowserVersion:
+		if sub.Browser == "" {
+			return "", true
+		}
+		major, _, _ := strings.Cut(sub.BrowserVersion, ".")
+		return strings.TrimSpace(sub.Browser + " " + major), true
+	case models.BreakdownOSVersion:
+		if sub.OS == "" {
+			return "", true
+		}
+		return strings.TrimSpace(sub.OS + " " + sub.OSVersion), true
+	case models.BreakdownPushService:
+		return pushServiceHost(sub.Endpoint), true
+	case models.BreakdownService:
+		return sub.PushService, true
+	}
+	return "", false
+}
+
+// pushServiceHost returns the host of an endpoint URL, as sqlDialect.pushService does in SQL
+func pushServiceHost(endpoint string) string {
+	_, rest, _ := strings.Cut(endpoint, "://")
+	host, _, _ := strings.Cut(rest, "/")
+	return host
+}
@@ -1,228 +1,661 @@
-package database
-
-import (
-	"database/sql"
-	"log"
-	"time"
-	"webpush/models"
-
-	_ "modernc.org/sqlite"
-)
-
-var DB *sql.DB
-
-// InitDB initializes the SQLite database
-func InitDB(dbPath string) error {
-	var err error
-	DB, err = sql.Open("sqlite", dbPath)
-	if err != nil {
-		return err
-	}
-
-	// Create tables
-	_, err = DB.Exec(`
-		CREATE TABLE IF NOT EXISTS subscriptions (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			endpoint TEXT NOT NULL UNIQUE,
-			p256dh TEXT NOT NULL,
-			auth TEXT NOT NULL,
-			ip TEXT,
-			nation TEXT,
-			os TEXT,
-			os_version TEXT,
-			browser TEXT,
-			browser_version TEXT,
-			platform TEXT,
-			platform_version TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			last_active DATETIME DEFAULT CURRENT_TIMESTAMP
-		);
-
-		CREATE TABLE IF NOT EXISTS push_stats (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			total_pushes INTEGER DEFAULT 0
-		);
-
-		-- Initialize push stats if not exists
-		INSERT OR IGNORE INTO push_stats (id, total_pushes) VALUES (1, 0);
-
-		CREATE INDEX IF NOT EXISTS idx_endpoint ON subscriptions(endpoint);
-		CREATE INDEX IF NOT EXISTS idx_nation ON subscriptions(nation);
-	`)
-
-	if err != nil {
-		return err
-	}
-
-	log.Println("Database initialized successfully")
-	return nil
-}
-
-// SaveSubscription saves or updates a subscription in the database
-func SaveSubscription(sub *models.Subscription) error {
-	_, err := DB.Exec(`
-		INSERT INTO subscriptions (endpoint, p256dh, auth, ip, nation, os, os_version, browser, browser_version, platform, platform_version)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(endpoint) DO UPDATE SET
-			ip = excluded.ip,
-			nation = excluded.nation,
-			os = excluded.os,
-			os_version = excluded.os_version,
-			browser = excluded.browser,
-			browser_version = excluded.browser_version,
-			platform = excluded.platform,
-			platform_version = excluded.platform_version,
-			last_active = CURRENT_TIMESTAMP
-	`, sub.Endpoint, sub.Keys.P256dh, sub.Keys.Auth, sub.IP, sub.Nation, sub.OS, sub.OSVersion, sub.Browser, sub.BrowserVersion, sub.Platform, sub.PlatformVersion)
-
-	return err
-}
-
-// GetAllSubscriptions retrieves all subscriptions from the database
-func GetAllSubscriptions() ([]models.Subscription, error) {
-	rows, err := DB.Query(`
-		SELECT endpoint, p256dh, auth, ip, nation, os, os_version, browser, browser_version, platform, platform_version
-		FROM subscriptions
-		ORDER BY created_at DESC
-	`)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var subscriptions []models.Subscription
-	for rows.Next() {
-		var sub models.Subscription
-		err := rows.Scan(
-			&sub.Endpoint,
-			&sub.Keys.P256dh,
-			&sub.Keys.Auth,
-			&sub.IP,
-			&sub.Nation,
-			&sub.OS,
-			&sub.OSVersion,
-			&sub.Browser,
-			&sub.BrowserVersion,
-			&sub.Platform,
-			&sub.PlatformVersion,
-		)
-		if err != nil {
-			log.Printf("Error scanning subscription: %v", err)
-			continue
-		}
-		subscriptions = append(subscriptions, sub)
-	}
-
-	return subscriptions, nil
-}
-
-// RemoveSubscription removes a subscription by endpoint
-func RemoveSubscription(endpoint string) error {
-	_, err := DB.Exec("DELETE FROM subscriptions WHERE endpoint = ?", endpoint)
-	return err
-}
-
-// IncrementPushCount increments the total push count
-func IncrementPushCount(count int) error {
-	_, err := DB.Exec("UPDATE push_stats SET total_pushes = total_pushes + ? WHERE id = 1", count)
-	return err
-}
-
-// GetPushCount returns the total push count
-func GetPushCount() int {
-	var count int
-	err := DB.QueryRow("SELECT total_pushes FROM push_stats WHERE id = 1").Scan(&count)
-	if err != nil {
-		log.Printf("Error getting push count: %v", err)
-		return 0
-	}
-	return count
-}
-
-// GetCountByNation returns a map of nation to subscriber count
-func GetCountByNation() (map[string]int, error) {
-	rows, err := DB.Query(`
-		SELECT nation, COUNT(*) as count
-		FROM subscriptions
-		WHERE nation IS NOT NULL AND nation != ''
-		GROUP BY nation
-		ORDER BY count DESC
-	`)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	counts := make(map[string]int)
-	for rows.Next() {
-		var nation string
-		var count int
-		if err := rows.Scan(&nation, &count); err != nil {
-			continue
-		}
-		counts[nation] = count
-	}
-
-	return counts, nil
-}
-
-// GetCountByBrowser returns a map of browser to count
-func GetCountByBrowser() (map[string]int, error) {
-	rows, err := DB.Query(`
-		SELECT browser, COUNT(*) as count
-		FROM subscriptions
-		WHERE browser IS NOT NULL AND browser != ''
-		GROUP BY browser
-		ORDER BY count DESC
-	`)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	counts := make(map[string]int)
-	for rows.Next() {
-		var browser string
-		var count int
-		if err := rows.Scan(&browser, &count); err != nil {
-			continue
-		}
-		counts[browser] = count
-	}
-
-	return counts, nil
-}
-
-// GetCountByOS returns a map of OS to count
-func GetCountByOS() (map[string]int, error) {
-	rows, err := DB.Query(`
-		SELECT os, COUNT(*) as count
-		FROM subscriptions
-		WHERE os IS NOT NULL AND os != ''
-		GROUP BY os
-		ORDER BY count DESC
-	`)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	counts := make(map[string]int)
-	for rows.Next() {
-		var os string
-		var count int
-		if err := rows.Scan(&os, &count); err != nil {
-			continue
-		}
-		counts[os] = count
-	}
-
-	return counts, nil
-}
-
-// CleanupOldSubscriptions removes subscriptions inactive for more than the specified duration
-func CleanupOldSubscriptions(days int) error {
-	cutoff := time.Now().AddDate(0, 0, -days)
-	_, err := DB.Exec("DELETE FROM subscriptions WHERE last_active < ?", cutoff)
-	return err
-}
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"webpush/models"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore is a Store backed by a SQLite database file. Writes go through
+// a single connection so they queue in Go instead of failing with
+// SQLITE_BUSY; reads use a separate pool, which WAL mode lets run alongside
+// the writer.
+type SQLiteStore struct {
+	db   *sql.DB // the single writer connection
+	read *sql.DB // read-only connection pool
+
+	stmtMu sync.Mutex
+	stmts  map[string]*sql.Stmt
+
+	// keys encrypts sensitive columns, nil when encryption is disabled
+	keys *Keyring
+
+	sqlMigrator
+}
+
+var (
+	_ Store     = (*SQLiteStore)(nil)
+	_ Migrator  = (*SQLiteStore)(nil)
+	_ Backuper  = (*SQLiteStore)(nil)
+	_ Encrypter = (*SQLiteStore)(nil)
+)
+
+// timeFormat matches the layout SQLite uses for CURRENT_TIMESTAMP, so
+// cutoffs compare correctly against stored DATETIME text
+const timeFormat = "2006-01-02 15:04:05"
+
+// SQLite connection settings
+const (
+	// sqliteBusyTimeout is how long a connection waits for a lock held by
+	// another process, such as a backup, before failing with SQLITE_BUSY
+	sqliteBusyTimeout = 5 * time.Second
+
+	// sqliteReadConns is the size of the read pool
+	sqliteReadConns = 4
+)
+
+// OpenSQLite opens the SQLite database at dbPath in WAL mode. Call Migrate to
+// create or upgrade its tables before use.
+func OpenSQLite(dbPath string) (*SQLiteStore, error) {
+	// IMMEDIATE transactions take the write lock up front, so a transaction
+	// never fails part way through when it upgrades from reading to writing
+	db, err := sql.Open("sqlite", sqliteDSN(dbPath, "_txlock=immediate", "_pragma=journal_mode(WAL)"))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+
+	// Ping opens the writer first so WAL mode is set before readers connect
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	read, err := sql.Open("sqlite", sqliteDSN(dbPath, "_pragma=query_only(1)"))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	read.SetMaxOpenConns(sqliteReadConns)
+	read.SetMaxIdleConns(sqliteReadConns)
+
+	log.Println("Database opened successfully")
+	return &SQLiteStore{
+		db:          db,
+		read:        read,
+		stmts:       make(map[string]*sql.Stmt),
+		sqlMigrator: sqlMigrator{db: db, dialect: DriverSQLite},
+	}, nil
+}
+
+// sqliteDSN builds a modernc.org/sqlite connection string for path with the
+// settings every connection shares plus params
+func sqliteDSN(path string, params ...string) string {
+	params = append([]string{
+		fmt.Sprintf("_pragma=busy_timeout(%d)", sqliteBusyTimeout.Milliseconds()),
+		"_pragma=synchronous(NORMAL)",
+	}, params...)
+
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	if !strings.HasPrefix(path, "file:") {
+		path = "file:" + path
+	}
+	return path + sep + strings.Join(params, "&")
+}
+
+// prepared returns a cached prepared statement for query on db, preparing
+// it on first use. Used for the queries run on every request.
+func (s *SQLiteStore) prepared(db *sql.DB, query string) (*sql.Stmt, error) {
+	key := query
+	if db == s.read {
+		key = "read:" + query
+	}
+
+	s.stmtMu.Lock()
+	defer s.stmtMu.Unlock()
+
+	if stmt, ok := s.stmts[key]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	s.stmts[key] = stmt
+	return stmt, nil
+}
+
+// Ping verifies the database connections are usable
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return err
+	}
+	return s.read.PingContext(ctx)
+}
+
+// SaveSubscription saves or updates a subscription in the database.
+// An update replaces the keys; an existing user ID or tags are kept when it does not set them.
+// CreatedAt and LastActive default to now when zero; last_active never moves back.
+// The IP is dated for retention with CreatedAt, or now when zero, on every save.
+func (s *SQLiteStore) SaveSubscription(sub *models.Subscription) error {
+	p256dh, auth, ip, err := s.keys.sealSubscription(sub)
+	if err != nil {
+		return err
+	}
+	stmt, err := s.prepared(s.db, saveSubscriptionSQL)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(sub.Endpoint, p256dh, auth, ip, sub.Nation, sub.Region, sub.City, sub.ASN, sub.ASOrg, sub.TimeZone, sub.OS, sub.OSVersion, sub.Browser, sub.BrowserVersion, sub.DeviceType, sub.Engine, sub.DeviceVendor, sub.PushService, sub.Platform, sub.PlatformVersion,
+		sub.ExpirationTime, sub.UserID, encodeTags(sub.Tags), sqliteDialect.optionalTime(sub.CreatedAt), sqliteDialect.optionalTime(sub.LastActive), sqliteDialect.optionalTime(sub.CreatedAt))
+
+	return err
+}
+
+// saveSubscriptionSQL upserts a subscription by endpoint
+const saveSubscriptionSQL = `
+	INSERT INTO subscriptions (endpoint, p256dh, auth, ip, nation, region, city, asn, as_org, timezone, os, os_version, browser, browser_version, device_type, engine, device_vendor, push_service, platform, platform_version, expiration_time, user_id, tags, created_at, last_active, ip_updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP), COALESCE(?, CURRENT_TIMESTAMP), COALESCE(?, CURRENT_TIMESTAMP))
+	ON CONFLICT(endpoint) DO UPDATE SET
+		p256dh = excluded.p256dh,
+		auth = excluded.auth,
+		ip = excluded.ip,
+		ip_updated_at = excluded.ip_updated_at,
+		nation = excluded.nation,
+		region = excluded.region,
+		city = excluded.city,
+		asn = excluded.asn,
+		as_org = excluded.as_org,
+		timezone = excluded.timezone,
+		os = excluded.os,
+		os_version = excluded.os_version,
+		browser = excluded.browser,
+		browser_version = excluded.browser_version,
+		device_type = excluded.device_type,
+		engine = excluded.engine,
+		device_vendor = excluded.device_vendor,
+		push_service = excluded.push_service,
+		platform = excluded.platform,
+		platform_version = excluded.platform_version,
+		expiration_time = excluded.expiration_time,
+		user_id = CASE WHEN excluded.user_id != '' THEN excluded.user_id ELSE subscriptions.user_id END,
+		tags = CASE WHEN excluded.tags != '[]' THEN excluded.tags ELSE subscriptions.tags END,
+		last_active = MAX(subscriptions.last_active, excluded.last_active)
+`
+
+// subscriptionColumns lists the columns scanned by scanSubscription
+const subscriptionColumns = `id, endpoint, p256dh, auth, ip, nation, region, city, asn, as_org, timezone, os, os_version, browser, browser_version, device_type, engine, device_vendor, push_service, platform, platform_version, expiration_time, user_id, tags, created_at, last_active`
+
+// scanSubscription scans a row selected with subscriptionColumns and decrypts its sensitive columns
+func (s *SQLiteStore) scanSubscription(row interface{ Scan(...any) error }) (models.Subscription, error) {
+	var sub models.Subscription
+	var tags string
+	err := row.Scan(
+		&sub.ID,
+		&sub.Endpoint,
+		&sub.Keys.P256dh,
+		&sub.Keys.Auth,
+		&sub.IP,
+		&sub.Nation,
+		&sub.Region,
+		&sub.City,
+		&sub.ASN,
+		&sub.ASOrg,
+		&sub.TimeZone,
+		&sub.OS,
+		&sub.OSVersion,
+		&sub.Browser,
+		&sub.BrowserVersion,
+		&sub.DeviceType,
+		&sub.Engine,
+		&sub.DeviceVendor,
+		&sub.PushService,
+		&sub.Platform,
+		&sub.PlatformVersion,
+		&sub.ExpirationTime,
+		&sub.UserID,
+		&tags,
+		&sub.CreatedAt,
+		&sub.LastActive,
+	)
+	if err != nil {
+		return sub, err
+	}
+	sub.Tags = decodeTags(tags)
+	return sub, s.keys.openSubscription(&sub)
+}
+
+// GetAllSubscriptions retrieves all subscriptions from the database
+func (s *SQLiteStore) GetAllSubscriptions() ([]models.Subscription, error) {
+	rows, err := s.read.Query(`SELECT ` + subscriptionColumns + ` FROM subscriptions ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []models.Subscription
+	for rows.Next() {
+		sub, err := s.scanSubscription(rows)
+		if err != nil {
+			log.Printf("Error scanning subscription: %v", err)
+			continue
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+
+	return subscriptions, nil
+}
+
+// ListSubscriptions returns one page of subscriptions matching q
+func (s *SQLiteStore) ListSubscriptions(q models.SubscriptionQuery) (models.SubscriptionPage, error) {
+	return subscriptionLister{
+		db:      s.read,
+		columns: subscriptionColumns,
+		scan:    s.scanSubscription,
+		dialect: sqliteDialect,
+	}.list(q)
+}
+
+// CountSubscriptions returns the number of stored subscriptions
+func (s *SQLiteStore) CountSubscriptions() (int, error) {
+	var count int
+	err := s.read.QueryRow("SELECT COUNT(*) FROM subscriptions").Scan(&count)
+	return count, err
+}
+
+// GetSubscription retrieves a single subscription by endpoint.
+// Returns nil if no subscription exists for the endpoint.
+func (s *SQLiteStore) GetSubscription(endpoint string) (*models.Subscription, error) {
+	stmt, err := s.prepared(s.read, `SELECT `+subscriptionColumns+` FROM subscriptions WHERE endpoint = ?`)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := s.scanSubscription(stmt.QueryRow(endpoint))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// SubscriptionSecrets returns the keys and IP of every subscription as stored
+func (s *SQLiteStore) SubscriptionSecrets() ([]SealedSecrets, error) {
+	rows, err := s.read.Query("SELECT endpoint, p256dh, auth, ip FROM subscriptions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var secrets []SealedSecrets
+	for rows.Next() {
+		var sec SealedSecrets
+		if err := rows.Scan(&sec.Endpoint, &sec.P256dh, &sec.Auth, &sec.IP); err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, sec)
+	}
+	return secrets, rows.Err()
+}
+
+// ReplaceSubscriptionSecrets overwrites the keys and IP of a subscription with
+// updated unless it was saved again since old was read
+func (s *SQLiteStore) ReplaceSubscriptionSecrets(old, updated SealedSecrets) (bool, error) {
+	res, err := s.db.Exec("UPDATE subscriptions SET p256dh = ?, auth = ?, ip = ? WHERE endpoint = ? AND p256dh = ? AND auth = ? AND ip = ?",
+		updated.P256dh, updated.Auth, updated.IP, old.Endpoint, old.P256dh, old.Auth, old.IP)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RemoveSubscription removes a subscription by endpoint
+func (s *SQLiteStore) RemoveSubscription(endpoint string) error {
+	_, err := s.db.Exec("DELETE FROM subscriptions WHERE endpoint = ?", endpoint)
+	return err
+}
+
+// EraseSubscription deletes a subscription, its delivery log and pending deliveries
+func (s *SQLiteStore) EraseSubscription(endpoint string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var n int64
+	for _, table := range []string{"subscriptions", "deliveries", "pending_deliveries"} {
+		res, err := tx.Exec("DELETE FROM "+table+" WHERE endpoint = ?", endpoint)
+		if err != nil {
+			return false, err
+		}
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		n += deleted
+	}
+	return n > 0, tx.Commit()
+}
+
+// TouchSubscription marks a subscription as active now.
+// Returns false if no subscription exists for the endpoint.
+func (s *SQLiteStore) TouchSubscription(endpoint string) (bool, error) {
+	stmt, err := s.prepared(s.db, "UPDATE subscriptions SET last_active = CURRENT_TIMESTAMP WHERE endpoint = ?")
+	if err != nil {
+		return false, err
+	}
+	res, err := stmt.Exec(endpoint)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SetSubscriptionLocation stores the GeoIP fields of sub without touching its other columns.
+// Returns false if no subscription exists for the endpoint.
+func (s *SQLiteStore) SetSubscriptionLocation(sub *models.Subscription) (bool, error) {
+	stmt, err := s.prepared(s.db, "UPDATE subscriptions SET nation = ?, region = ?, city = ?, asn = ?, as_org = ?, timezone = ? WHERE endpoint = ?")
+	if err != nil {
+		return false, err
+	}
+	res, err := stmt.Exec(sub.Nation, sub.Region, sub.City, sub.ASN, sub.ASOrg, sub.TimeZone, sub.Endpoint)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// CountActiveSince returns the number of subscriptions active at or after the given time
+func (s *SQLiteStore) CountActiveSince(since time.Time) (int, error) {
+	var count int
+	err := s.read.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE last_active >= ?",
+		since.UTC().Format(timeFormat)).Scan(&count)
+	return count, err
+}
+
+// IncrementPushCount increments the total push count
+func (s *SQLiteStore) IncrementPushCount(count int) error {
+	stmt, err := s.prepared(s.db, "UPDATE push_stats SET total_pushes = total_pushes + ? WHERE id = 1")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(count)
+	return err
+}
+
+// GetPushCount returns the total push count
+func (s *SQLiteStore) GetPushCount() (int, error) {
+	var count int
+	err := s.read.QueryRow("SELECT total_pushes FROM push_stats WHERE id = 1").Scan(&count)
+	return count, err
+}
+
+// CountSubscriptionsBy counts the subscriptions matching f, grouped by dimension
+func (s *SQLiteStore) CountSubscriptionsBy(dimension string, f models.SubscriptionFilter) (map[string]int, error) {
+	return countSubscriptionsBy(s.read, sqliteDialect, dimension, f)
+}
+
+// RecordDeliveries appends entries to the delivery log
+func (s *SQLiteStore) RecordDeliveries(deliveries []models.Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	// Prepare before Begin: the transaction holds the only writer connection
+	insert, err := s.prepared(s.db, "INSERT INTO deliveries (endpoint, event, status_code, created_at) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := tx.Stmt(insert)
+	defer stmt.Close()
+
+	for _, d := range deliveries {
+		if _, err := stmt.Exec(d.Endpoint, string(d.Event), d.StatusCode, d.CreatedAt.UTC().Format(timeFormat)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetDeliveries returns the delivery log of one endpoint, oldest first
+func (s *SQLiteStore) GetDeliveries(endpoint string) ([]models.Delivery, error) {
+	rows, err := s.read.Query("SELECT endpoint, event, status_code, created_at FROM deliveries WHERE endpoint = ? ORDER BY created_at, id", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []models.Delivery
+	for rows.Next() {
+		var d models.Delivery
+		if err := rows.Scan(&d.Endpoint, &d.Event, &d.StatusCode, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// PruneDeliveries deletes delivery log entries older than before
+func (s *SQLiteStore) PruneDeliveries(before time.Time) (int, error) {
+	res, err := s.db.Exec("DELETE FROM deliveries WHERE created_at < ?", before.UTC().Format(timeFormat))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// SavePendingDeliveries stores deliveries that were not sent before shutdown
+func (s *SQLiteStore) SavePendingDeliveries(pending []models.PendingDelivery) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO pending_deliveries (endpoint, payload, ttl, urgency) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, p := range pending {
+		if _, err := stmt.Exec(p.Endpoint, p.Payload, p.TTL, p.Urgency); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ClaimPendingDeliveries claims the pending deliveries that are unclaimed or
+// were claimed before abandonedBefore, oldest first
+func (s *SQLiteStore) ClaimPendingDeliveries(abandonedBefore time.Time) ([]models.PendingDelivery, error) {
+	rows, err := s.db.Query("UPDATE pending_deliveries SET claimed_at = ? WHERE claimed_at IS NULL OR claimed_at < ? RETURNING id, endpoint, payload, ttl, urgency",
+		time.Now().UTC().Format(timeFormat), abandonedBefore.UTC().Format(timeFormat))
+	if err != nil {
+		return nil, err
+	}
+	return scanPendingDeliveries(rows)
+}
+
+// DeletePendingDelivery deletes a claimed delivery
+func (s *SQLiteStore) DeletePendingDelivery(id int64) error {
+	_, err := s.db.Exec("DELETE FROM pending_deliveries WHERE id = ?", id)
+	return err
+}
+
+// ClaimIdempotencyKey records rec as in progress unless a live record holds its key,
+// which is returned instead
+func (s *SQLiteStore) ClaimIdempotencyKey(rec models.IdempotencyRecord, expiredBefore, abandonedBefore time.Time) (*models.IdempotencyRecord, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO idempotency_keys (idempotency_key, fingerprint, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(idempotency_key) DO UPDATE SET
+			fingerprint = excluded.fingerprint, status_code = 0, content_type = '', response = NULL, created_at = excluded.created_at
+		WHERE idempotency_keys.created_at < ? OR (idempotency_keys.status_code = 0 AND idempotency_keys.created_at < ?)
+	`, rec.Key, rec.Fingerprint, rec.CreatedAt.UTC().Format(timeFormat),
+		expiredBefore.UTC().Format(timeFormat), abandonedBefore.UTC().Format(timeFormat))
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, tx.Commit()
+	}
+
+	existing := models.IdempotencyRecord{Key: rec.Key}
+	err = tx.QueryRow("SELECT fingerprint, status_code, content_type, response, created_at FROM idempotency_keys WHERE idempotency_key = ?", rec.Key).
+		Scan(&existing.Fingerprint, &existing.StatusCode, &existing.ContentType, &existing.Response, &existing.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &existing, tx.Commit()
+}
+
+// CompleteIdempotencyKey stores the response of the request holding key
+func (s *SQLiteStore) CompleteIdempotencyKey(key string, statusCode int, contentType string, response []byte) error {
+	_, err := s.db.Exec("UPDATE idempotency_keys SET status_code = ?, content_type = ?, response = ? WHERE idempotency_key = ?",
+		statusCode, contentType, response, key)
+	return err
+}
+
+// ReleaseIdempotencyKey deletes key while it is still in progress
+func (s *SQLiteStore) ReleaseIdempotencyKey(key string) error {
+	_, err := s.db.Exec("DELETE FROM idempotency_keys WHERE idempotency_key = ? AND status_code = 0", key)
+	return err
+}
+
+// PruneIdempotencyKeys deletes keys created before before
+func (s *SQLiteStore) PruneIdempotencyKeys(before time.Time) (int, error) {
+	res, err := s.db.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", before.UTC().Format(timeFormat))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// EnableEncryption encrypts sensitive columns with k from now on. Rows written
+// before remain readable and are encrypted when next saved or on key rotation.
+func (s *SQLiteStore) EnableEncryption(k *Keyring) {
+	s.keys = k
+}
+
+// GetDataKeys returns all stored data encryption keys
+func (s *SQLiteStore) GetDataKeys() ([]DataKey, error) {
+	rows, err := s.read.Query("SELECT id, wrapped_key, active FROM encryption_keys ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []DataKey
+	for rows.Next() {
+		var k DataKey
+		if err := rows.Scan(&k.ID, &k.Wrapped, &k.Active); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// SaveDataKey inserts or updates a data key. Saving an active key deactivates the others.
+func (s *SQLiteStore) SaveDataKey(key DataKey) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if key.Active {
+		if _, err := tx.Exec("UPDATE encryption_keys SET active = 0"); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`
+		INSERT INTO encryption_keys (id, wrapped_key, active) VALUES (?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET wrapped_key = excluded.wrapped_key, active = excluded.active
+	`, key.ID, key.Wrapped, key.Active)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteDataKey removes a data key
+func (s *SQLiteStore) DeleteDataKey(id string) error {
+	_, err := s.db.Exec("DELETE FROM encryption_keys WHERE id = ?", id)
+	return err
+}
+
+// DataKeyInUse reports whether any subscription is still encrypted with the data key
+func (s *SQLiteStore) DataKeyInUse(id string) (bool, error) {
+	pattern := encryptedColumnPattern(id)
+	var inUse bool
+	err := s.read.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM subscriptions WHERE p256dh LIKE ? OR auth LIKE ? OR ip LIKE ?)
+	`, pattern, pattern, pattern).Scan(&inUse)
+	return inUse, err
+}
+
+// Close closes the database, checkpointing the WAL into the database file
+func (s *SQLiteStore) Close() error {
+	s.stmtMu.Lock()
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+	s.stmts = make(map[string]*sql.Stmt)
+	s.stmtMu.Unlock()
+
+	s.read.Close()
+	return s.db.Close()
+}
+
+// ClearSubscriptionIPs blanks the IPs written before before
+func (s *SQLiteStore) ClearSubscriptionIPs(before time.Time) (int, error) {
+	res, err := s.db.Exec("UPDATE subscriptions SET ip = '' WHERE ip != '' AND ip_updated_at < ?", before.UTC().Format(timeFormat))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// CleanupOldSubscriptions removes subscriptions inactive for more than the specified duration
+func (s *SQLiteStore) CleanupOldSubscriptions(days int) error {
+	cutoff := time.Now().AddDate(0, 0, -days)
+	_, err := s.db.Exec("DELETE FROM subscriptions WHERE last_active < ?", cutoff)
+	return err
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+	"testing"
+	"time"
+	"webpush/models"
+)
+
+// BenchmarkSQLiteConcurrent mixes subscription reads and writes from parallel
+// goroutines, as the handlers do under load: 80% reads (lookups, counts and a
+// listing page), 20% writes (heartbeats and resubscriptions). Run with -cpu to
+// vary the concurrency, e.g. go test -bench SQLiteConcurrent -cpu 1,4,16 ./database
+func BenchmarkSQLiteConcurrent(b *testing.B) {
+	s := newTestSQLiteStore(b)
+
+	const subscriptions = 1000
+	for i := 0; i < subscriptions; i++ {
+		mustSave(b, s, testSubscription(benchEndpoint(i), testTime.Add(time.Duration(i)*time.Second)))
+	}
+
+	var errs atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewPCG(rand.Uint64(), 0))
+		for pb.Next() {
+			endpoint := benchEndpoint(rng.IntN(subscriptions))
+			var err error
+			switch op := rng.IntN(10); {
+			case op < 5:
+				_, err = s.GetSubscription(endpoint)
+			case op < 7:
+				_, err = s.CountActiveSince(time.Now().Add(-time.Hour))
+			case op < 8:
+				_, err = s.ListSubscriptions(benchPageQuery)
+			case op < 9:
+				_, err = s.TouchSubscription(endpoint)
+			default:
+				sub := testSubscription(endpoint, time.Time{})
+				err = s.SaveSubscription(&sub)
+			}
+			if err != nil {
+				errs.Add(1)
+			}
+		}
+	})
+	if n := errs.Load(); n > 0 {
+		b.Fatalf("%d operations failed", n)
+	}
+}
+
+// benchPageQuery is the first page of the dashboard's subscription listing
+var benchPageQuery = models.SubscriptionQuery{Sort: models.SortLastActive, Limit: 50}
+
+// benchEndpoint returns the endpoint of the i-th benchmark subscription
+func benchEndpoint(i int) string {
+	return fmt.Sprintf("https://fcm.googleapis.com/fcm/send/bench-%d", i)
+}
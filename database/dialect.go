@@ -0,0 +1,93 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+	"webpush/models"
+)
+
+// sqlDialect holds the SQL that differs between SQLite and PostgreSQL
+type sqlDialect struct {
+	placeholder func(n int) string
+	timeArg     func(t time.Time) any
+	like        string // LIKE or ILIKE, whichever is case-insensitive
+
+	// pushService extracts the host from the endpoint URL
+	pushService string
+
+	// majorVersion returns the expression for the part of column before the first dot
+	majorVersion func(column string) string
+}
+
+var sqliteDialect = sqlDialect{
+	placeholder: func(int) string { return "?" },
+	timeArg:     func(t time.Time) any { return t.UTC().Format(timeFormat) },
+	like:        "LIKE",
+	pushService: `substr(endpoint, instr(endpoint, '://') + 3, instr(substr(endpoint, instr(endpoint, '://') + 3) || '/', '/') - 1)`,
+	majorVersion: func(column string) string {
+		return fmt.Sprintf(`CASE WHEN instr(%[1]s, '.') > 0 THEN substr(%[1]s, 1, instr(%[1]s, '.') - 1) ELSE COALESCE(%[1]s, '') END`, column)
+	},
+}
+
+var postgresDialect = sqlDialect{
+	placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+	timeArg:     func(t time.Time) any { return t },
+	like:        "ILIKE",
+	pushService: `split_part(split_part(endpoint, '://', 2), '/', 1)`,
+	majorVersion: func(column string) string {
+		return fmt.Sprintf("split_part(%s, '.', 1)", column)
+	},
+}
+
+// optionalTime binds t, or NULL when t is zero so the current time is used instead
+func (d sqlDialect) optionalTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return d.timeArg(t)
+}
+
+// filterConditions returns the WHERE conditions for f, binding values through arg
+func (d sqlDialect) filterConditions(f models.SubscriptionFilter, arg func(v any) string) []string {
+	var where []string
+	if f.Nation != "" {
+		where = append(where, "nation = "+arg(f.Nation))
+	}
+	if f.OS != "" {
+		where = append(where, "os = "+arg(f.OS))
+	}
+	if f.Browser != "" {
+		where = append(where, "browser = "+arg(f.Browser))
+	}
+	if f.PushService != "" {
+		where = append(where, d.pushService+" = "+arg(f.PushService))
+	}
+	if f.UserID != "" {
+		where = append(where, "user_id = "+arg(f.UserID))
+	}
+	return where
+}
+
+// scanPendingDeliveries reads and closes rows of id, endpoint, payload, ttl and
+// urgency, returning them oldest first
+func scanPendingDeliveries(rows *sql.Rows) ([]models.PendingDelivery, error) {
+	defer rows.Close()
+
+	var pending []models.PendingDelivery
+	for rows.Next() {
+		var p models.PendingDelivery
+		if err := rows.Scan(&p.ID, &p.Endpoint, &p.Payload, &p.TTL, &p.Urgency); err != nil {
+			return nil, err
+		}
+		pending = append(pending, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// RETURNING does not keep an order
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+	return pending, nil
+}
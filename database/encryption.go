@@ -0,0 +1,453 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"webpush/models"
+)
+
+// Encrypted column values are stored as enc:v1:<data key id>:<base64 nonce+ciphertext>.
+// Values without the prefix are plaintext written before encryption was enabled.
+const encryptedPrefix = "enc:v1:"
+
+// MasterKeySize is the length of the master key in bytes (AES-256)
+const MasterKeySize = 32
+
+// DataKey is a data encryption key as stored, wrapped by the master key
+type DataKey struct {
+	ID      string
+	Wrapped []byte
+	Active  bool
+}
+
+// KeyStore persists wrapped data encryption keys
+type KeyStore interface {
+	GetDataKeys() ([]DataKey, error)
+	// SaveDataKey inserts or updates a key; saving an active key deactivates the others
+	SaveDataKey(key DataKey) error
+	DeleteDataKey(id string) error
+	// DataKeyInUse reports whether any row is still encrypted with the key
+	DataKeyInUse(id string) (bool, error)
+}
+
+// Encrypter is implemented by stores that can encrypt sensitive subscription
+// columns (p256dh, auth and ip) at rest
+type Encrypter interface {
+	KeyStore
+	EnableEncryption(k *Keyring)
+	// SubscriptionSecrets returns the sensitive columns of every subscription as stored
+	SubscriptionSecrets() ([]SealedSecrets, error)
+	// ReplaceSubscriptionSecrets overwrites the sensitive columns of a
+	// subscription with updated if they still hold old, and reports whether they did
+	ReplaceSubscriptionSecrets(old, updated SealedSecrets) (bool, error)
+}
+
+// SealedSecrets are the sensitive columns of a subscription as stored: encrypted,
+// or plaintext from before encryption was enabled
+type SealedSecrets struct {
+	Endpoint string
+	P256dh   string
+	Auth     string
+	IP       string
+}
+
+// ErrMasterKeyRequired is returned when the database holds encrypted data but no master key is configured
+var ErrMasterKeyRequired = errors.New("database contains encrypted subscriptions; set WEBPUSH_ENCRYPTION_KEY or WEBPUSH_ENCRYPTION_KEY_FILE")
+
+// Keyring holds the unwrapped data keys and encrypts column values with the active one
+type Keyring struct {
+	store   KeyStore
+	masters []cipher.AEAD // current master first, then retired masters accepted for unwrapping
+
+	mu       sync.RWMutex
+	keys     map[string]cipher.AEAD
+	active   string
+	loadedAt time.Time
+}
+
+// keyringRefreshInterval is how often a running Keyring reloads data keys, so
+// instances start encrypting with a rotated key without a restart
+const keyringRefreshInterval = 5 * time.Minute
+
+// LoadMasterKey decodes a base64 master key from the environment value, or
+// from the file at path when the value is empty. Returns nil if neither is set.
+func LoadMasterKey(value, path string) ([]byte, error) {
+	if value == "" && path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		value = string(b)
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %w", err)
+	}
+	if len(key) != MasterKeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", MasterKeySize, len(key))
+	}
+	return key, nil
+}
+
+// OpenKeyring unwraps the data keys in store with master, trying oldMasters
+// for keys wrapped before a master key rotation. A data key is created if
+// the store has none.
+func OpenKeyring(store KeyStore, master []byte, oldMasters ...[]byte) (*Keyring, error) {
+	k := &Keyring{store: store, keys: make(map[string]cipher.AEAD)}
+	for _, m := range append([][]byte{master}, oldMasters...) {
+		aead, err := newAEAD(m)
+		if err != nil {
+			return nil, err
+		}
+		k.masters = append(k.masters, aead)
+	}
+
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	if k.active == "" {
+		if _, err := k.NewDataKey(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// reload unwraps every stored data key, picking up keys added by other instances
+func (k *Keyring) reload() error {
+	stored, err := k.store.GetDataKeys()
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, dk := range stored {
+		if _, ok := k.keys[dk.ID]; !ok {
+			raw, _, err := k.unwrap(dk)
+			if err != nil {
+				return err
+			}
+			aead, err := newAEAD(raw)
+			if err != nil {
+				return err
+			}
+			k.keys[dk.ID] = aead
+		}
+		if dk.Active {
+			k.active = dk.ID
+		}
+	}
+	k.loadedAt = time.Now()
+	return nil
+}
+
+// unwrap decrypts a data key with the first master key that accepts it and
+// reports whether that was the current master
+func (k *Keyring) unwrap(dk DataKey) ([]byte, bool, error) {
+	for i, master := range k.masters {
+		raw, err := openSealed(master, dk.Wrapped, dataKeyAAD(dk.ID))
+		if err == nil {
+			return raw, i == 0, nil
+		}
+	}
+	return nil, false, fmt.Errorf("data key %s cannot be unwrapped with the configured master key", dk.ID)
+}
+
+// NewDataKey generates a data key, stores it wrapped by the current master
+// key and makes it the active key for encryption
+func (k *Keyring) NewDataKey() (string, error) {
+	raw := make([]byte, 32)
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(idBytes)
+
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.masters[0], raw, dataKeyAAD(id))
+	if err != nil {
+		return "", err
+	}
+	if err := k.store.SaveDataKey(DataKey{ID: id, Wrapped: wrapped, Active: true}); err != nil {
+		return "", err
+	}
+
+	k.mu.Lock()
+	k.keys[id] = aead
+	k.active = id
+	k.mu.Unlock()
+	return id, nil
+}
+
+// Encrypt seals a column value of the subscription identified by endpoint.
+// The column and endpoint are bound to the ciphertext, so values cannot be
+// swapped between rows or columns. Empty values are stored as is.
+func (k *Keyring) Encrypt(column, endpoint, value string) (string, error) {
+	if k == nil || value == "" {
+		return value, nil
+	}
+
+	k.mu.RLock()
+	stale := time.Since(k.loadedAt) > keyringRefreshInterval
+	k.mu.RUnlock()
+	if stale {
+		if err := k.reload(); err != nil {
+			log.Printf("Error reloading data keys: %v", err)
+		}
+	}
+
+	k.mu.RLock()
+	id, aead := k.active, k.keys[k.active]
+	k.mu.RUnlock()
+
+	sealed, err := seal(aead, []byte(value), columnAAD(column, endpoint))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + id + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a column value written by Encrypt. Plaintext values are returned unchanged.
+func (k *Keyring) Decrypt(column, endpoint, value string) (string, error) {
+	rest, ok := strings.CutPrefix(value, encryptedPrefix)
+	if !ok {
+		return value, nil
+	}
+	if k == nil {
+		return "", ErrMasterKeyRequired
+	}
+
+	id, data, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted %s value", column)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted %s value: %w", column, err)
+	}
+
+	k.mu.RLock()
+	aead, found := k.keys[id]
+	k.mu.RUnlock()
+	if !found {
+		// Another instance may have rotated keys since we loaded them
+		if err := k.reload(); err != nil {
+			return "", err
+		}
+		k.mu.RLock()
+		aead, found = k.keys[id]
+		k.mu.RUnlock()
+		if !found {
+			return "", fmt.Errorf("unknown data key %s", id)
+		}
+	}
+
+	plain, err := openSealed(aead, sealed, columnAAD(column, endpoint))
+	if err != nil {
+		return "", fmt.Errorf("decrypting %s: %w", column, err)
+	}
+	return string(plain), nil
+}
+
+// sealSubscription returns the stored forms of a subscription's sensitive columns
+func (k *Keyring) sealSubscription(sub *models.Subscription) (p256dh, auth, ip string, err error) {
+	if p256dh, err = k.Encrypt("p256dh", sub.Endpoint, sub.Keys.P256dh); err != nil {
+		return
+	}
+	if auth, err = k.Encrypt("auth", sub.Endpoint, sub.Keys.Auth); err != nil {
+		return
+	}
+	ip, err = k.Encrypt("ip", sub.Endpoint, sub.IP)
+	return
+}
+
+// openSubscription decrypts a scanned subscription's sensitive columns in place
+func (k *Keyring) openSubscription(sub *models.Subscription) error {
+	var err error
+	if sub.Keys.P256dh, err = k.Decrypt("p256dh", sub.Endpoint, sub.Keys.P256dh); err != nil {
+		return err
+	}
+	if sub.Keys.Auth, err = k.Decrypt("auth", sub.Endpoint, sub.Keys.Auth); err != nil {
+		return err
+	}
+	sub.IP, err = k.Decrypt("ip", sub.Endpoint, sub.IP)
+	return err
+}
+
+// RotateDataKey creates a new active data key, re-encrypts every subscription
+// with it and re-wraps the older keys with the current master key, so a
+// retired master key is no longer needed. Older keys are kept, since running
+// instances may still write with them until they reload; remove them later
+// with PruneDataKeys. Returns the number of rows rewritten.
+func RotateDataKey(s Store, k *Keyring) (int, error) {
+	store, ok := s.(Encrypter)
+	if !ok {
+		return 0, errors.New("store does not support encryption")
+	}
+	if _, err := k.NewDataKey(); err != nil {
+		return 0, err
+	}
+
+	n, err := reencryptSubscriptions(store, k)
+	if err != nil {
+		return n, err
+	}
+
+	stored, err := store.GetDataKeys()
+	if err != nil {
+		return n, err
+	}
+	for _, dk := range stored {
+		if dk.Active {
+			continue
+		}
+		raw, current, err := k.unwrap(dk)
+		if err != nil {
+			return n, err
+		}
+		if current {
+			continue
+		}
+		if dk.Wrapped, err = seal(k.masters[0], raw, dataKeyAAD(dk.ID)); err != nil {
+			return n, err
+		}
+		if err := store.SaveDataKey(dk); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// PruneDataKeys re-encrypts every subscription with the active data key and
+// deletes the inactive keys no longer used by any row. Run it once every
+// instance has picked up the active key (after a restart or
+// keyringRefreshInterval). Returns the number of keys deleted.
+func PruneDataKeys(s Store, k *Keyring) (int, error) {
+	store, ok := s.(Encrypter)
+	if !ok {
+		return 0, errors.New("store does not support encryption")
+	}
+	if _, err := reencryptSubscriptions(store, k); err != nil {
+		return 0, err
+	}
+
+	stored, err := store.GetDataKeys()
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, dk := range stored {
+		if dk.Active {
+			continue
+		}
+		inUse, err := store.DataKeyInUse(dk.ID)
+		if err != nil {
+			return deleted, err
+		}
+		if inUse {
+			log.Printf("Data key %s is still in use, keeping it", dk.ID)
+			continue
+		}
+		if err := store.DeleteDataKey(dk.ID); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// reencryptSubscriptions rewrites every subscription's sensitive columns with
+// the active data key and returns the number of rows rewritten. A row that
+// cannot be decrypted stops it with an error, since skipping it would leave
+// the row on a key that is about to be retired. A row saved again meanwhile
+// already holds fresh values and is left alone.
+func reencryptSubscriptions(store Encrypter, k *Keyring) (int, error) {
+	rows, err := store.SubscriptionSecrets()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, old := range rows {
+		sub := models.Subscription{Endpoint: old.Endpoint, IP: old.IP}
+		sub.Keys.P256dh, sub.Keys.Auth = old.P256dh, old.Auth
+		if err := k.openSubscription(&sub); err != nil {
+			return n, fmt.Errorf("subscription %s: %w", old.Endpoint, err)
+		}
+		updated := SealedSecrets{Endpoint: old.Endpoint}
+		if updated.P256dh, updated.Auth, updated.IP, err = k.sealSubscription(&sub); err != nil {
+			return n, err
+		}
+		replaced, err := store.ReplaceSubscriptionSecrets(old, updated)
+		if err != nil {
+			return n, err
+		}
+		if replaced {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// encryptedColumnPattern returns a LIKE pattern matching values encrypted with the data key id
+func encryptedColumnPattern(id string) string {
+	return encryptedPrefix + id + ":%"
+}
+
+// dataKeyAAD binds a wrapped data key to its id
+func dataKeyAAD(id string) []byte {
+	return []byte("webpush data key " + id)
+}
+
+// columnAAD binds an encrypted value to its column and row
+func columnAAD(column, endpoint string) []byte {
+	return []byte(column + "\x00" + endpoint)
+}
+
+// newAEAD returns AES-256-GCM for key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, returning nonce followed by ciphertext
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// openSealed decrypts the output of seal
+func openSealed(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
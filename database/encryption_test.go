@@ -0,0 +1,84 @@
+package database
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// newTestEncryptedStore returns a SQLite store encrypting with a fresh keyring
+func newTestEncryptedStore(t *testing.T) (*SQLiteStore, *Keyring) {
+	t.Helper()
+	s := newTestSQLiteStore(t).(*SQLiteStore)
+	k, err := OpenKeyring(s, bytes.Repeat([]byte{7}, MasterKeySize))
+	if err != nil {
+		t.Fatalf("OpenKeyring: %v", err)
+	}
+	s.EnableEncryption(k)
+	return s, k
+}
+
+func TestRotateDataKey(t *testing.T) {
+	s, k := newTestEncryptedStore(t)
+	a := testSubscription("https://fcm.googleapis.com/fcm/send/a", testTime)
+	b := testSubscription("https://fcm.googleapis.com/fcm/send/b", testTime)
+	mustSave(t, s, a, b)
+	oldKey := k.active
+
+	if n, err := RotateDataKey(s, k); err != nil || n != 2 {
+		t.Fatalf("RotateDataKey = %d, %v, want 2", n, err)
+	}
+	if inUse, err := s.DataKeyInUse(oldKey); err != nil || inUse {
+		t.Errorf("DataKeyInUse(old key) = %v, %v, want false", inUse, err)
+	}
+	got, err := s.GetSubscription(a.Endpoint)
+	if err != nil || got.Keys != a.Keys || got.IP != a.IP {
+		t.Errorf("GetSubscription after rotation = %+v, %v", got, err)
+	}
+	if n, err := PruneDataKeys(s, k); err != nil || n != 1 {
+		t.Errorf("PruneDataKeys = %d, %v, want 1", n, err)
+	}
+}
+
+// TestRotateDataKeyUndecryptable checks that a row that cannot be decrypted
+// stops the rotation instead of being skipped
+func TestRotateDataKeyUndecryptable(t *testing.T) {
+	s, k := newTestEncryptedStore(t)
+	a := testSubscription("https://fcm.googleapis.com/fcm/send/a", testTime)
+	mustSave(t, s, a)
+
+	// A value sealed for another row does not open here
+	secrets, _ := s.SubscriptionSecrets()
+	broken := secrets[0]
+	if broken.Auth, _ = k.Encrypt("auth", "https://example.com/other", a.Keys.Auth); broken.Auth == "" {
+		t.Fatal("Encrypt failed")
+	}
+	if ok, err := s.ReplaceSubscriptionSecrets(secrets[0], broken); err != nil || !ok {
+		t.Fatalf("ReplaceSubscriptionSecrets = %v, %v", ok, err)
+	}
+
+	_, err := RotateDataKey(s, k)
+	if err == nil || !strings.Contains(err.Error(), a.Endpoint) {
+		t.Errorf("RotateDataKey error = %v, want one naming %s", err, a.Endpoint)
+	}
+}
+
+// TestReplaceSubscriptionSecretsStale checks that secrets read before a save
+// do not overwrite the saved ones
+func TestReplaceSubscriptionSecretsStale(t *testing.T) {
+	s, _ := newTestEncryptedStore(t)
+	a := testSubscription("https://fcm.googleapis.com/fcm/send/a", testTime)
+	mustSave(t, s, a)
+	secrets, _ := s.SubscriptionSecrets()
+
+	a.Keys.Auth = "auth-rotated"
+	mustSave(t, s, a)
+
+	if ok, err := s.ReplaceSubscriptionSecrets(secrets[0], secrets[0]); err != nil || ok {
+		t.Errorf("ReplaceSubscriptionSecrets(stale) = %v, %v, want false", ok, err)
+	}
+	got, _ := s.GetSubscription(a.Endpoint)
+	if got.Keys.Auth != "auth-rotated" {
+		t.Errorf("Auth = %q, want the saved value kept", got.Keys.Auth)
+	}
+}
@@ -0,0 +1,397 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"webpush/models"
+	"webpush/utils"
+)
+
+// Subscription export and import formats
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// exportPageSize is the number of subscriptions read per query while exporting
+const exportPageSize = 500
+
+// maxImportErrors caps the row errors listed in an ImportResult; Failed still counts all of them
+const maxImportErrors = 100
+
+// maxImportLine bounds one NDJSON line
+const maxImportLine = 1 << 20
+
+// csvColumns is the header of a CSV export. Imports match columns by these
+// names in any order and ignore unknown ones.
+var csvColumns = []string{
+	"endpoint", "p256dh", "auth", "ip", "nation", "region", "city", "asn", "as_org", "timezone",
+	"os", "os_version", "browser", "browser_version", "device_type", "engine", "device_vendor", "push_service",
+	"platform", "platform_version", "expiration_time", "user_id", "tags", "created_at", "last_active",
+}
+
+// FormatFromName returns the format implied by a file name's extension, or "" if none
+func FormatFromName(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".csv"):
+		return FormatCSV
+	case strings.HasSuffix(name, ".ndjson"), strings.HasSuffix(name, ".jsonl"):
+		return FormatNDJSON
+	}
+	return ""
+}
+
+// ExportSubscriptions writes every subscription to w in format, oldest first.
+// Subscriptions are read a page at a time, so the export never holds the whole
+// table in memory. Returns the number of subscriptions written.
+func ExportSubscriptions(w io.Writer, s SubscriptionStore, format string) (int, error) {
+	var write func(sub models.Subscription) error
+	flush := func() error { return nil }
+
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvColumns); err != nil {
+			return 0, err
+		}
+		write = func(sub models.Subscription) error { return cw.Write(csvRecord(sub)) }
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case FormatNDJSON:
+		enc := json.NewEncoder(w)
+		write = func(sub models.Subscription) error { return enc.Encode(sub) }
+	default:
+		return 0, fmt.Errorf("unknown format %q", format)
+	}
+
+	q := models.SubscriptionQuery{Sort: models.SortCreatedAt, Asc: true, Limit: exportPageSize}
+	n := 0
+	for {
+		page, err := s.ListSubscriptions(q)
+		if err != nil {
+			return n, err
+		}
+		for _, sub := range page.Subscriptions {
+			if err := write(sub); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if err := flush(); err != nil {
+			return n, err
+		}
+		if page.NextCursor == "" {
+			return n, nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+// csvRecord returns the CSV fields of sub, in csvColumns order
+func csvRecord(sub models.Subscription) []string {
+	var expiration, asn string
+	if sub.ExpirationTime != nil {
+		expiration = strconv.FormatInt(*sub.ExpirationTime, 10)
+	}
+	if sub.ASN != 0 {
+		asn = strconv.Itoa(sub.ASN)
+	}
+	return []string{
+		sub.Endpoint, sub.Keys.P256dh, sub.Keys.Auth, sub.IP, sub.Nation, sub.Region, sub.City, asn, sub.ASOrg, sub.TimeZone, sub.OS, sub.OSVersion, sub.Browser, sub.BrowserVersion, sub.DeviceType, sub.Engine, sub.DeviceVendor, sub.PushService,
+		sub.Platform, sub.PlatformVersion, expiration, sub.UserID, strings.Join(sub.Tags, ";"),
+		formatCSVTime(sub.CreatedAt), formatCSVTime(sub.LastActive),
+	}
+}
+
+// formatCSVTime formats t as RFC 3339, or "" when zero
+func formatCSVTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// ImportResult reports the outcome of an import
+type ImportResult struct {
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Failed  int           `json:"failed"`
+	Errors  []ImportError `json:"errors,omitempty"`
+}
+
+// ImportError describes a rejected input row
+type ImportError struct {
+	Line     int    `json:"line"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Error    string `json:"error"`
+}
+
+// importRow is one parsed input row; err is set when the row cannot be parsed
+type importRow struct {
+	line int
+	sub  models.Subscription
+	err  error
+}
+
+// ImportSubscriptions reads subscriptions in format from r, validates each one
+// and upserts it by endpoint, so importing the same file twice is harmless.
+// Imported IPs are stored as anonymizer stores client addresses.
+// Invalid rows are skipped and reported in the result. With dryRun rows are
+// only validated and counted. An error is returned only when the input cannot
+// be read at all.
+func ImportSubscriptions(r io.Reader, s SubscriptionStore, anonymizer *utils.IPAnonymizer, format string, dryRun bool) (ImportResult, error) {
+	var result ImportResult
+
+	var next func() (importRow, error)
+	switch format {
+	case FormatCSV:
+		var err error
+		if next, err = csvRows(r); err != nil {
+			return result, err
+		}
+	case FormatNDJSON:
+		next = ndjsonRows(r)
+	default:
+		return result, fmt.Errorf("unknown format %q", format)
+	}
+
+	fail := func(row importRow, err error) {
+		result.Failed++
+		if len(result.Errors) < maxImportErrors {
+			result.Errors = append(result.Errors, ImportError{Line: row.line, Endpoint: row.sub.Endpoint, Error: err.Error()})
+		}
+	}
+
+	// A dry run saves nothing, so remember endpoints to count repeats within the file as updates
+	seen := make(map[string]bool)
+
+	for {
+		row, err := next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		if row.err != nil {
+			fail(row, row.err)
+			continue
+		}
+		if err := validateImport(&row.sub); err != nil {
+			fail(row, err)
+			continue
+		}
+		// Derived from the endpoint, so an imported value is not trusted
+		row.sub.PushService = utils.ClassifyPushService(row.sub.Endpoint)
+		// Stored under this instance's WEBPUSH_IP_MODE, whatever the source kept
+		row.sub.IP = anonymizer.AnonymizeString(row.sub.IP)
+
+		existing, err := s.GetSubscription(row.sub.Endpoint)
+		if err != nil {
+			fail(row, err)
+			continue
+		}
+		if !dryRun {
+			if err := s.SaveSubscription(&row.sub); err != nil {
+				fail(row, err)
+				continue
+			}
+		}
+		if existing != nil || seen[row.sub.Endpoint] {
+			result.Updated++
+		} else {
+			result.Created++
+		}
+		if dryRun {
+			seen[row.sub.Endpoint] = true
+		}
+	}
+}
+
+// csvRows reads the CSV header from r and returns a function yielding each following row
+func csvRows(r io.Reader) (func() (importRow, error), error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("empty CSV input")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	index := make(map[string]int)
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, required := range []string{"endpoint", "p256dh", "auth"} {
+		if _, ok := index[required]; !ok {
+			return nil, fmt.Errorf("CSV header has no %s column", required)
+		}
+	}
+
+	return func() (importRow, error) {
+		record, err := cr.Read()
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return importRow{line: parseErr.Line, err: parseErr.Err}, nil
+		}
+		if err != nil {
+			return importRow{}, err
+		}
+
+		field := func(name string) string {
+			if i, ok := index[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		line, _ := cr.FieldPos(0)
+		row := importRow{line: line}
+		row.sub, row.err = parseCSVSubscription(field)
+		return row, nil
+	}, nil
+}
+
+// parseCSVSubscription builds a subscription from the named fields of a CSV row
+func parseCSVSubscription(field func(name string) string) (models.Subscription, error) {
+	var sub models.Subscription
+	sub.Endpoint = field("endpoint")
+	sub.Keys.P256dh = field("p256dh")
+	sub.Keys.Auth = field("auth")
+	sub.IP = field("ip")
+	sub.Nation = field("nation")
+	sub.Region = field("region")
+	sub.City = field("city")
+	sub.ASOrg = field("as_org")
+	sub.TimeZone = field("timezone")
+	sub.OS = field("os")
+	sub.OSVersion = field("os_version")
+	sub.Browser = field("browser")
+	sub.BrowserVersion = field("browser_version")
+	sub.DeviceType = field("device_type")
+	sub.Engine = field("engine")
+	sub.DeviceVendor = field("device_vendor")
+	sub.Platform = field("platform")
+	sub.PlatformVersion = field("platform_version")
+	sub.UserID = field("user_id")
+
+	if v := field("tags"); v != "" {
+		for _, tag := range strings.Split(v, ";") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				sub.Tags = append(sub.Tags, tag)
+			}
+		}
+	}
+	if v := field("asn"); v != "" {
+		asn, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(v), "AS"))
+		if err != nil {
+			return sub, fmt.Errorf("invalid asn %q", v)
+		}
+		sub.ASN = asn
+	}
+	if v := field("expiration_time"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return sub, fmt.Errorf("invalid expiration_time %q", v)
+		}
+		sub.ExpirationTime = &ms
+	}
+
+	var err error
+	if sub.CreatedAt, err = parseCSVTime("created_at", field("created_at")); err != nil {
+		return sub, err
+	}
+	if sub.LastActive, err = parseCSVTime("last_active", field("last_active")); err != nil {
+		return sub, err
+	}
+	return sub, nil
+}
+
+// parseCSVTime parses an RFC 3339 timestamp, returning the zero time for ""
+func parseCSVTime(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("invalid %s %q, want RFC 3339", name, value)
+	}
+	return t, nil
+}
+
+// ndjsonRows returns a function yielding each non-empty line of r as a subscription,
+// in the JSON shape of the subscribe API and of an NDJSON export
+func ndjsonRows(r io.Reader) func() (importRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+	line := 0
+
+	return func() (importRow, error) {
+		for scanner.Scan() {
+			line++
+			b := bytes.TrimSpace(scanner.Bytes())
+			if len(b) == 0 {
+				continue
+			}
+			row := importRow{line: line}
+			if err := json.Unmarshal(b, &row.sub); err != nil {
+				row.err = fmt.Errorf("invalid JSON: %w", err)
+			}
+			return row, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return importRow{}, fmt.Errorf("line %d: %w", line+1, err)
+		}
+		return importRow{}, io.EOF
+	}
+}
+
+// validateImport checks that sub can receive pushes: an https endpoint, a P-256
+// public key and a 16-byte auth secret
+func validateImport(sub *models.Subscription) error {
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("endpoint must be an https URL")
+	}
+
+	p256dh, err := decodeSubscriptionKey(sub.Keys.P256dh)
+	if err != nil {
+		return errors.New("p256dh is not valid base64")
+	}
+	if _, err := ecdh.P256().NewPublicKey(p256dh); err != nil {
+		return errors.New("p256dh is not an uncompressed P-256 public key")
+	}
+
+	auth, err := decodeSubscriptionKey(sub.Keys.Auth)
+	if err != nil {
+		return errors.New("auth is not valid base64")
+	}
+	if len(auth) != 16 {
+		return fmt.Errorf("auth must be 16 bytes, got %d", len(auth))
+	}
+	return nil
+}
+
+// decodeSubscriptionKey decodes a key in URL-safe or standard base64, padded or not,
+// since exports from other systems use either
+func decodeSubscriptionKey(key string) ([]byte, error) {
+	key = strings.TrimRight(key, "=")
+	if strings.ContainsAny(key, "+/") {
+		return base64.RawStdEncoding.DecodeString(key)
+	}
+	return base64.RawURLEncoding.DecodeString(key)
+}
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"webpush/utils"
+)
+
+// testImportKeys returns a valid p256dh and auth pair, base64url encoded
+func testImportKeys(t *testing.T) (p256dh, auth string) {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	return base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()), base64.RawURLEncoding.EncodeToString(secret)
+}
+
+func TestImportSubscriptions(t *testing.T) {
+	anonymizer, err := utils.NewIPAnonymizer(utils.IPModeTruncate, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMemoryStore()
+	const endpoint = "https://fcm.googleapis.com/fcm/send/a"
+
+	p256dh, auth := testImportKeys(t)
+	csv := fmt.Sprintf("endpoint,p256dh,auth,ip\n%s,%s,%s,192.0.2.77\n", endpoint, p256dh, auth)
+	result, err := ImportSubscriptions(strings.NewReader(csv), s, anonymizer, FormatCSV, false)
+	if err != nil || result.Created != 1 || result.Failed != 0 {
+		t.Fatalf("ImportSubscriptions = %+v, %v, want 1 created", result, err)
+	}
+	got, _ := s.GetSubscription(endpoint)
+	if got == nil || got.IP != "192.0.2.0" {
+		t.Fatalf("imported subscription = %+v, want IP truncated to 192.0.2.0", got)
+	}
+
+	// Reimporting with new keys updates them, and a value that is no address is dropped
+	p256dh, auth = testImportKeys(t)
+	csv = fmt.Sprintf("endpoint,p256dh,auth,ip\n%s,%s,%s,not-an-ip\n", endpoint, p256dh, auth)
+	result, err = ImportSubscriptions(strings.NewReader(csv), s, anonymizer, FormatCSV, false)
+	if err != nil || result.Updated != 1 {
+		t.Fatalf("reimport = %+v, %v, want 1 updated", result, err)
+	}
+	got, _ = s.GetSubscription(endpoint)
+	if got.Keys.P256dh != p256dh || got.Keys.Auth != auth {
+		t.Errorf("keys after reimport = %+v, want the imported ones", got.Keys)
+	}
+	if got.IP != "" {
+		t.Errorf("IP after reimport = %q, want dropped", got.IP)
+	}
+}
@@ -0,0 +1,195 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"webpush/models"
+)
+
+// ErrInvalidCursor is returned for a cursor that is malformed or was issued for a different sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// listCursor is the position after the last subscription of a page: its
+// sort value, with the row id to break ties
+type listCursor struct {
+	Sort string    `json:"s"`
+	Asc  bool      `json:"a,omitempty"`
+	At   time.Time `json:"t"`
+	ID   int64     `json:"i"`
+}
+
+// sortValue returns the value sub is ordered by
+func sortValue(sub models.Subscription, sort string) time.Time {
+	if sort == models.SortLastActive {
+		return sub.LastActive
+	}
+	return sub.CreatedAt
+}
+
+// encodeCursor returns the opaque cursor for the page following sub
+func encodeCursor(q models.SubscriptionQuery, sub models.Subscription) string {
+	b, _ := json.Marshal(listCursor{Sort: q.Sort, Asc: q.Asc, At: sortValue(sub, q.Sort), ID: sub.ID})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses q.Cursor, returning nil for the first page
+func decodeCursor(q models.SubscriptionQuery) (*listCursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c listCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Sort != q.Sort || c.Asc != q.Asc {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// after reports whether sub comes after the cursor position in the listing order
+func (c *listCursor) after(sub models.Subscription) bool {
+	if c == nil {
+		return true
+	}
+	at := sortValue(sub, c.Sort)
+	if c.Asc {
+		return at.After(c.At) || (at.Equal(c.At) && sub.ID > c.ID)
+	}
+	return at.Before(c.At) || (at.Equal(c.At) && sub.ID < c.ID)
+}
+
+// validateQuery checks the sort key, which is interpolated into SQL, and the page size
+func validateQuery(q models.SubscriptionQuery) error {
+	if q.Sort != models.SortCreatedAt && q.Sort != models.SortLastActive {
+		return fmt.Errorf("unknown sort %q", q.Sort)
+	}
+	if q.Limit <= 0 {
+		return errors.New("limit must be positive")
+	}
+	return nil
+}
+
+// matchesFilters reports whether sub passes the exact-match filters in f
+func matchesFilters(sub models.Subscription, f models.SubscriptionFilter) bool {
+	return (f.Nation == "" || sub.Nation == f.Nation) &&
+		(f.OS == "" || sub.OS == f.OS) &&
+		(f.Browser == "" || sub.Browser == f.Browser) &&
+		(f.PushService == "" || pushServiceHost(sub.Endpoint) == f.PushService) &&
+		(f.UserID == "" || sub.UserID == f.UserID)
+}
+
+// matchesSearch reports whether the endpoint of sub contains the search text
+func matchesSearch(sub models.Subscription, search string) bool {
+	return search == "" || strings.Contains(strings.ToLower(sub.Endpoint), strings.ToLower(search))
+}
+
+// escapeLike escapes LIKE wildcards in s for use with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// subscriptionLister pages through subscriptions in a SQL store with keyset
+// pagination on (sort column, id)
+type subscriptionLister struct {
+	db      *sql.DB
+	columns string
+	scan    func(row interface{ Scan(...any) error }) (models.Subscription, error)
+	dialect sqlDialect
+}
+
+// list returns the page of subscriptions selected by q
+func (l subscriptionLister) list(q models.SubscriptionQuery) (models.SubscriptionPage, error) {
+	var page models.SubscriptionPage
+	if err := validateQuery(q); err != nil {
+		return page, err
+	}
+
+	cursor, err := decodeCursor(q)
+	if err != nil {
+		return page, err
+	}
+
+	// Fetch one extra row to learn whether there is a next page
+	batch := q.Limit + 1
+
+	var subs []models.Subscription
+	for {
+		query, args := l.query(q, cursor, batch)
+		rows, err := l.db.Query(query, args...)
+		if err != nil {
+			return page, err
+		}
+
+		scanned := 0
+		for rows.Next() {
+			sub, err := l.scan(rows)
+			scanned++
+			if sub.ID != 0 {
+				// Move past rows that fail to decrypt too, or a batch of them would repeat forever
+				cursor = &listCursor{Sort: q.Sort, Asc: q.Asc, At: sortValue(sub, q.Sort), ID: sub.ID}
+			}
+			if err != nil {
+				log.Printf("Error scanning subscription: %v", err)
+				continue
+			}
+			subs = append(subs, sub)
+			if len(subs) > q.Limit {
+				break
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return page, err
+		}
+
+		if len(subs) > q.Limit || scanned < batch {
+			break
+		}
+	}
+
+	if len(subs) > q.Limit {
+		subs = subs[:q.Limit]
+		page.NextCursor = encodeCursor(q, subs[len(subs)-1])
+	}
+	page.Subscriptions = subs
+	return page, nil
+}
+
+// query builds the SELECT for one batch of the listing after cursor
+func (l subscriptionLister) query(q models.SubscriptionQuery, cursor *listCursor, limit int) (string, []any) {
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return l.dialect.placeholder(len(args))
+	}
+
+	where := l.dialect.filterConditions(q.SubscriptionFilter, arg)
+	if q.Search != "" {
+		where = append(where, fmt.Sprintf(`endpoint %s %s ESCAPE '\'`, l.dialect.like, arg("%"+escapeLike(q.Search)+"%")))
+	}
+
+	column, dir, cmp := q.Sort, "DESC", "<"
+	if q.Asc {
+		dir, cmp = "ASC", ">"
+	}
+	if cursor != nil {
+		at := l.dialect.timeArg(cursor.At)
+		where = append(where, fmt.Sprintf("(%[1]s %[2]s %[3]s OR (%[1]s = %[4]s AND id %[2]s %[5]s))",
+			column, cmp, arg(at), arg(at), arg(cursor.ID)))
+	}
+
+	query := "SELECT " + l.columns + " FROM subscriptions"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %[1]s %[2]s, id %[2]s LIMIT %[3]d", column, dir, limit)
+	return query, args
+}
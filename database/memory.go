@@ -0,0 +1,550 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+	"webpush/models"
+)
+
+// MemoryStore is a Store that keeps everything in memory, for tests and local development
+type MemoryStore struct {
+	mu          sync.Mutex
+	subs        map[string]*models.Subscription
+	ipUpdated   map[string]time.Time // when each subscription's IP was last written
+	seq         int64
+	totalPushes int
+	timeseries  map[memoryBucketKey]models.PushCounts
+	deliveries  []models.Delivery
+	pending     []memoryPending
+	pendingSeq  int64
+	idempotency map[string]models.IdempotencyRecord
+}
+
+// memoryPending is a pending delivery and when it was claimed, zero if unclaimed
+type memoryPending struct {
+	models.PendingDelivery
+	claimedAt time.Time
+}
+
+// memoryBucketKey identifies one time series row
+type memoryBucketKey struct {
+	resolution string
+	bucket     time.Time
+	key        models.PushStatKey
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		subs:        make(map[string]*models.Subscription),
+		ipUpdated:   make(map[string]time.Time),
+		timeseries:  make(map[memoryBucketKey]models.PushCounts),
+		idempotency: make(map[string]models.IdempotencyRecord),
+	}
+}
+
+// Ping always succeeds
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close is a no-op
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// SaveSubscription saves or updates a subscription.
+// An update replaces the keys; an existing user ID or tags are kept when it does not set them.
+// CreatedAt and LastActive default to now when zero; LastActive never moves back.
+// The IP is dated for retention with CreatedAt, or now when zero, on every save.
+func (m *MemoryStore) SaveSubscription(sub *models.Subscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	saved := *sub
+	saved.Tags = append([]string(nil), sub.Tags...)
+	if saved.CreatedAt.IsZero() {
+		saved.CreatedAt = now
+	}
+	if saved.LastActive.IsZero() {
+		saved.LastActive = now
+	}
+	m.ipUpdated[sub.Endpoint] = saved.CreatedAt
+
+	if existing, ok := m.subs[sub.Endpoint]; ok {
+		saved.ID = existing.ID
+		saved.CreatedAt = existing.CreatedAt
+		if saved.UserID == "" {
+			saved.UserID = existing.UserID
+		}
+		if len(saved.Tags) == 0 {
+			saved.Tags = existing.Tags
+		}
+		if saved.LastActive.Before(existing.LastActive) {
+			saved.LastActive = existing.LastActive
+		}
+		*existing = saved
+		return nil
+	}
+
+	m.seq++
+	saved.ID = m.seq
+	m.subs[sub.Endpoint] = &saved
+	return nil
+}
+
+// GetSubscription retrieves a single subscription by endpoint, or nil if it does not exist
+func (m *MemoryStore) GetSubscription(endpoint string) (*models.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.subs[endpoint]
+	if !ok {
+		return nil, nil
+	}
+	sub := *stored
+	return &sub, nil
+}
+
+// GetAllSubscriptions returns all subscriptions, newest first
+func (m *MemoryStore) GetAllSubscriptions() ([]models.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subs := make([]models.Subscription, 0, len(m.subs))
+	for _, s := range m.subs {
+		subs = append(subs, *s)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID > subs[j].ID })
+	return subs, nil
+}
+
+// ListSubscriptions returns one page of subscriptions matching q
+func (m *MemoryStore) ListSubscriptions(q models.SubscriptionQuery) (models.SubscriptionPage, error) {
+	var page models.SubscriptionPage
+	if err := validateQuery(q); err != nil {
+		return page, err
+	}
+	cursor, err := decodeCursor(q)
+	if err != nil {
+		return page, err
+	}
+
+	m.mu.Lock()
+	var subs []models.Subscription
+	for _, s := range m.subs {
+		if matchesFilters(*s, q.SubscriptionFilter) && matchesSearch(*s, q.Search) && cursor.after(*s) {
+			subs = append(subs, *s)
+		}
+	}
+	m.mu.Unlock()
+
+	sort.Slice(subs, func(i, j int) bool {
+		a, b := sortValue(subs[i], q.Sort), sortValue(subs[j], q.Sort)
+		if !a.Equal(b) {
+			return a.Before(b) == q.Asc
+		}
+		return (subs[i].ID < subs[j].ID) == q.Asc
+	})
+
+	if len(subs) > q.Limit {
+		subs = subs[:q.Limit]
+		page.NextCursor = encodeCursor(q, subs[len(subs)-1])
+	}
+	page.Subscriptions = subs
+	return page, nil
+}
+
+// CountSubscriptions returns the number of stored subscriptions
+func (m *MemoryStore) CountSubscriptions() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.subs), nil
+}
+
+// RemoveSubscription removes a subscription by endpoint
+func (m *MemoryStore) RemoveSubscription(endpoint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.subs, endpoint)
+	delete(m.ipUpdated, endpoint)
+	return nil
+}
+
+// EraseSubscription deletes a subscription, its delivery log and pending deliveries
+func (m *MemoryStore) EraseSubscription(endpoint string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, found := m.subs[endpoint]
+	delete(m.subs, endpoint)
+	delete(m.ipUpdated, endpoint)
+
+	deliveries := m.deliveries[:0]
+	for _, d := range m.deliveries {
+		if d.Endpoint != endpoint {
+			deliveries = append(deliveries, d)
+		}
+	}
+	found = found || len(deliveries) < len(m.deliveries)
+	clear(m.deliveries[len(deliveries):])
+	m.deliveries = deliveries
+
+	pending := m.pending[:0]
+	for _, p := range m.pending {
+		if p.Endpoint != endpoint {
+			pending = append(pending, p)
+		}
+	}
+	found = found || len(pending) < len(m.pending)
+	clear(m.pending[len(pending):])
+	m.pending = pending
+
+	return found, nil
+}
+
+// TouchSubscription marks a subscription as active now.
+// Returns false if no subscription exists for the endpoint.
+func (m *MemoryStore) TouchSubscription(endpoint string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.subs[endpoint]
+	if !ok {
+		return false, nil
+	}
+	stored.LastActive = time.Now().UTC().Truncate(time.Second)
+	return true, nil
+}
+
+// SetSubscriptionLocation stores the GeoIP fields of sub without touching its other fields.
+// Returns false if no subscription exists for the endpoint.
+func (m *MemoryStore) SetSubscriptionLocation(sub *models.Subscription) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.subs[sub.Endpoint]
+	if !ok {
+		return false, nil
+	}
+	stored.Nation, stored.Region, stored.City = sub.Nation, sub.Region, sub.City
+	stored.ASN, stored.ASOrg, stored.TimeZone = sub.ASN, sub.ASOrg, sub.TimeZone
+	return true, nil
+}
+
+// CountActiveSince returns the number of subscriptions active at or after the given time
+func (m *MemoryStore) CountActiveSince(since time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	since = since.Truncate(time.Second)
+	count := 0
+	for _, s := range m.subs {
+		if !s.LastActive.Before(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// CountSubscriptionsBy counts the subscriptions matching f, grouped by dimension
+func (m *MemoryStore) CountSubscriptionsBy(dimension string, f models.SubscriptionFilter) (map[string]int, error) {
+	if _, ok := breakdownValue(models.Subscription{}, dimension); !ok {
+		return nil, fmt.Errorf("unknown breakdown %q", dimension)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, s := range m.subs {
+		if !matchesFilters(*s, f) {
+			continue
+		}
+		if v, _ := breakdownValue(*s, dimension); v != "" {
+			counts[v]++
+		}
+	}
+	return counts, nil
+}
+
+// ClearSubscriptionIPs blanks the IPs written before before
+func (m *MemoryStore) ClearSubscriptionIPs(before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for _, s := range m.subs {
+		if s.IP != "" && m.ipUpdated[s.Endpoint].Before(before) {
+			s.IP = ""
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CleanupOldSubscriptions removes subscriptions inactive for more than the specified number of days
+func (m *MemoryStore) CleanupOldSubscriptions(days int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().AddDate(0, 0, -days)
+	for endpoint, s := range m.subs {
+		if s.LastActive.Before(cutoff) {
+			delete(m.subs, endpoint)
+			delete(m.ipUpdated, endpoint)
+		}
+	}
+	return nil
+}
+
+// IncrementPushCount increments the total push count
+func (m *MemoryStore) IncrementPushCount(count int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.totalPushes += count
+	return nil
+}
+
+// GetPushCount returns the total push count
+func (m *MemoryStore) GetPushCount() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.totalPushes, nil
+}
+
+// RecordPushCounts adds the given counts to the minute, hour and day buckets containing at
+func (m *MemoryStore) RecordPushCounts(at time.Time, counts map[models.PushStatKey]models.PushCounts) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, resolution := range []string{models.ResolutionMinute, models.ResolutionHour, models.ResolutionDay} {
+		bucket := BucketStart(at, resolution)
+		for key, c := range counts {
+			k := memoryBucketKey{resolution: resolution, bucket: bucket, key: key}
+			total := m.timeseries[k]
+			total.Sent += c.Sent
+			total.Failed += c.Failed
+			total.Expired += c.Expired
+			total.Clicked += c.Clicked
+			m.timeseries[k] = total
+		}
+	}
+	return nil
+}
+
+// GetPushTimeSeries returns push counts between from (inclusive) and to (exclusive),
+// optionally split into one series per push service or browser
+func (m *MemoryStore) GetPushTimeSeries(resolution string, from, to time.Time, groupBy string) ([]models.TimeSeries, error) {
+	if _, ok := groupColumns[groupBy]; !ok {
+		return nil, fmt.Errorf("unsupported group_by %q", groupBy)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type seriesKey struct {
+		key    string
+		bucket time.Time
+	}
+	points := make(map[seriesKey]models.PushCounts)
+	for k, c := range m.timeseries {
+		if k.resolution != resolution || k.bucket.Before(from) || !k.bucket.Before(to) {
+			continue
+		}
+		var key string
+		switch groupBy {
+		case "push_service":
+			key = k.key.PushService
+		case "browser":
+			key = k.key.Browser
+		}
+		sk := seriesKey{key: key, bucket: k.bucket}
+		total := points[sk]
+		total.Sent += c.Sent
+		total.Failed += c.Failed
+		total.Expired += c.Expired
+		total.Clicked += c.Clicked
+		points[sk] = total
+	}
+
+	keys := make([]seriesKey, 0, len(points))
+	for k := range points {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].key != keys[j].key {
+			return keys[i].key < keys[j].key
+		}
+		return keys[i].bucket.Before(keys[j].bucket)
+	})
+
+	series := []models.TimeSeries{}
+	for _, k := range keys {
+		if len(series) == 0 || series[len(series)-1].Key != k.key {
+			series = append(series, models.TimeSeries{Key: k.key})
+		}
+		last := &series[len(series)-1]
+		last.Points = append(last.Points, models.TimeSeriesPoint{Bucket: k.bucket, PushCounts: points[k]})
+	}
+	return series, nil
+}
+
+// PruneTimeSeries removes buckets of the given resolution that start before the cutoff
+func (m *MemoryStore) PruneTimeSeries(resolution string, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k := range m.timeseries {
+		if k.resolution == resolution && k.bucket.Before(before) {
+			delete(m.timeseries, k)
+		}
+	}
+	return nil
+}
+
+// RecordDeliveries appends entries to the delivery log
+func (m *MemoryStore) RecordDeliveries(deliveries []models.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries = append(m.deliveries, deliveries...)
+	return nil
+}
+
+// GetDeliveries returns the delivery log of one endpoint, oldest first
+func (m *MemoryStore) GetDeliveries(endpoint string) ([]models.Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deliveries []models.Delivery
+	for _, d := range m.deliveries {
+		if d.Endpoint == endpoint {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.Before(deliveries[j].CreatedAt)
+	})
+	return deliveries, nil
+}
+
+// PruneDeliveries deletes delivery log entries older than before
+func (m *MemoryStore) PruneDeliveries(before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.deliveries[:0]
+	for _, d := range m.deliveries {
+		if !d.CreatedAt.Before(before) {
+			kept = append(kept, d)
+		}
+	}
+	n := len(m.deliveries) - len(kept)
+	clear(m.deliveries[len(kept):])
+	m.deliveries = kept
+	return n, nil
+}
+
+// SavePendingDeliveries stores deliveries that were not sent before shutdown
+func (m *MemoryStore) SavePendingDeliveries(pending []models.PendingDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range pending {
+		m.pendingSeq++
+		p.ID = m.pendingSeq
+		m.pending = append(m.pending, memoryPending{PendingDelivery: p})
+	}
+	return nil
+}
+
+// ClaimPendingDeliveries claims the pending deliveries that are unclaimed or
+// were claimed before abandonedBefore, oldest first
+func (m *MemoryStore) ClaimPendingDeliveries(abandonedBefore time.Time) ([]models.PendingDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var claimed []models.PendingDelivery
+	for i := range m.pending {
+		if p := &m.pending[i]; p.claimedAt.IsZero() || p.claimedAt.Before(abandonedBefore) {
+			p.claimedAt = now
+			claimed = append(claimed, p.PendingDelivery)
+		}
+	}
+	return claimed, nil
+}
+
+// DeletePendingDelivery deletes a claimed delivery
+func (m *MemoryStore) DeletePendingDelivery(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = slices.DeleteFunc(m.pending, func(p memoryPending) bool { return p.ID == id })
+	return nil
+}
+
+// ClaimIdempotencyKey records rec as in progress unless a live record holds its key,
+// which is returned instead
+func (m *MemoryStore) ClaimIdempotencyKey(rec models.IdempotencyRecord, expiredBefore, abandonedBefore time.Time) (*models.IdempotencyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.idempotency[rec.Key]; ok {
+		expired := existing.CreatedAt.Before(expiredBefore)
+		abandoned := existing.StatusCode == 0 && existing.CreatedAt.Before(abandonedBefore)
+		if !expired && !abandoned {
+			existing.Response = append([]byte(nil), existing.Response...)
+			return &existing, nil
+		}
+	}
+	m.idempotency[rec.Key] = models.IdempotencyRecord{Key: rec.Key, Fingerprint: rec.Fingerprint, CreatedAt: rec.CreatedAt}
+	return nil, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request holding key
+func (m *MemoryStore) CompleteIdempotencyKey(key string, statusCode int, contentType string, response []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec, ok := m.idempotency[key]
+	if !ok {
+		return nil
+	}
+	rec.StatusCode = statusCode
+	rec.ContentType = contentType
+	rec.Response = append([]byte(nil), response...)
+	m.idempotency[key] = rec
+	return nil
+}
+
+// ReleaseIdempotencyKey deletes key while it is still in progress
+func (m *MemoryStore) ReleaseIdempotencyKey(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if rec, ok := m.idempotency[key]; ok && rec.StatusCode == 0 {
+		delete(m.idempotency, key)
+	}
+	return nil
+}
+
+// PruneIdempotencyKeys deletes keys created before before
+func (m *MemoryStore) PruneIdempotencyKeys(before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for key, rec := range m.idempotency {
+		if rec.CreatedAt.Before(before) {
+			delete(m.idempotency, key)
+			n++
+		}
+	}
+	return n, nil
+}
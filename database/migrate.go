@@ -0,0 +1,212 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles holds the numbered up migrations for each SQL dialect,
+// named NNNN_description.sql under migrations/<dialect>/
+//
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+// Migration is one numbered schema change
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Migrator is implemented by stores whose schema is managed by versioned migrations
+type Migrator interface {
+	// SchemaVersion returns the highest applied migration version, 0 for a new database
+	SchemaVersion() (int, error)
+
+	// PendingMigrations returns the migrations not yet applied, in order
+	PendingMigrations() ([]Migration, error)
+
+	// Migrate applies all pending migrations and returns the ones applied
+	Migrate() ([]Migration, error)
+}
+
+// schemaVersionTable records applied migrations, per dialect
+var schemaVersionTable = map[string]string{
+	DriverSQLite: `CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+	DriverPostgres: `CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+}
+
+// migrationLockID is the PostgreSQL advisory lock held while migrating, so
+// instances starting together do not apply the same migration twice
+const migrationLockID = 7340251
+
+// loadMigrations returns the embedded migrations for dialect, ordered by version
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %w", dialect, err)
+	}
+
+	var migrations []Migration
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		num, desc, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %s", e.Name())
+		}
+
+		body, err := migrationFiles.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: desc, SQL: string(body)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("%s migrations must be numbered consecutively from 1, found %04d at position %d", dialect, m.Version, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// sqlMigrator applies embedded migrations to a database/sql handle
+type sqlMigrator struct {
+	db      *sql.DB
+	dialect string
+}
+
+// placeholder returns the bind parameter syntax for argument n (1-based)
+func (m sqlMigrator) placeholder(n int) string {
+	if m.dialect == DriverPostgres {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// tableExists reports whether the schema_version table has been created
+func (m sqlMigrator) tableExists(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}) (bool, error) {
+	query := "SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'"
+	if m.dialect == DriverPostgres {
+		query = "SELECT to_regclass('schema_version') IS NOT NULL"
+	}
+	var exists bool
+	err := q.QueryRowContext(ctx, query).Scan(&exists)
+	return exists, err
+}
+
+// appliedVersion returns the highest version recorded in schema_version
+func (m sqlMigrator) appliedVersion(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}) (int, error) {
+	exists, err := m.tableExists(ctx, q)
+	if err != nil || !exists {
+		return 0, err
+	}
+	var version int
+	err = q.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// pending returns the migrations after version, failing if the database is
+// ahead of the migrations built into this binary
+func (m sqlMigrator) pending(version int) ([]Migration, error) {
+	migrations, err := loadMigrations(m.dialect)
+	if err != nil {
+		return nil, err
+	}
+	if version > len(migrations) {
+		return nil, fmt.Errorf("database schema version %d is newer than this binary supports (%d)", version, len(migrations))
+	}
+	return migrations[version:], nil
+}
+
+// SchemaVersion returns the highest applied migration version
+func (m sqlMigrator) SchemaVersion() (int, error) {
+	return m.appliedVersion(context.Background(), m.db)
+}
+
+// PendingMigrations returns the migrations not yet applied, without changing the database
+func (m sqlMigrator) PendingMigrations() ([]Migration, error) {
+	version, err := m.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	return m.pending(version)
+}
+
+// Migrate applies each pending migration in its own transaction, recording it
+// in schema_version, and returns the migrations applied
+func (m sqlMigrator) Migrate() ([]Migration, error) {
+	ctx := context.Background()
+
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if m.dialect == DriverPostgres {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+			return nil, fmt.Errorf("acquiring migration lock: %w", err)
+		}
+		defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+	}
+
+	if _, err := conn.ExecContext(ctx, schemaVersionTable[m.dialect]); err != nil {
+		return nil, fmt.Errorf("creating schema_version table: %w", err)
+	}
+
+	// Read the version under the lock, another instance may have just migrated
+	version, err := m.appliedVersion(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := m.pending(version)
+	if err != nil {
+		return nil, err
+	}
+
+	record := fmt.Sprintf("INSERT INTO schema_version (version, name) VALUES (%s, %s)", m.placeholder(1), m.placeholder(2))
+	for i, mig := range pending {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return pending[:i], err
+		}
+		if _, err := tx.ExecContext(ctx, mig.SQL); err != nil {
+			tx.Rollback()
+			return pending[:i], fmt.Errorf("migration %04d_%s: %w", mig.Version, mig.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, record, mig.Version, mig.Name); err != nil {
+			tx.Rollback()
+			return pending[:i], fmt.Errorf("migration %04d_%s: %w", mig.Version, mig.Name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return pending[:i], fmt.Errorf("migration %04d_%s: %w", mig.Version, mig.Name, err)
+		}
+		log.Printf("[Migrate] Applied %04d_%s", mig.Version, mig.Name)
+	}
+
+	return pending, nil
+}
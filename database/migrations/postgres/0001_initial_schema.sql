@@ -0,0 +1,57 @@
+-- Initial schema, matching the tables created before versioned migrations
+CREATE TABLE IF NOT EXISTS subscriptions (
+	id BIGSERIAL PRIMARY KEY,
+	endpoint TEXT NOT NULL UNIQUE,
+	p256dh TEXT NOT NULL,
+	auth TEXT NOT NULL,
+	ip TEXT NOT NULL DEFAULT '',
+	nation TEXT NOT NULL DEFAULT '',
+	os TEXT NOT NULL DEFAULT '',
+	os_version TEXT NOT NULL DEFAULT '',
+	browser TEXT NOT NULL DEFAULT '',
+	browser_version TEXT NOT NULL DEFAULT '',
+	platform TEXT NOT NULL DEFAULT '',
+	platform_version TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	last_active TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS push_stats (
+	id INTEGER PRIMARY KEY,
+	total_pushes BIGINT NOT NULL DEFAULT 0
+);
+
+-- Initialize push stats if not exists
+INSERT INTO push_stats (id, total_pushes) VALUES (1, 0) ON CONFLICT (id) DO NOTHING;
+
+CREATE INDEX IF NOT EXISTS idx_nation ON subscriptions(nation);
+CREATE INDEX IF NOT EXISTS idx_last_active ON subscriptions(last_active);
+
+CREATE TABLE IF NOT EXISTS pending_deliveries (
+	id BIGSERIAL PRIMARY KEY,
+	endpoint TEXT NOT NULL,
+	payload BYTEA NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS deliveries (
+	id BIGSERIAL PRIMARY KEY,
+	endpoint TEXT NOT NULL,
+	event TEXT NOT NULL,
+	status_code INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_deliveries_endpoint ON deliveries(endpoint);
+
+CREATE TABLE IF NOT EXISTS push_timeseries (
+	resolution TEXT NOT NULL,
+	bucket TIMESTAMPTZ NOT NULL,
+	push_service TEXT NOT NULL DEFAULT '',
+	browser TEXT NOT NULL DEFAULT '',
+	sent BIGINT NOT NULL DEFAULT 0,
+	failed BIGINT NOT NULL DEFAULT 0,
+	expired BIGINT NOT NULL DEFAULT 0,
+	clicked BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (resolution, bucket, push_service, browser)
+);
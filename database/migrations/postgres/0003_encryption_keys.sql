@@ -0,0 +1,7 @@
+-- Data encryption keys for subscription secrets, wrapped by the master key
+CREATE TABLE IF NOT EXISTS encryption_keys (
+	id TEXT PRIMARY KEY,
+	wrapped_key BYTEA NOT NULL,
+	active BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
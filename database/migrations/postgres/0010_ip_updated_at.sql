@@ -0,0 +1,6 @@
+-- When the IP of a subscription was last written, so IP retention counts from
+-- the latest resubscription rather than from created_at
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS ip_updated_at TIMESTAMPTZ;
+UPDATE subscriptions SET ip_updated_at = created_at WHERE ip_updated_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_ip_updated_at ON subscriptions(ip_updated_at);
@@ -0,0 +1,3 @@
+-- When an instance claimed a pending delivery to resume it. Rows stay until
+-- they are sent, so a crash while resuming leaves them to be claimed again.
+ALTER TABLE pending_deliveries ADD COLUMN IF NOT EXISTS claimed_at TIMESTAMPTZ;
@@ -0,0 +1,57 @@
+-- Initial schema, matching the tables created before versioned migrations
+CREATE TABLE IF NOT EXISTS subscriptions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	endpoint TEXT NOT NULL UNIQUE,
+	p256dh TEXT NOT NULL,
+	auth TEXT NOT NULL,
+	ip TEXT,
+	nation TEXT,
+	os TEXT,
+	os_version TEXT,
+	browser TEXT,
+	browser_version TEXT,
+	platform TEXT,
+	platform_version TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_active DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS push_stats (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	total_pushes INTEGER DEFAULT 0
+);
+
+-- Initialize push stats if not exists
+INSERT OR IGNORE INTO push_stats (id, total_pushes) VALUES (1, 0);
+
+CREATE INDEX IF NOT EXISTS idx_endpoint ON subscriptions(endpoint);
+CREATE INDEX IF NOT EXISTS idx_nation ON subscriptions(nation);
+
+CREATE TABLE IF NOT EXISTS pending_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	endpoint TEXT NOT NULL,
+	payload BLOB NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	endpoint TEXT NOT NULL,
+	event TEXT NOT NULL,
+	status_code INTEGER DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_deliveries_endpoint ON deliveries(endpoint);
+
+CREATE TABLE IF NOT EXISTS push_timeseries (
+	resolution TEXT NOT NULL,
+	bucket DATETIME NOT NULL,
+	push_service TEXT NOT NULL DEFAULT '',
+	browser TEXT NOT NULL DEFAULT '',
+	sent INTEGER DEFAULT 0,
+	failed INTEGER DEFAULT 0,
+	expired INTEGER DEFAULT 0,
+	clicked INTEGER DEFAULT 0,
+	PRIMARY KEY (resolution, bucket, push_service, browser)
+);
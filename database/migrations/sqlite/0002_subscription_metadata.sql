@@ -0,0 +1,7 @@
+-- Subscription expiry reported by the browser, and the application user and
+-- tags a subscription belongs to
+ALTER TABLE subscriptions ADD COLUMN expiration_time INTEGER;
+ALTER TABLE subscriptions ADD COLUMN user_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN tags TEXT NOT NULL DEFAULT '[]';
+
+CREATE INDEX IF NOT EXISTS idx_user_id ON subscriptions(user_id);
@@ -0,0 +1,7 @@
+-- Data encryption keys for subscription secrets, wrapped by the master key
+CREATE TABLE IF NOT EXISTS encryption_keys (
+	id TEXT PRIMARY KEY,
+	wrapped_key BLOB NOT NULL,
+	active INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
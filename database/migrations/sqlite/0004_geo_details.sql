@@ -0,0 +1,6 @@
+-- Location details from GeoIP lookups, alongside the country in nation
+ALTER TABLE subscriptions ADD COLUMN region TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN city TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN asn INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE subscriptions ADD COLUMN as_org TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN timezone TEXT NOT NULL DEFAULT '';
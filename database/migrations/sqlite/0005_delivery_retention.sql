@@ -0,0 +1,2 @@
+-- Retention pruning deletes delivery log entries by age
+CREATE INDEX IF NOT EXISTS idx_deliveries_created_at ON deliveries(created_at);
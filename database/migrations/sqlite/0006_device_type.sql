@@ -0,0 +1,2 @@
+-- Device class detected from Client Hints or the User-Agent, e.g. mobile or desktop
+ALTER TABLE subscriptions ADD COLUMN device_type TEXT NOT NULL DEFAULT '';
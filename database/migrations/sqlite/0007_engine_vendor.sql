@@ -0,0 +1,3 @@
+-- Rendering engine and device manufacturer detected from the User-Agent, e.g. Blink and Samsung
+ALTER TABLE subscriptions ADD COLUMN engine TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN device_vendor TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,15 @@
+-- Push service classified from the endpoint host, e.g. fcm or mozilla
+ALTER TABLE subscriptions ADD COLUMN push_service TEXT NOT NULL DEFAULT '';
+
+UPDATE subscriptions SET push_service = CASE
+	WHEN endpoint LIKE 'https://fcm.googleapis.com/%' OR endpoint LIKE 'https://android.googleapis.com/%' THEN 'fcm'
+	WHEN endpoint LIKE 'https://%push.services.mozilla.com/%' THEN 'mozilla'
+	WHEN endpoint LIKE 'https://%push.apple.com/%' THEN 'apple'
+	WHEN endpoint LIKE 'https://%notify.windows.com/%' THEN 'wns'
+	ELSE 'other'
+END
+WHERE endpoint <> '';
+
+-- Delivery options of deliveries persisted at shutdown, so they are resumed unchanged
+ALTER TABLE pending_deliveries ADD COLUMN ttl INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE pending_deliveries ADD COLUMN urgency TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,11 @@
+-- Requests sent with an Idempotency-Key and their responses, replayed on retries
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	idempotency_key TEXT PRIMARY KEY,
+	fingerprint TEXT NOT NULL,
+	status_code INTEGER NOT NULL DEFAULT 0, -- 0 while the request is in progress
+	content_type TEXT NOT NULL DEFAULT '',
+	response BLOB,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at);
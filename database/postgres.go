@@ -0,0 +1,626 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+	"webpush/models"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// PostgresStore is a Store backed by PostgreSQL, for deployments with several server instances
+type PostgresStore struct {
+	db *sql.DB
+
+	// keys encrypts sensitive columns, nil when encryption is disabled
+	keys *Keyring
+
+	sqlMigrator
+}
+
+var (
+	_ Store     = (*PostgresStore)(nil)
+	_ Migrator  = (*PostgresStore)(nil)
+	_ Encrypter = (*PostgresStore)(nil)
+)
+
+// OpenPostgres connects to the PostgreSQL database at dsn. Call Migrate to
+// create or upgrade its tables before use.
+func OpenPostgres(dsn string) (*PostgresStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Println("PostgreSQL database connected successfully")
+	return &PostgresStore{db: db, sqlMigrator: sqlMigrator{db: db, dialect: DriverPostgres}}, nil
+}
+
+// Ping verifies the database connection is usable
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Close closes the connection pool
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// SaveSubscription saves or updates a subscription in the database.
+// An update replaces the keys; an existing user ID or tags are kept when it does not set them.
+// CreatedAt and LastActive default to now when zero; last_active never moves back.
+// The IP is dated for retention with CreatedAt, or now when zero, on every save.
+func (s *PostgresStore) SaveSubscription(sub *models.Subscription) error {
+	p256dh, auth, ip, err := s.keys.sealSubscription(sub)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO subscriptions (endpoint, p256dh, auth, ip, nation, region, city, asn, as_org, timezone, os, os_version, browser, browser_version, device_type, engine, device_vendor, push_service, platform, platform_version, expiration_time, user_id, tags, created_at, last_active, ip_updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, COALESCE($24::timestamptz, now()), COALESCE($25::timestamptz, now()), COALESCE($24::timestamptz, now()))
+		ON CONFLICT (endpoint) DO UPDATE SET
+			p256dh = excluded.p256dh,
+			auth = excluded.auth,
+			ip = excluded.ip,
+			ip_updated_at = excluded.ip_updated_at,
+			nation = excluded.nation,
+			region = excluded.region,
+			city = excluded.city,
+			asn = excluded.asn,
+			as_org = excluded.as_org,
+			timezone = excluded.timezone,
+			os = excluded.os,
+			os_version = excluded.os_version,
+			browser = excluded.browser,
+			browser_version = excluded.browser_version,
+			device_type = excluded.device_type,
+			engine = excluded.engine,
+			device_vendor = excluded.device_vendor,
+			push_service = excluded.push_service,
+			platform = excluded.platform,
+			platform_version = excluded.platform_version,
+			expiration_time = excluded.expiration_time,
+			user_id = CASE WHEN excluded.user_id <> '' THEN excluded.user_id ELSE subscriptions.user_id END,
+			tags = CASE WHEN excluded.tags <> '[]' THEN excluded.tags ELSE subscriptions.tags END,
+			last_active = GREATEST(subscriptions.last_active, excluded.last_active)
+	`, sub.Endpoint, p256dh, auth, ip, sub.Nation, sub.Region, sub.City, sub.ASN, sub.ASOrg, sub.TimeZone, sub.OS, sub.OSVersion, sub.Browser, sub.BrowserVersion, sub.DeviceType, sub.Engine, sub.DeviceVendor, sub.PushService, sub.Platform, sub.PlatformVersion,
+		sub.ExpirationTime, sub.UserID, encodeTags(sub.Tags), postgresDialect.optionalTime(sub.CreatedAt), postgresDialect.optionalTime(sub.LastActive))
+
+	return err
+}
+
+// pgSubscriptionColumns lists the columns scanned by scanSubscription
+const pgSubscriptionColumns = `id, endpoint, p256dh, auth, ip, nation, region, city, asn, as_org, timezone, os, os_version, browser, browser_version, device_type, engine, device_vendor, push_service, platform, platform_version, expiration_time, user_id, tags, created_at, last_active`
+
+// scanSubscription scans a row selected with pgSubscriptionColumns and decrypts its sensitive columns
+func (s *PostgresStore) scanSubscription(row interface{ Scan(...any) error }) (models.Subscription, error) {
+	var sub models.Subscription
+	var tags string
+	err := row.Scan(
+		&sub.ID,
+		&sub.Endpoint,
+		&sub.Keys.P256dh,
+		&sub.Keys.Auth,
+		&sub.IP,
+		&sub.Nation,
+		&sub.Region,
+		&sub.City,
+		&sub.ASN,
+		&sub.ASOrg,
+		&sub.TimeZone,
+		&sub.OS,
+		&sub.OSVersion,
+		&sub.Browser,
+		&sub.BrowserVersion,
+		&sub.DeviceType,
+		&sub.Engine,
+		&sub.DeviceVendor,
+		&sub.PushService,
+		&sub.Platform,
+		&sub.PlatformVersion,
+		&sub.ExpirationTime,
+		&sub.UserID,
+		&tags,
+		&sub.CreatedAt,
+		&sub.LastActive,
+	)
+	if err != nil {
+		return sub, err
+	}
+	sub.Tags = decodeTags(tags)
+	sub.CreatedAt = sub.CreatedAt.UTC()
+	sub.LastActive = sub.LastActive.UTC()
+	return sub, s.keys.openSubscription(&sub)
+}
+
+// GetAllSubscriptions retrieves all subscriptions from the database
+func (s *PostgresStore) GetAllSubscriptions() ([]models.Subscription, error) {
+	rows, err := s.db.Query(`SELECT ` + pgSubscriptionColumns + ` FROM subscriptions ORDER BY created_at DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []models.Subscription
+	for rows.Next() {
+		sub, err := s.scanSubscription(rows)
+		if err != nil {
+			log.Printf("Error scanning subscription: %v", err)
+			continue
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+// ListSubscriptions returns one page of subscriptions matching q
+func (s *PostgresStore) ListSubscriptions(q models.SubscriptionQuery) (models.SubscriptionPage, error) {
+	return subscriptionLister{
+		db:      s.db,
+		columns: pgSubscriptionColumns,
+		scan:    s.scanSubscription,
+		dialect: postgresDialect,
+	}.list(q)
+}
+
+// CountSubscriptions returns the number of stored subscriptions
+func (s *PostgresStore) CountSubscriptions() (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM subscriptions").Scan(&count)
+	return count, err
+}
+
+// GetSubscription retrieves a single subscription by endpoint.
+// Returns nil if no subscription exists for the endpoint.
+func (s *PostgresStore) GetSubscription(endpoint string) (*models.Subscription, error) {
+	row := s.db.QueryRow(`SELECT `+pgSubscriptionColumns+` FROM subscriptions WHERE endpoint = $1`, endpoint)
+	sub, err := s.scanSubscription(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// SubscriptionSecrets returns the keys and IP of every subscription as stored
+func (s *PostgresStore) SubscriptionSecrets() ([]SealedSecrets, error) {
+	rows, err := s.db.Query("SELECT endpoint, p256dh, auth, ip FROM subscriptions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var secrets []SealedSecrets
+	for rows.Next() {
+		var sec SealedSecrets
+		if err := rows.Scan(&sec.Endpoint, &sec.P256dh, &sec.Auth, &sec.IP); err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, sec)
+	}
+	return secrets, rows.Err()
+}
+
+// ReplaceSubscriptionSecrets overwrites the keys and IP of a subscription with
+// updated unless it was saved again since old was read
+func (s *PostgresStore) ReplaceSubscriptionSecrets(old, updated SealedSecrets) (bool, error) {
+	res, err := s.db.Exec("UPDATE subscriptions SET p256dh = $1, auth = $2, ip = $3 WHERE endpoint = $4 AND p256dh = $5 AND auth = $6 AND ip = $7",
+		updated.P256dh, updated.Auth, updated.IP, old.Endpoint, old.P256dh, old.Auth, old.IP)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// EnableEncryption encrypts sensitive columns with k from now on. Rows written
+// before remain readable and are encrypted when next saved or on key rotation.
+func (s *PostgresStore) EnableEncryption(k *Keyring) {
+	s.keys = k
+}
+
+// GetDataKeys returns all stored data encryption keys
+func (s *PostgresStore) GetDataKeys() ([]DataKey, error) {
+	rows, err := s.db.Query("SELECT id, wrapped_key, active FROM encryption_keys ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []DataKey
+	for rows.Next() {
+		var k DataKey
+		if err := rows.Scan(&k.ID, &k.Wrapped, &k.Active); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// SaveDataKey inserts or updates a data key. Saving an active key deactivates the others.
+func (s *PostgresStore) SaveDataKey(key DataKey) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if key.Active {
+		if _, err := tx.Exec("UPDATE encryption_keys SET active = FALSE"); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`
+		INSERT INTO encryption_keys (id, wrapped_key, active) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET wrapped_key = excluded.wrapped_key, active = excluded.active
+	`, key.ID, key.Wrapped, key.Active)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteDataKey removes a data key
+func (s *PostgresStore) DeleteDataKey(id string) error {
+	_, err := s.db.Exec("DELETE FROM encryption_keys WHERE id = $1", id)
+	return err
+}
+
+// DataKeyInUse reports whether any subscription is still encrypted with the data key
+func (s *PostgresStore) DataKeyInUse(id string) (bool, error) {
+	var inUse bool
+	err := s.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM subscriptions WHERE p256dh LIKE $1 OR auth LIKE $1 OR ip LIKE $1)
+	`, encryptedColumnPattern(id)).Scan(&inUse)
+	return inUse, err
+}
+
+// RemoveSubscription removes a subscription by endpoint
+func (s *PostgresStore) RemoveSubscription(endpoint string) error {
+	_, err := s.db.Exec("DELETE FROM subscriptions WHERE endpoint = $1", endpoint)
+	return err
+}
+
+// EraseSubscription deletes a subscription, its delivery log and pending deliveries
+func (s *PostgresStore) EraseSubscription(endpoint string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var n int64
+	for _, table := range []string{"subscriptions", "deliveries", "pending_deliveries"} {
+		res, err := tx.Exec("DELETE FROM "+table+" WHERE endpoint = $1", endpoint)
+		if err != nil {
+			return false, err
+		}
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		n += deleted
+	}
+	return n > 0, tx.Commit()
+}
+
+// TouchSubscription marks a subscription as active now.
+// Returns false if no subscription exists for the endpoint.
+func (s *PostgresStore) TouchSubscription(endpoint string) (bool, error) {
+	res, err := s.db.Exec("UPDATE subscriptions SET last_active = now() WHERE endpoint = $1", endpoint)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SetSubscriptionLocation stores the GeoIP fields of sub without touching its other columns.
+// Returns false if no subscription exists for the endpoint.
+func (s *PostgresStore) SetSubscriptionLocation(sub *models.Subscription) (bool, error) {
+	res, err := s.db.Exec("UPDATE subscriptions SET nation = $1, region = $2, city = $3, asn = $4, as_org = $5, timezone = $6 WHERE endpoint = $7",
+		sub.Nation, sub.Region, sub.City, sub.ASN, sub.ASOrg, sub.TimeZone, sub.Endpoint)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// CountActiveSince returns the number of subscriptions active at or after the given time
+func (s *PostgresStore) CountActiveSince(since time.Time) (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE last_active >= $1", since).Scan(&count)
+	return count, err
+}
+
+// IncrementPushCount increments the total push count
+func (s *PostgresStore) IncrementPushCount(count int) error {
+	_, err := s.db.Exec("UPDATE push_stats SET total_pushes = total_pushes + $1 WHERE id = 1", count)
+	return err
+}
+
+// GetPushCount returns the total push count
+func (s *PostgresStore) GetPushCount() (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT total_pushes FROM push_stats WHERE id = 1").Scan(&count)
+	return count, err
+}
+
+// CountSubscriptionsBy counts the subscriptions matching f, grouped by dimension
+func (s *PostgresStore) CountSubscriptionsBy(dimension string, f models.SubscriptionFilter) (map[string]int, error) {
+	return countSubscriptionsBy(s.db, postgresDialect, dimension, f)
+}
+
+// ClearSubscriptionIPs blanks the IPs written before before
+func (s *PostgresStore) ClearSubscriptionIPs(before time.Time) (int, error) {
+	res, err := s.db.Exec("UPDATE subscriptions SET ip = '' WHERE ip != '' AND ip_updated_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// CleanupOldSubscriptions removes subscriptions inactive for more than the specified duration
+func (s *PostgresStore) CleanupOldSubscriptions(days int) error {
+	cutoff := time.Now().AddDate(0, 0, -days)
+	_, err := s.db.Exec("DELETE FROM subscriptions WHERE last_active < $1", cutoff)
+	return err
+}
+
+// RecordPushCounts adds the given counts to the minute, hour and day buckets containing at
+func (s *PostgresStore) RecordPushCounts(at time.Time, counts map[models.PushStatKey]models.PushCounts) error {
+	if len(counts) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO push_timeseries AS t (resolution, bucket, push_service, browser, sent, failed, expired, clicked)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (resolution, bucket, push_service, browser) DO UPDATE SET
+			sent = t.sent + excluded.sent,
+			failed = t.failed + excluded.failed,
+			expired = t.expired + excluded.expired,
+			clicked = t.clicked + excluded.clicked
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, resolution := range []string{models.ResolutionMinute, models.ResolutionHour, models.ResolutionDay} {
+		bucket := BucketStart(at, resolution)
+		for key, c := range counts {
+			_, err := stmt.Exec(resolution, bucket, key.PushService, key.Browser, c.Sent, c.Failed, c.Expired, c.Clicked)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetPushTimeSeries returns push counts between from (inclusive) and to (exclusive),
+// optionally split into one series per push service or browser
+func (s *PostgresStore) GetPushTimeSeries(resolution string, from, to time.Time, groupBy string) ([]models.TimeSeries, error) {
+	column, ok := groupColumns[groupBy]
+	if !ok {
+		return nil, fmt.Errorf("unsupported group_by %q", groupBy)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT bucket, `+column+` AS key,
+			SUM(sent)::BIGINT, SUM(failed)::BIGINT, SUM(expired)::BIGINT, SUM(clicked)::BIGINT
+		FROM push_timeseries
+		WHERE resolution = $1 AND bucket >= $2 AND bucket < $3
+		GROUP BY bucket, key
+		ORDER BY key, bucket
+	`, resolution, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	series := []models.TimeSeries{}
+	for rows.Next() {
+		var p models.TimeSeriesPoint
+		var key string
+		if err := rows.Scan(&p.Bucket, &key, &p.Sent, &p.Failed, &p.Expired, &p.Clicked); err != nil {
+			return nil, err
+		}
+		p.Bucket = p.Bucket.UTC()
+		if len(series) == 0 || series[len(series)-1].Key != key {
+			series = append(series, models.TimeSeries{Key: key})
+		}
+		last := &series[len(series)-1]
+		last.Points = append(last.Points, p)
+	}
+
+	return series, rows.Err()
+}
+
+// PruneTimeSeries removes buckets of the given resolution that start before the cutoff
+func (s *PostgresStore) PruneTimeSeries(resolution string, before time.Time) error {
+	_, err := s.db.Exec("DELETE FROM push_timeseries WHERE resolution = $1 AND bucket < $2", resolution, before)
+	return err
+}
+
+// RecordDeliveries appends entries to the delivery log
+func (s *PostgresStore) RecordDeliveries(deliveries []models.Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO deliveries (endpoint, event, status_code, created_at) VALUES ($1, $2, $3, $4)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, d := range deliveries {
+		if _, err := stmt.Exec(d.Endpoint, string(d.Event), d.StatusCode, d.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetDeliveries returns the delivery log of one endpoint, oldest first
+func (s *PostgresStore) GetDeliveries(endpoint string) ([]models.Delivery, error) {
+	rows, err := s.db.Query("SELECT endpoint, event, status_code, created_at FROM deliveries WHERE endpoint = $1 ORDER BY created_at, id", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []models.Delivery
+	for rows.Next() {
+		var d models.Delivery
+		if err := rows.Scan(&d.Endpoint, &d.Event, &d.StatusCode, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// PruneDeliveries deletes delivery log entries older than before
+func (s *PostgresStore) PruneDeliveries(before time.Time) (int, error) {
+	res, err := s.db.Exec("DELETE FROM deliveries WHERE created_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// SavePendingDeliveries stores deliveries that were not sent before shutdown
+func (s *PostgresStore) SavePendingDeliveries(pending []models.PendingDelivery) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO pending_deliveries (endpoint, payload, ttl, urgency) VALUES ($1, $2, $3, $4)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, p := range pending {
+		if _, err := stmt.Exec(p.Endpoint, p.Payload, p.TTL, p.Urgency); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ClaimPendingDeliveries claims the pending deliveries that are unclaimed or
+// were claimed before abandonedBefore, oldest first. The update locks each row,
+// so concurrent instances never claim the same delivery.
+func (s *PostgresStore) ClaimPendingDeliveries(abandonedBefore time.Time) ([]models.PendingDelivery, error) {
+	rows, err := s.db.Query("UPDATE pending_deliveries SET claimed_at = now() WHERE claimed_at IS NULL OR claimed_at < $1 RETURNING id, endpoint, payload, ttl, urgency", abandonedBefore)
+	if err != nil {
+		return nil, err
+	}
+	return scanPendingDeliveries(rows)
+}
+
+// DeletePendingDelivery deletes a claimed delivery
+func (s *PostgresStore) DeletePendingDelivery(id int64) error {
+	_, err := s.db.Exec("DELETE FROM pending_deliveries WHERE id = $1", id)
+	return err
+}
+
+// ClaimIdempotencyKey records rec as in progress unless a live record holds its key,
+// which is returned instead
+func (s *PostgresStore) ClaimIdempotencyKey(rec models.IdempotencyRecord, expiredBefore, abandonedBefore time.Time) (*models.IdempotencyRecord, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO idempotency_keys (idempotency_key, fingerprint, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (idempotency_key) DO UPDATE SET
+			fingerprint = excluded.fingerprint, status_code = 0, content_type = '', response = NULL, created_at = excluded.created_at
+		WHERE idempotency_keys.created_at < $4 OR (idempotency_keys.status_code = 0 AND idempotency_keys.created_at < $5)
+	`, rec.Key, rec.Fingerprint, rec.CreatedAt, expiredBefore, abandonedBefore)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, tx.Commit()
+	}
+
+	existing := models.IdempotencyRecord{Key: rec.Key}
+	err = tx.QueryRow("SELECT fingerprint, status_code, content_type, response, created_at FROM idempotency_keys WHERE idempotency_key = $1", rec.Key).
+		Scan(&existing.Fingerprint, &existing.StatusCode, &existing.ContentType, &existing.Response, &existing.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &existing, tx.Commit()
+}
+
+// CompleteIdempotencyKey stores the response of the request holding key
+func (s *PostgresStore) CompleteIdempotencyKey(key string, statusCode int, contentType string, response []byte) error {
+	_, err := s.db.Exec("UPDATE idempotency_keys SET status_code = $1, content_type = $2, response = $3 WHERE idempotency_key = $4",
+		statusCode, contentType, response, key)
+	return err
+}
+
+// ReleaseIdempotencyKey deletes key while it is still in progress
+func (s *PostgresStore) ReleaseIdempotencyKey(key string) error {
+	_, err := s.db.Exec("DELETE FROM idempotency_keys WHERE idempotency_key = $1 AND status_code = 0", key)
+	return err
+}
+
+// PruneIdempotencyKeys deletes keys created before before
+func (s *PostgresStore) PruneIdempotencyKeys(before time.Time) (int, error) {
+	res, err := s.db.Exec("DELETE FROM idempotency_keys WHERE created_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"webpush/models"
+)
+
+// postgresTestDSNEnv names the connection URL of a PostgreSQL database the
+// tests may create schemas in. The PostgreSQL tests are skipped when it is unset.
+const postgresTestDSNEnv = "WEBPUSH_TEST_POSTGRES_DSN"
+
+// postgresSchemaSeq numbers the schemas created by one test run
+var postgresSchemaSeq atomic.Int64
+
+// newTestPostgresStore returns a store in a new schema of the test database,
+// which is dropped when the test ends
+func newTestPostgresStore(t testing.TB) Store {
+	t.Helper()
+	dsn := os.Getenv(postgresTestDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s not set", postgresTestDSNEnv)
+	}
+
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("open %s: %v", postgresTestDSNEnv, err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("webpush_test_%d_%d", time.Now().UnixNano(), postgresSchemaSeq.Add(1))
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("drop schema %s: %v", schema, err)
+		}
+	})
+
+	s, err := OpenPostgres(withSearchPath(t, dsn, schema))
+	if err != nil {
+		t.Fatalf("OpenPostgres: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err := s.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	return s
+}
+
+// withSearchPath returns dsn with schema as the search path of its connections
+func withSearchPath(t testing.TB, dsn, schema string) string {
+	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
+		return dsn + " search_path=" + schema
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("parse %s: %v", postgresTestDSNEnv, err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func TestPostgresStore(t *testing.T) {
+	if os.Getenv(postgresTestDSNEnv) == "" {
+		t.Skipf("%s not set", postgresTestDSNEnv)
+	}
+	testStore(t, newTestPostgresStore)
+}
+
+// TestPostgresSharedSubscriptions checks that two instances sharing a database
+// see each other's subscriptions, as in a multi-instance deployment
+func TestPostgresSharedSubscriptions(t *testing.T) {
+	s := newTestPostgresStore(t).(*PostgresStore)
+	other, err := OpenPostgres(withSearchPath(t, os.Getenv(postgresTestDSNEnv), currentSchema(t, s)))
+	if err != nil {
+		t.Fatalf("OpenPostgres: %v", err)
+	}
+	defer other.Close()
+
+	a := testSubscription("https://fcm.googleapis.com/fcm/send/a", testTime)
+	mustSave(t, s, a)
+	b := testSubscription("https://fcm.googleapis.com/fcm/send/b", testTime)
+	mustSave(t, other, b)
+
+	for _, store := range []Store{s, other} {
+		if n, err := store.CountSubscriptions(); err != nil || n != 2 {
+			t.Errorf("CountSubscriptions = %d, %v, want both instances' subscriptions", n, err)
+		}
+	}
+
+	// Pending deliveries are handed to exactly one instance
+	pending := []models.PendingDelivery{{Endpoint: a.Endpoint, Payload: []byte("{}")}, {Endpoint: b.Endpoint, Payload: []byte("{}")}}
+	if err := s.SavePendingDeliveries(pending); err != nil {
+		t.Fatalf("SavePendingDeliveries: %v", err)
+	}
+	abandoned := time.Now().Add(-time.Hour)
+	first, err := other.ClaimPendingDeliveries(abandoned)
+	if err != nil || len(first) != 2 {
+		t.Fatalf("ClaimPendingDeliveries = %d, %v, want 2", len(first), err)
+	}
+	if second, _ := s.ClaimPendingDeliveries(abandoned); len(second) != 0 {
+		t.Errorf("pending deliveries claimed twice: %d", len(second))
+	}
+}
+
+// currentSchema returns the schema the store's connections use
+func currentSchema(t *testing.T, s *PostgresStore) string {
+	t.Helper()
+	var schema string
+	if err := s.db.QueryRow("SELECT current_schema()").Scan(&schema); err != nil {
+		t.Fatalf("current_schema: %v", err)
+	}
+	return schema
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"fmt"
+	"time"
+	"webpush/models"
+)
+
+// groupColumns maps time series group_by values to their column
+var groupColumns = map[string]string{
+	"":             "''",
+	"push_service": "push_service",
+	"browser":      "browser",
+}
+
+// BucketStart truncates t to the start of its bucket for the given resolution
+func BucketStart(t time.Time, resolution string) time.Time {
+	t = t.UTC()
+	switch resolution {
+	case models.ResolutionMinute:
+		return t.Truncate(time.Minute)
+	case models.ResolutionHour:
+		return t.Truncate(time.Hour)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// RecordPushCounts adds the given counts to the minute, hour and day buckets containing at
+func (s *SQLiteStore) RecordPushCounts(at time.Time, counts map[models.PushStatKey]models.PushCounts) error {
+	if len(counts) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO push_timeseries (resolution, bucket, push_service, browser, sent, failed, expired, clicked)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(resolution, bucket, push_service, browser) DO UPDATE SET
+			sent = sent + excluded.sent,
+			failed = failed + excluded.failed,
+			expired = expired + excluded.expired,
+			clicked = clicked + excluded.clicked
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, resolution := range []string{models.ResolutionMinute, models.ResolutionHour, models.ResolutionDay} {
+		bucket := BucketStart(at, resolution).Format(timeFormat)
+		for key, c := range counts {
+			_, err := stmt.Exec(resolution, bucket, key.PushService, key.Browser, c.Sent, c.Failed, c.Expired, c.Clicked)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetPushTimeSeries returns push counts between from (inclusive) and to (exclusive),
+// optionally split into one series per push service or browser
+func (s *SQLiteStore) GetPushTimeSeries(resolution string, from, to time.Time, groupBy string) ([]models.TimeSeries, error) {
+	column, ok := groupColumns[groupBy]
+	if !ok {
+		return nil, fmt.Errorf("unsupported group_by %q", groupBy)
+	}
+
+	rows, err := s.read.Query(`
+		SELECT bucket, `+column+` AS key,
+			SUM(sent), SUM(failed), SUM(expired), SUM(clicked)
+		FROM push_timeseries
+		WHERE resolution = ? AND bucket >= ? AND bucket < ?
+		GROUP BY bucket, key
+		ORDER BY key, bucket
+	`, resolution, from.UTC().Format(timeFormat), to.UTC().Format(timeFormat))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	series := []models.TimeSeries{}
+	for rows.Next() {
+		var p models.TimeSeriesPoint
+		var key string
+		if err := rows.Scan(&p.Bucket, &key, &p.Sent, &p.Failed, &p.Expired, &p.Clicked); err != nil {
+			return nil, err
+		}
+		if len(series) == 0 || series[len(series)-1].Key != key {
+			series = append(series, models.TimeSeries{Key: key})
+		}
+		last := &series[len(series)-1]
+		last.Points = append(last.Points, p)
+	}
+
+	return series, rows.Err()
+}
+
+// PruneTimeSeries removes buckets of the given resolution that start before the cutoff
+func (s *SQLiteStore) PruneTimeSeries(resolution string, before time.Time) error {
+	_, err := s.db.Exec("DELETE FROM push_timeseries WHERE resolution = ? AND bucket < ?",
+		resolution, before.UTC().Format(timeFormat))
+	return err
+}
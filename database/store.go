@@ -0,0 +1,142 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"webpush/models"
+)
+
+// Supported storage drivers
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+	DriverMemory   = "memory"
+)
+
+// DefaultSQLitePath is the SQLite database file used when no DSN is configured
+const DefaultSQLitePath = "data/webpush.db"
+
+// Open returns the Store for driver. dsn is a file path for sqlite,
+// a connection URL for postgres, and ignored for memory.
+func Open(driver, dsn string) (Store, error) {
+	switch driver {
+	case DriverSQLite:
+		if dsn == "" {
+			dsn = DefaultSQLitePath
+		}
+		return OpenSQLite(dsn)
+	case DriverPostgres:
+		if dsn == "" {
+			return nil, errors.New("postgres driver requires a connection URL")
+		}
+		return OpenPostgres(dsn)
+	case DriverMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", driver)
+	}
+}
+
+// Store persists subscriptions, push statistics, the delivery log, pending jobs
+// and idempotency keys
+type Store interface {
+	SubscriptionStore
+	StatsStore
+	DeliveryStore
+	JobStore
+	IdempotencyStore
+
+	// Ping verifies the store is reachable
+	Ping(ctx context.Context) error
+
+	// Close releases the store, flushing any pending writes
+	Close() error
+}
+
+// SubscriptionStore manages push subscriptions and their client metadata
+type SubscriptionStore interface {
+	SaveSubscription(sub *models.Subscription) error
+	GetSubscription(endpoint string) (*models.Subscription, error)
+	GetAllSubscriptions() ([]models.Subscription, error)
+	// ListSubscriptions returns one page of subscriptions; ErrInvalidCursor for a bad cursor
+	ListSubscriptions(q models.SubscriptionQuery) (models.SubscriptionPage, error)
+	CountSubscriptions() (int, error)
+	RemoveSubscription(endpoint string) error
+	// EraseSubscription deletes a subscription with its delivery log and pending
+	// deliveries; false if nothing was stored for the endpoint
+	EraseSubscription(endpoint string) (bool, error)
+	TouchSubscription(endpoint string) (bool, error)
+	// SetSubscriptionLocation updates the location columns of sub's endpoint; false if it does not exist
+	SetSubscriptionLocation(sub *models.Subscription) (bool, error)
+	CountActiveSince(since time.Time) (int, error)
+	// CountSubscriptionsBy counts subscriptions matching f, grouped by a models.Breakdown* dimension
+	CountSubscriptionsBy(dimension string, f models.SubscriptionFilter) (map[string]int, error)
+	CleanupOldSubscriptions(days int) error
+	// ClearSubscriptionIPs blanks the IPs last written before the given time, by
+	// subscribing or resubscribing, so retention counts from the latest IP
+	ClearSubscriptionIPs(before time.Time) (int, error)
+}
+
+// StatsStore manages the total push counter and the bucketed push time series
+type StatsStore interface {
+	IncrementPushCount(count int) error
+	GetPushCount() (int, error)
+	RecordPushCounts(at time.Time, counts map[models.PushStatKey]models.PushCounts) error
+	GetPushTimeSeries(resolution string, from, to time.Time, groupBy string) ([]models.TimeSeries, error)
+	PruneTimeSeries(resolution string, before time.Time) error
+}
+
+// DeliveryStore records the outcome of each push attempt and click
+type DeliveryStore interface {
+	RecordDeliveries(deliveries []models.Delivery) error
+	// GetDeliveries returns the delivery log of one endpoint, oldest first
+	GetDeliveries(endpoint string) ([]models.Delivery, error)
+	// PruneDeliveries deletes delivery log entries older than before
+	PruneDeliveries(before time.Time) (int, error)
+}
+
+// JobStore persists unfinished delivery work across restarts
+type JobStore interface {
+	SavePendingDeliveries(pending []models.PendingDelivery) error
+	// ClaimPendingDeliveries claims and returns the pending deliveries that are
+	// unclaimed or were claimed before abandonedBefore, oldest first. A claimed
+	// delivery stays stored until DeletePendingDelivery, so none is lost when the
+	// claiming instance stops before sending it.
+	ClaimPendingDeliveries(abandonedBefore time.Time) ([]models.PendingDelivery, error)
+	// DeletePendingDelivery deletes a claimed delivery once it was sent or saved again
+	DeletePendingDelivery(id int64) error
+}
+
+// IdempotencyStore remembers requests sent with an Idempotency-Key and their responses
+type IdempotencyStore interface {
+	// ClaimIdempotencyKey records rec as in progress. It returns nil when the key
+	// was free, expired (created before expiredBefore) or abandoned in progress
+	// (created before abandonedBefore), and the stored record otherwise.
+	ClaimIdempotencyKey(rec models.IdempotencyRecord, expiredBefore, abandonedBefore time.Time) (*models.IdempotencyRecord, error)
+	// CompleteIdempotencyKey stores the response of the request holding key
+	CompleteIdempotencyKey(key string, statusCode int, contentType string, response []byte) error
+	// ReleaseIdempotencyKey deletes key while it is still in progress, so a retry
+	// runs the request again
+	ReleaseIdempotencyKey(key string) error
+	// PruneIdempotencyKeys deletes keys created before before
+	PruneIdempotencyKeys(before time.Time) (int, error)
+}
+
+// encodeTags serialises subscription tags for the tags column
+func encodeTags(tags []string) string {
+	if len(tags) == 0 {
+		return "[]"
+	}
+	b, _ := json.Marshal(tags)
+	return string(b)
+}
+
+// decodeTags parses the tags column, ignoring malformed values
+func decodeTags(s string) []string {
+	var tags []string
+	json.Unmarshal([]byte(s), &tags)
+	return tags
+}
@@ -0,0 +1,565 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	"webpush/models"
+)
+
+// storeFactory returns an empty, migrated store that is closed when the test ends
+type storeFactory func(t testing.TB) Store
+
+func newTestMemoryStore(t testing.TB) Store {
+	return NewMemoryStore()
+}
+
+func newTestSQLiteStore(t testing.TB) Store {
+	t.Helper()
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "webpush.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err := s.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	return s
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, newTestMemoryStore)
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, newTestSQLiteStore)
+}
+
+// testStore runs the Store contract against the stores returned by newStore
+func testStore(t *testing.T, newStore storeFactory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s Store)
+	}{
+		{"SaveAndGet", testSaveAndGet},
+		{"SaveKeepsUserAndTags", testSaveKeepsUserAndTags},
+		{"RemoveAndErase", testRemoveAndErase},
+		{"TouchAndLocation", testTouchAndLocation},
+		{"ListSubscriptions", testListSubscriptions},
+		{"CountSubscriptionsBy", testCountSubscriptionsBy},
+		{"Retention", testRetention},
+		{"PushCounts", testPushCounts},
+		{"Deliveries", testDeliveries},
+		{"PendingDeliveries", testPendingDeliveries},
+		{"IdempotencyKeys", testIdempotencyKeys},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newStore(t))
+		})
+	}
+}
+
+// testSubscription returns a subscription for endpoint created at created
+func testSubscription(endpoint string, created time.Time) models.Subscription {
+	sub := models.Subscription{
+		Endpoint:       endpoint,
+		IP:             "203.0.113.7",
+		OS:             "Android",
+		OSVersion:      "14",
+		Browser:        "Chrome",
+		BrowserVersion: "120.0.0.0",
+		PushService:    "fcm",
+		CreatedAt:      created,
+		LastActive:     created,
+	}
+	sub.Keys.P256dh = "p256dh-" + endpoint
+	sub.Keys.Auth = "auth-" + endpoint
+	return sub
+}
+
+// mustSave saves subs or fails the test
+func mustSave(t testing.TB, s Store, subs ...models.Subscription) {
+	t.Helper()
+	for i := range subs {
+		if err := s.SaveSubscription(&subs[i]); err != nil {
+			t.Fatalf("SaveSubscription(%s): %v", subs[i].Endpoint, err)
+		}
+	}
+}
+
+// endpoints returns the endpoints of subs, in order
+func endpoints(subs []models.Subscription) []string {
+	var e []string
+	for _, s := range subs {
+		e = append(e, s.Endpoint)
+	}
+	return e
+}
+
+// testTime is a fixed second-precision instant, as the SQL stores keep seconds
+var testTime = time.Date(2025, 3, 14, 12, 0, 0, 0, time.UTC)
+
+func testSaveAndGet(t *testing.T, s Store) {
+	want := testSubscription("https://fcm.googleapis.com/fcm/send/a", testTime)
+	mustSave(t, s, want)
+
+	got, err := s.GetSubscription(want.Endpoint)
+	if err != nil || got == nil {
+		t.Fatalf("GetSubscription = %v, %v", got, err)
+	}
+	if got.Keys != want.Keys || got.IP != want.IP || got.Browser != want.Browser || got.PushService != want.PushService {
+		t.Errorf("GetSubscription = %+v, want %+v", *got, want)
+	}
+	if !got.CreatedAt.Equal(testTime) {
+		t.Errorf("CreatedAt = %v, want %v", got.CreatedAt, testTime)
+	}
+
+	missing, err := s.GetSubscription("https://example.com/missing")
+	if err != nil || missing != nil {
+		t.Errorf("GetSubscription(missing) = %v, %v, want nil, nil", missing, err)
+	}
+
+	mustSave(t, s, testSubscription("https://fcm.googleapis.com/fcm/send/b", testTime.Add(time.Minute)))
+	all, err := s.GetAllSubscriptions()
+	if err != nil {
+		t.Fatalf("GetAllSubscriptions: %v", err)
+	}
+	if got, want := endpoints(all), []string{"https://fcm.googleapis.com/fcm/send/b", want.Endpoint}; !slices.Equal(got, want) {
+		t.Errorf("GetAllSubscriptions = %v, want newest first %v", got, want)
+	}
+	if n, err := s.CountSubscriptions(); err != nil || n != 2 {
+		t.Errorf("CountSubscriptions = %d, %v, want 2", n, err)
+	}
+}
+
+func testSaveKeepsUserAndTags(t *testing.T, s Store) {
+	sub := testSubscription("https://fcm.googleapis.com/fcm/send/a", testTime)
+	sub.UserID = "user-1"
+	sub.Tags = []string{"news", "sports"}
+	mustSave(t, s, sub)
+
+	// A resubscription from the page carries neither, and must not clear them
+	update := testSubscription(sub.Endpoint, testTime.Add(time.Hour))
+	update.Browser = "Firefox"
+	update.Keys.P256dh, update.Keys.Auth = "p256dh-rotated", "auth-rotated"
+	mustSave(t, s, update)
+
+	got, err := s.GetSubscription(sub.Endpoint)
+	if err != nil || got == nil {
+		t.Fatalf("GetSubscription = %v, %v", got, err)
+	}
+	if got.UserID != "user-1" || !slices.Equal(got.Tags, sub.Tags) {
+		t.Errorf("user and tags = %q %v, want kept", got.UserID, got.Tags)
+	}
+	if got.Browser != "Firefox" {
+		t.Errorf("Browser = %q, want updated to Firefox", got.Browser)
+	}
+	if got.Keys != update.Keys {
+		t.Errorf("Keys = %+v, want replaced by %+v", got.Keys, update.Keys)
+	}
+	if !got.CreatedAt.Equal(testTime) {
+		t.Errorf("CreatedAt = %v, want kept at %v", got.CreatedAt, testTime)
+	}
+	if !got.LastActive.Equal(testTime.Add(time.Hour)) {
+		t.Errorf("LastActive = %v, want %v", got.LastActive, testTime.Add(time.Hour))
+	}
+
+	// LastActive never moves back
+	mustSave(t, s, testSubscription(sub.Endpoint, testTime))
+	got, _ = s.GetSubscription(sub.Endpoint)
+	if !got.LastActive.Equal(testTime.Add(time.Hour)) {
+		t.Errorf("LastActive after older save = %v, want %v", got.LastActive, testTime.Add(time.Hour))
+	}
+}
+
+func testRemoveAndErase(t *testing.T, s Store) {
+	a := testSubscription("https://fcm.googleapis.com/fcm/send/a", testTime)
+	b := testSubscription("https://fcm.googleapis.com/fcm/send/b", testTime)
+	mustSave(t, s, a, b)
+
+	if err := s.RemoveSubscription(a.Endpoint); err != nil {
+		t.Fatalf("RemoveSubscription: %v", err)
+	}
+	if got, _ := s.GetSubscription(a.Endpoint); got != nil {
+		t.Errorf("subscription still stored after RemoveSubscription")
+	}
+
+	err := s.RecordDeliveries([]models.Delivery{{Endpoint: b.Endpoint, Event: models.PushSent, StatusCode: 201, CreatedAt: testTime}})
+	if err != nil {
+		t.Fatalf("RecordDeliveries: %v", err)
+	}
+	if err := s.SavePendingDeliveries([]models.PendingDelivery{{Endpoint: b.Endpoint, Payload: []byte("{}")}}); err != nil {
+		t.Fatalf("SavePendingDeliveries: %v", err)
+	}
+
+	found, err := s.EraseSubscription(b.Endpoint)
+	if err != nil || !found {
+		t.Fatalf("EraseSubscription = %v, %v, want true", found, err)
+	}
+	if got, _ := s.GetSubscription(b.Endpoint); got != nil {
+		t.Errorf("subscription still stored after EraseSubscription")
+	}
+	if d, _ := s.GetDeliveries(b.Endpoint); len(d) != 0 {
+		t.Errorf("delivery log still holds %d entries after EraseSubscription", len(d))
+	}
+	if p, _ := s.ClaimPendingDeliveries(time.Now()); len(p) != 0 {
+		t.Errorf("%d pending deliveries left after EraseSubscription", len(p))
+	}
+
+	found, err = s.EraseSubscription(b.Endpoint)
+	if err != nil || found {
+		t.Errorf("EraseSubscription of erased endpoint = %v, %v, want false", found, err)
+	}
+}
+
+func testTouchAndLocation(t *testing.T, s Store) {
+	sub := testSubscription("https://fcm.googleapis.com/fcm/send/a", testTime)
+	mustSave(t, s, sub)
+
+	if found, err := s.TouchSubscription(sub.Endpoint); err != nil || !found {
+		t.Fatalf("TouchSubscription = %v, %v, want true", found, err)
+	}
+	if found, err := s.TouchSubscription("https://example.com/missing"); err != nil || found {
+		t.Errorf("TouchSubscription(missing) = %v, %v, want false", found, err)
+	}
+	if n, err := s.CountActiveSince(time.Now().Add(-time.Minute)); err != nil || n != 1 {
+		t.Errorf("CountActiveSince after touch = %d, %v, want 1", n, err)
+	}
+
+	loc := models.Subscription{Endpoint: sub.Endpoint, Nation: "DE", Region: "Berlin", City: "Berlin", ASN: 3320, ASOrg: "DTAG", TimeZone: "Europe/Berlin"}
+	if found, err := s.SetSubscriptionLocation(&loc); err != nil || !found {
+		t.Fatalf("SetSubscriptionLocation = %v, %v, want true", found, err)
+	}
+	got, _ := s.GetSubscription(sub.Endpoint)
+	if got.Nation != "DE" || got.City != "Berlin" || got.ASN != 3320 || got.TimeZone != "Europe/Berlin" {
+		t.Errorf("location = %+v, want DE/Berlin/3320", *got)
+	}
+	if got.Browser != sub.Browser || got.Keys != sub.Keys {
+		t.Errorf("SetSubscriptionLocation changed other fields: %+v", *got)
+	}
+
+	loc.Endpoint = "https://example.com/missing"
+	if found, err := s.SetSubscriptionLocation(&loc); err != nil || found {
+		t.Errorf("SetSubscriptionLocation(missing) = %v, %v, want false", found, err)
+	}
+}
+
+func testListSubscriptions(t *testing.T, s Store) {
+	var want []string
+	for i := 0; i < 5; i++ {
+		sub := testSubscription("https://fcm.googleapis.com/fcm/send/"+string(rune('a'+i)), testTime.Add(time.Duration(i)*time.Minute))
+		if i == 4 {
+			sub.Nation = "FR"
+		}
+		mustSave(t, s, sub)
+		want = append([]string{sub.Endpoint}, want...)
+	}
+
+	// Page through newest first
+	var got []string
+	q := models.SubscriptionQuery{Sort: models.SortCreatedAt, Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("ListSubscriptions does not stop paging")
+		}
+		page, err := s.ListSubscriptions(q)
+		if err != nil {
+			t.Fatalf("ListSubscriptions: %v", err)
+		}
+		got = append(got, endpoints(page.Subscriptions)...)
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("paged listing = %v, want %v", got, want)
+	}
+
+	page, err := s.ListSubscriptions(models.SubscriptionQuery{Sort: models.SortCreatedAt, Asc: true, Limit: 10})
+	if err != nil || len(page.Subscriptions) != 5 || page.Subscriptions[0].Endpoint != want[4] {
+		t.Errorf("ascending listing = %v, %v, want oldest first", endpoints(page.Subscriptions), err)
+	}
+
+	page, err = s.ListSubscriptions(models.SubscriptionQuery{Sort: models.SortCreatedAt, Limit: 10, SubscriptionFilter: models.SubscriptionFilter{Nation: "FR"}})
+	if err != nil || !slices.Equal(endpoints(page.Subscriptions), want[:1]) {
+		t.Errorf("nation filter = %v, %v, want %v", endpoints(page.Subscriptions), err, want[:1])
+	}
+
+	page, err = s.ListSubscriptions(models.SubscriptionQuery{Sort: models.SortCreatedAt, Limit: 10, Search: "SEND/C"})
+	if err != nil || !slices.Equal(endpoints(page.Subscriptions), []string{"https://fcm.googleapis.com/fcm/send/c"}) {
+		t.Errorf("search = %v, %v, want send/c", endpoints(page.Subscriptions), err)
+	}
+
+	// The IP is not searchable, so the listing cannot tell whether an address subscribed
+	page, err = s.ListSubscriptions(models.SubscriptionQuery{Sort: models.SortCreatedAt, Limit: 10, Search: "203.0.113"})
+	if err != nil || len(page.Subscriptions) != 0 {
+		t.Errorf("search by IP = %v, %v, want none", endpoints(page.Subscriptions), err)
+	}
+
+	_, err = s.ListSubscriptions(models.SubscriptionQuery{Sort: models.SortCreatedAt, Limit: 10, Cursor: "not a cursor"})
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("bad cursor error = %v, want ErrInvalidCursor", err)
+	}
+}
+
+func testCountSubscriptionsBy(t *testing.T, s Store) {
+	a := testSubscription("https://fcm.googleapis.com/fcm/send/a", testTime)
+	b := testSubscription("https://fcm.googleapis.com/fcm/send/b", testTime)
+	c := testSubscription("https://updates.push.services.mozilla.com/wpush/v2/c", testTime)
+	c.Browser, c.BrowserVersion, c.PushService = "Firefox", "121.0", "mozilla"
+	a.Nation, b.Nation, c.Nation = "DE", "FR", "DE"
+	mustSave(t, s, a, b, c)
+
+	tests := []struct {
+		dimension string
+		filter    models.SubscriptionFilter
+		want      map[string]int
+	}{
+		{models.BreakdownBrowser, models.SubscriptionFilter{}, map[string]int{"Chrome": 2, "Firefox": 1}},
+		{models.BreakdownBrowserVersion, models.SubscriptionFilter{}, map[string]int{"Chrome 120": 2, "Firefox 121": 1}},
+		{models.BreakdownNation, models.SubscriptionFilter{Browser: "Chrome"}, map[string]int{"DE": 1, "FR": 1}},
+		{models.BreakdownPushService, models.SubscriptionFilter{}, map[string]int{"fcm.googleapis.com": 2, "updates.push.services.mozilla.com": 1}},
+		{models.BreakdownService, models.SubscriptionFilter{Nation: "DE"}, map[string]int{"fcm": 1, "mozilla": 1}},
+	}
+	for _, tt := range tests {
+		got, err := s.CountSubscriptionsBy(tt.dimension, tt.filter)
+		if err != nil {
+			t.Errorf("CountSubscriptionsBy(%s): %v", tt.dimension, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("CountSubscriptionsBy(%s, %+v) = %v, want %v", tt.dimension, tt.filter, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("CountSubscriptionsBy(%s, %+v) = %v, want %v", tt.dimension, tt.filter, got, tt.want)
+				break
+			}
+		}
+	}
+
+	if _, err := s.CountSubscriptionsBy("nonsense", models.SubscriptionFilter{}); err == nil {
+		t.Error("CountSubscriptionsBy(nonsense) succeeded, want an error")
+	}
+}
+
+func testRetention(t *testing.T, s Store) {
+	now := time.Now().UTC().Truncate(time.Second)
+	old := testSubscription("https://fcm.googleapis.com/fcm/send/old", now.AddDate(0, 0, -40))
+	recent := testSubscription("https://fcm.googleapis.com/fcm/send/recent", now.Add(-time.Hour))
+	mustSave(t, s, old, recent)
+
+	n, err := s.ClearSubscriptionIPs(now.AddDate(0, 0, -30))
+	if err != nil || n != 1 {
+		t.Fatalf("ClearSubscriptionIPs = %d, %v, want 1", n, err)
+	}
+	if got, _ := s.GetSubscription(old.Endpoint); got.IP != "" {
+		t.Errorf("old IP = %q, want cleared", got.IP)
+	}
+	if got, _ := s.GetSubscription(recent.Endpoint); got.IP != recent.IP {
+		t.Errorf("recent IP = %q, want kept", got.IP)
+	}
+
+	// A returning subscriber keeps created_at but its new IP starts a fresh retention period
+	returning := testSubscription("https://fcm.googleapis.com/fcm/send/returning", now.AddDate(0, 0, -40))
+	mustSave(t, s, returning)
+	resubscribed := testSubscription(returning.Endpoint, time.Time{})
+	resubscribed.IP = "198.51.100.9"
+	mustSave(t, s, resubscribed)
+	if n, err := s.ClearSubscriptionIPs(now.AddDate(0, 0, -30)); err != nil || n != 0 {
+		t.Errorf("ClearSubscriptionIPs after resubscribe = %d, %v, want 0", n, err)
+	}
+	got, _ := s.GetSubscription(returning.Endpoint)
+	if got.IP != resubscribed.IP || !got.CreatedAt.Equal(returning.CreatedAt) {
+		t.Errorf("resubscribed = IP %q created %v, want IP %q created %v", got.IP, got.CreatedAt, resubscribed.IP, returning.CreatedAt)
+	}
+	s.RemoveSubscription(returning.Endpoint)
+
+	if err := s.CleanupOldSubscriptions(30); err != nil {
+		t.Fatalf("CleanupOldSubscriptions: %v", err)
+	}
+	all, _ := s.GetAllSubscriptions()
+	if got := endpoints(all); !slices.Equal(got, []string{recent.Endpoint}) {
+		t.Errorf("after CleanupOldSubscriptions = %v, want only the recent one", got)
+	}
+}
+
+func testPushCounts(t *testing.T, s Store) {
+	if err := s.IncrementPushCount(3); err != nil {
+		t.Fatalf("IncrementPushCount: %v", err)
+	}
+	s.IncrementPushCount(2)
+	if n, err := s.GetPushCount(); err != nil || n != 5 {
+		t.Errorf("GetPushCount = %d, %v, want 5", n, err)
+	}
+
+	fcm := models.PushStatKey{PushService: "fcm.googleapis.com", Browser: "Chrome"}
+	moz := models.PushStatKey{PushService: "updates.push.services.mozilla.com", Browser: "Firefox"}
+	at := testTime.Add(30 * time.Second)
+	err := s.RecordPushCounts(at, map[models.PushStatKey]models.PushCounts{fcm: {Sent: 2, Failed: 1}, moz: {Sent: 1}})
+	if err != nil {
+		t.Fatalf("RecordPushCounts: %v", err)
+	}
+	s.RecordPushCounts(at.Add(time.Minute), map[models.PushStatKey]models.PushCounts{fcm: {Clicked: 1}})
+
+	series, err := s.GetPushTimeSeries(models.ResolutionMinute, testTime, testTime.Add(time.Hour), "")
+	if err != nil {
+		t.Fatalf("GetPushTimeSeries: %v", err)
+	}
+	if len(series) != 1 || len(series[0].Points) != 2 {
+		t.Fatalf("GetPushTimeSeries = %+v, want one series of two minutes", series)
+	}
+	first := series[0].Points[0]
+	if !first.Bucket.Equal(testTime) || first.PushCounts != (models.PushCounts{Sent: 3, Failed: 1}) {
+		t.Errorf("first point = %v %+v, want %v sent 3 failed 1", first.Bucket, first.PushCounts, testTime)
+	}
+
+	series, err = s.GetPushTimeSeries(models.ResolutionDay, testTime.Truncate(24*time.Hour), testTime.Add(24*time.Hour), "push_service")
+	if err != nil {
+		t.Fatalf("GetPushTimeSeries(push_service): %v", err)
+	}
+	if len(series) != 2 || series[0].Key != fcm.PushService || series[0].Points[0].PushCounts != (models.PushCounts{Sent: 2, Failed: 1, Clicked: 1}) {
+		t.Errorf("grouped day series = %+v", series)
+	}
+
+	if err := s.PruneTimeSeries(models.ResolutionMinute, testTime.Add(time.Minute)); err != nil {
+		t.Fatalf("PruneTimeSeries: %v", err)
+	}
+	series, _ = s.GetPushTimeSeries(models.ResolutionMinute, testTime, testTime.Add(time.Hour), "")
+	if len(series) != 1 || len(series[0].Points) != 1 {
+		t.Errorf("after PruneTimeSeries = %+v, want only the second minute", series)
+	}
+}
+
+func testDeliveries(t *testing.T, s Store) {
+	endpoint := "https://fcm.googleapis.com/fcm/send/a"
+	err := s.RecordDeliveries([]models.Delivery{
+		{Endpoint: endpoint, Event: models.PushSent, StatusCode: 201, CreatedAt: testTime},
+		{Endpoint: endpoint, Event: models.PushClicked, CreatedAt: testTime.Add(time.Hour)},
+		{Endpoint: "https://fcm.googleapis.com/fcm/send/b", Event: models.PushFailed, StatusCode: 500, CreatedAt: testTime},
+	})
+	if err != nil {
+		t.Fatalf("RecordDeliveries: %v", err)
+	}
+
+	got, err := s.GetDeliveries(endpoint)
+	if err != nil || len(got) != 2 {
+		t.Fatalf("GetDeliveries = %+v, %v, want 2 entries", got, err)
+	}
+	if got[0].Event != models.PushSent || got[0].StatusCode != 201 || got[1].Event != models.PushClicked {
+		t.Errorf("GetDeliveries = %+v, want sent then clicked", got)
+	}
+
+	n, err := s.PruneDeliveries(testTime.Add(time.Minute))
+	if err != nil || n != 2 {
+		t.Errorf("PruneDeliveries = %d, %v, want 2", n, err)
+	}
+	if got, _ := s.GetDeliveries(endpoint); len(got) != 1 || got[0].Event != models.PushClicked {
+		t.Errorf("after PruneDeliveries = %+v, want the click only", got)
+	}
+}
+
+func testPendingDeliveries(t *testing.T, s Store) {
+	pending := []models.PendingDelivery{
+		{Endpoint: "https://fcm.googleapis.com/fcm/send/a", Payload: []byte(`{"title":"a"}`), SendOptions: models.SendOptions{TTL: 60, Urgency: "high"}},
+		{Endpoint: "https://fcm.googleapis.com/fcm/send/b", Payload: []byte(`{"title":"b"}`)},
+	}
+	if err := s.SavePendingDeliveries(pending); err != nil {
+		t.Fatalf("SavePendingDeliveries: %v", err)
+	}
+
+	now := time.Now()
+	got, err := s.ClaimPendingDeliveries(now.Add(-time.Hour))
+	if err != nil || len(got) != 2 {
+		t.Fatalf("ClaimPendingDeliveries = %+v, %v, want 2", got, err)
+	}
+	for i := range pending {
+		if got[i].Endpoint != pending[i].Endpoint || string(got[i].Payload) != string(pending[i].Payload) || got[i].SendOptions != pending[i].SendOptions {
+			t.Errorf("pending[%d] = %+v, want %+v", i, got[i], pending[i])
+		}
+	}
+
+	if again, err := s.ClaimPendingDeliveries(now.Add(-time.Hour)); err != nil || len(again) != 0 {
+		t.Errorf("second ClaimPendingDeliveries = %+v, %v, want none while claimed", again, err)
+	}
+
+	// A sent delivery is deleted; one its claimer never finished is claimed again once abandoned
+	if err := s.DeletePendingDelivery(got[0].ID); err != nil {
+		t.Fatalf("DeletePendingDelivery: %v", err)
+	}
+	again, err := s.ClaimPendingDeliveries(now.Add(time.Hour))
+	if err != nil || len(again) != 1 || again[0].ID != got[1].ID {
+		t.Errorf("ClaimPendingDeliveries after abandonment = %+v, %v, want only %s", again, err, got[1].Endpoint)
+	}
+}
+
+func testIdempotencyKeys(t *testing.T, s Store) {
+	now := time.Now().UTC().Truncate(time.Second)
+	expired, abandoned := now.Add(-24*time.Hour), now.Add(-time.Hour)
+	rec := models.IdempotencyRecord{Key: "k1", Fingerprint: "f1", CreatedAt: now}
+
+	existing, err := s.ClaimIdempotencyKey(rec, expired, abandoned)
+	if err != nil || existing != nil {
+		t.Fatalf("first claim = %+v, %v, want claimed", existing, err)
+	}
+
+	existing, err = s.ClaimIdempotencyKey(models.IdempotencyRecord{Key: "k1", Fingerprint: "f2", CreatedAt: now}, expired, abandoned)
+	if err != nil || existing == nil {
+		t.Fatalf("second claim = %+v, %v, want the stored record", existing, err)
+	}
+	if existing.Fingerprint != "f1" || existing.StatusCode != 0 {
+		t.Errorf("in-progress record = %+v, want fingerprint f1 and status 0", *existing)
+	}
+
+	if err := s.CompleteIdempotencyKey("k1", 200, "application/json", []byte(`{"sent":1}`)); err != nil {
+		t.Fatalf("CompleteIdempotencyKey: %v", err)
+	}
+	existing, err = s.ClaimIdempotencyKey(rec, expired, abandoned)
+	if err != nil || existing == nil {
+		t.Fatalf("claim after completion = %+v, %v, want the stored record", existing, err)
+	}
+	if existing.StatusCode != 200 || existing.ContentType != "application/json" || string(existing.Response) != `{"sent":1}` {
+		t.Errorf("completed record = %+v", *existing)
+	}
+
+	// A completed key is only reclaimed once it expired
+	existing, err = s.ClaimIdempotencyKey(models.IdempotencyRecord{Key: "k1", Fingerprint: "f3", CreatedAt: now}, now.Add(time.Second), abandoned)
+	if err != nil || existing != nil {
+		t.Errorf("claim of expired key = %+v, %v, want claimed", existing, err)
+	}
+
+	// An in-progress key is reclaimed once abandoned, even before it expires
+	stale := models.IdempotencyRecord{Key: "k2", Fingerprint: "f1", CreatedAt: now.Add(-2 * time.Hour)}
+	if existing, err := s.ClaimIdempotencyKey(stale, expired, abandoned); err != nil || existing != nil {
+		t.Fatalf("claim of k2 = %+v, %v", existing, err)
+	}
+	if existing, err := s.ClaimIdempotencyKey(models.IdempotencyRecord{Key: "k2", Fingerprint: "f1", CreatedAt: now}, expired, abandoned); err != nil || existing != nil {
+		t.Errorf("claim of abandoned key = %+v, %v, want claimed", existing, err)
+	}
+
+	// Releasing frees an in-progress key but leaves a completed one alone
+	released := models.IdempotencyRecord{Key: "k4", Fingerprint: "f1", CreatedAt: now}
+	s.ClaimIdempotencyKey(released, expired, abandoned)
+	if err := s.ReleaseIdempotencyKey("k4"); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey: %v", err)
+	}
+	if existing, err := s.ClaimIdempotencyKey(released, expired, abandoned); err != nil || existing != nil {
+		t.Errorf("claim of released key = %+v, %v, want claimed", existing, err)
+	}
+	s.CompleteIdempotencyKey("k4", 202, "application/json", nil)
+	s.ReleaseIdempotencyKey("k4")
+	if existing, err := s.ClaimIdempotencyKey(released, expired, abandoned); err != nil || existing == nil || existing.StatusCode != 202 {
+		t.Errorf("claim after releasing a completed key = %+v, %v, want the stored record", existing, err)
+	}
+
+	old := models.IdempotencyRecord{Key: "k3", Fingerprint: "f1", CreatedAt: now.Add(-48 * time.Hour)}
+	s.ClaimIdempotencyKey(old, now.Add(-72*time.Hour), now.Add(-72*time.Hour))
+	if n, err := s.PruneIdempotencyKeys(expired); err != nil || n != 1 {
+		t.Errorf("PruneIdempotencyKeys = %d, %v, want 1", n, err)
+	}
+}
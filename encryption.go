@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"webpush/config"
+	"webpush/database"
+)
+
+// setupEncryption enables at-rest encryption of subscription secrets when a
+// master key is configured. Without one it refuses to start against a
+// database that already holds encrypted data.
+func setupEncryption(store database.Store, cfg config.Config) error {
+	master, err := database.LoadMasterKey(cfg.EncryptionKey, cfg.EncryptionKeyFile)
+	if err != nil {
+		return err
+	}
+
+	enc, ok := store.(database.Encrypter)
+	if !ok {
+		if master != nil {
+			log.Printf("The %s driver keeps nothing at rest, encryption key ignored", cfg.DBDriver)
+		}
+		return nil
+	}
+
+	if master == nil {
+		keys, err := enc.GetDataKeys()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			return database.ErrMasterKeyRequired
+		}
+		return nil
+	}
+
+	keyring, err := database.OpenKeyring(enc, master)
+	if err != nil {
+		return err
+	}
+	enc.EnableEncryption(keyring)
+	log.Println("Subscription secrets are encrypted at rest")
+	return nil
+}
+
+// runRotateKey implements the rotate-key subcommand: it re-encrypts every
+// subscription with a new data key. With -old-key or -old-key-file it also
+// moves from that master key to the one currently configured. With -prune it
+// instead deletes data keys replaced by an earlier rotation.
+func runRotateKey(args []string) {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	oldKey := flags.String("old-key", "", "previous base64 master key, when rotating the master key")
+	oldKeyFile := flags.String("old-key-file", "", "file holding the previous master key")
+	prune := flags.Bool("prune", false, "delete data keys replaced by an earlier rotation; run once every instance has restarted or run for 5 minutes since")
+	flags.Parse(args)
+
+	cfg := config.Load()
+	master, err := database.LoadMasterKey(cfg.EncryptionKey, cfg.EncryptionKeyFile)
+	if err != nil {
+		log.Fatalf("Invalid master key: %v", err)
+	}
+	if master == nil {
+		log.Fatal("Set WEBPUSH_ENCRYPTION_KEY or WEBPUSH_ENCRYPTION_KEY_FILE to the master key to encrypt with")
+	}
+	old, err := database.LoadMasterKey(*oldKey, *oldKeyFile)
+	if err != nil {
+		log.Fatalf("Invalid old master key: %v", err)
+	}
+
+	store, err := database.Open(cfg.DBDriver, cfg.DBDSN)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
+
+	enc, ok := store.(database.Encrypter)
+	if !ok {
+		fmt.Printf("The %s driver keeps nothing at rest, nothing to rotate\n", cfg.DBDriver)
+		return
+	}
+	if err := migrateOnStartup(store, cfg.AutoMigrate, false); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	var oldMasters [][]byte
+	if old != nil {
+		oldMasters = append(oldMasters, old)
+	}
+	keyring, err := database.OpenKeyring(enc, master, oldMasters...)
+	if err != nil {
+		log.Fatalf("Failed to load data keys: %v", err)
+	}
+	enc.EnableEncryption(keyring)
+
+	if *prune {
+		n, err := database.PruneDataKeys(store, keyring)
+		if err != nil {
+			log.Fatalf("Pruning data keys failed: %v", err)
+		}
+		fmt.Printf("Deleted %d unused data keys\n", n)
+		return
+	}
+
+	n, err := database.RotateDataKey(store, keyring)
+	if err != nil {
+		log.Printf("Rotation stopped after %d subscriptions: %v", n, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Re-encrypted %d subscriptions with a new data key\n", n)
+	fmt.Println("Old data keys are kept; run rotate-key -prune once every instance has restarted or run for 5 minutes")
+}
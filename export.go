@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"webpush/config"
+	"webpush/database"
+	"webpush/utils"
+)
+
+// openDataStore opens the configured store for a subcommand that reads or
+// writes subscriptions, migrating it and enabling encryption as the server does
+func openDataStore(cfg config.Config) database.Store {
+	store, err := database.Open(cfg.DBDriver, cfg.DBDSN)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	if err := migrateOnStartup(store, cfg.AutoMigrate, false); err != nil {
+		store.Close()
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+	if err := setupEncryption(store, cfg); err != nil {
+		store.Close()
+		log.Fatalf("Failed to set up encryption: %v", err)
+	}
+	return store
+}
+
+// runExport implements the export subcommand: it writes every subscription as
+// CSV or NDJSON to a file or standard output
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "", "csv or ndjson (default from the -o extension, else csv)")
+	out := flags.String("o", "", "file to write, default standard output")
+	flags.Parse(args)
+
+	if *format == "" {
+		*format = database.FormatFromName(*out)
+	}
+	if *format == "" {
+		*format = database.FormatCSV
+	}
+	if *format != database.FormatCSV && *format != database.FormatNDJSON {
+		log.Fatalf("Unknown format %q, use csv or ndjson", *format)
+	}
+
+	store := openDataStore(config.Load())
+	defer store.Close()
+
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if *out != "" {
+		var err error
+		file, err = os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *out, err)
+		}
+		w = file
+	}
+	buf := bufio.NewWriter(w)
+
+	n, err := database.ExportSubscriptions(buf, store, *format)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil && file != nil {
+		err = file.Close()
+	}
+	if err != nil {
+		log.Fatalf("Export failed after %d subscriptions: %v", n, err)
+	}
+	log.Printf("Exported %d subscriptions", n)
+}
+
+// runImport implements the import subcommand: it upserts subscriptions from a
+// CSV or NDJSON file by endpoint and reports rows that were rejected
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "csv or ndjson (default from the file extension)")
+	dryRun := flags.Bool("dry-run", false, "validate the file without saving anything")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: webpush import [-format csv|ndjson] [-dry-run] <file, or - for standard input>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	src := flags.Arg(0)
+
+	if *format == "" {
+		*format = database.FormatFromName(src)
+	}
+	if *format != database.FormatCSV && *format != database.FormatNDJSON {
+		log.Fatal("Set -format to csv or ndjson")
+	}
+
+	var r io.Reader = os.Stdin
+	if src != "-" {
+		f, err := os.Open(src)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", src, err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	cfg := config.Load()
+	anonymizer, err := utils.NewIPAnonymizer(cfg.IPMode, cfg.IPHashSalt)
+	if err != nil {
+		log.Fatalf("Invalid WEBPUSH_IP_MODE: %v", err)
+	}
+	store := openDataStore(cfg)
+	defer store.Close()
+
+	result, err := database.ImportSubscriptions(bufio.NewReader(r), store, anonymizer, *format, *dryRun)
+	for _, e := range result.Errors {
+		fmt.Printf("line %d: %s %s\n", e.Line, e.Error, e.Endpoint)
+	}
+	if result.Failed > len(result.Errors) {
+		fmt.Printf("... and %d more rejected rows\n", result.Failed-len(result.Errors))
+	}
+
+	verb := "Imported"
+	if *dryRun {
+		verb = "Dry run, would import"
+	}
+	fmt.Printf("%s: %d created, %d updated, %d rejected\n", verb, result.Created, result.Updated, result.Failed)
+	if err != nil {
+		store.Close()
+		log.Fatalf("Import stopped: %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// authorizeAdmin checks the bearer token on /admin/ requests and writes a 401
+// response if it does not match. With no admin token configured the admin
+// endpoints are disabled and answer 403.
+func (h *Handler) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if h.adminToken == "" {
+		writeJSONError(w, http.StatusForbidden, "This endpoint requires WEBPUSH_ADMIN_TOKEN to be set")
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="webpush admin"`)
+		writeJSONError(w, http.StatusUnauthorized, "Admin token required")
+		return false
+	}
+	return true
+}
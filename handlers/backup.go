@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+	"webpush/database"
+)
+
+// backupTimeout bounds a single snapshot
+const backupTimeout = 10 * time.Minute
+
+// backup writes a snapshot of the store into the backup directory and rotates old ones
+func (h *Handler) backup(ctx context.Context) (string, error) {
+	b, ok := h.store.(database.Backuper)
+	if !ok {
+		return "", errBackupUnsupported
+	}
+
+	h.backupMu.Lock()
+	defer h.backupMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, backupTimeout)
+	defer cancel()
+	return database.CreateBackup(ctx, b, h.backupDir, h.backupKeep)
+}
+
+// errBackupUnsupported is returned for stores without online backup, such as PostgreSQL
+var errBackupUnsupported = errors.New("the configured storage driver does not support online backup")
+
+// BackupHandler takes a database snapshot on demand (POST /admin/backup)
+func (h *Handler) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	path, err := h.backup(r.Context())
+	if errors.Is(err, errBackupUnsupported) {
+		writeJSONError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil && path == "" {
+		log.Printf("[Backup] Error creating backup: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create backup")
+		return
+	}
+	if err != nil {
+		log.Printf("[Backup] %v", err)
+	}
+
+	var size int64
+	if fi, err := os.Stat(path); err == nil {
+		size = fi.Size()
+	}
+	log.Printf("[Backup] Wrote %s (%d bytes)", path, size)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file": filepath.Base(path),
+		"size": size,
+	})
+}
+
+// StartBackupScheduler starts a background goroutine that takes a backup every
+// interval, keeping the newest backups according to the configured rotation
+func (h *Handler) StartBackupScheduler(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	if _, ok := h.store.(database.Backuper); !ok {
+		log.Println("[Backup] Scheduled backups skipped: storage driver has no online backup")
+		return
+	}
+
+	go func() {
+		// Restarts should not postpone backups, so time the first one from the newest existing backup
+		wait := interval
+		if backups, err := database.ListBackups(h.backupDir); err == nil && len(backups) > 0 {
+			if fi, err := os.Stat(backups[0]); err == nil {
+				wait = max(interval-time.Since(fi.ModTime()), 0)
+			}
+		}
+
+		for {
+			time.Sleep(wait)
+			wait = interval
+
+			path, err := h.backup(context.Background())
+			if err != nil {
+				log.Printf("[Backup] Scheduled backup failed: %v", err)
+			}
+			if path != "" {
+				log.Printf("[Backup] Scheduled backup written to %s", path)
+			}
+		}
+	}()
+	log.Printf("[Backup] Backing up every %s to %s, keeping %d", interval, h.backupDir, h.backupKeep)
+}
@@ -1,39 +1,225 @@
-package handlers
-
-import (
-	"encoding/json"
-	"net/http"
-	"webpush/database"
-	"webpush/models"
-)
-
-// GetDashboardStatsHandler returns statistics for the dashboard
-func GetDashboardStatsHandler(w http.ResponseWriter, r *http.Request) {
-	subs := LoadSubscriptions()
-
-	// Get countries from database with proper aggregation
-	countries, err := database.GetCountByNation()
-	if err != nil {
-		countries = make(map[string]int)
-	}
-
-	stats := models.DashboardStats{
-		TotalClients:  len(subs),
-		OnlineClients: len(subs), // For now, all subscriptions are considered online
-		TotalPushes:   database.GetPushCount(),
-		Countries:     countries,
-		Subscriptions: subs,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
-}
-
-// ServeDashboard serves the dashboard HTML page
-func ServeDashboard(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
-		return
-	}
-	http.ServeFile(w, r, "static/index.html")
-}
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"webpush/database"
+	"webpush/models"
+	"webpush/utils"
+)
+
+// Subscription listing page sizes
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// GetDashboardStatsHandler returns aggregate statistics for the dashboard.
+// The nation, os, browser and push_service query parameters restrict the
+// breakdowns, e.g. ?nation=Germany for the browser share within Germany.
+// Individual subscriptions are listed by GetSubscriptionsHandler.
+func (h *Handler) GetDashboardStatsHandler(w http.ResponseWriter, r *http.Request) {
+	totalClients, err := h.store.CountSubscriptions()
+	if err != nil {
+		log.Printf("Error counting subscriptions: %v", err)
+	}
+
+	totalPushes, err := h.store.GetPushCount()
+	if err != nil {
+		log.Printf("Error getting push count: %v", err)
+	}
+
+	filter := subscriptionFilter(r.URL.Query())
+	now := time.Now()
+	stats := models.DashboardStats{
+		TotalClients:   totalClients,
+		OnlineClients:  h.countActiveSince(now.Add(-h.onlineWindow)),
+		ActiveToday:    h.countActiveSince(now.Add(-24 * time.Hour)),
+		ActiveThisWeek: h.countActiveSince(now.Add(-7 * 24 * time.Hour)),
+		OnlineWindow:   int(h.onlineWindow.Seconds()),
+		TotalPushes:    totalPushes,
+
+		Countries:       h.countSubscriptionsBy(models.BreakdownNation, filter),
+		Browsers:        h.countSubscriptionsBy(models.BreakdownBrowser, filter),
+		OS:              h.countSubscriptionsBy(models.BreakdownOS, filter),
+		BrowserVersions: h.countSubscriptionsBy(models.BreakdownBrowserVersion, filter),
+		OSVersions:      h.countSubscriptionsBy(models.BreakdownOSVersion, filter),
+		PushServices:    h.countSubscriptionsBy(models.BreakdownPushService, filter),
+		Services:        h.countSubscriptionsBy(models.BreakdownService, filter),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// GetSubscriptionsHandler returns a page of subscriptions (GET /api/subscriptions).
+//
+// Query parameters: sort (created_at or last_active), order (desc or asc),
+// limit (1-500, default 50), cursor (next_cursor of the previous page),
+// q (search in the endpoint), and nation, os, browser and push_service filters.
+func (h *Handler) GetSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	q := models.SubscriptionQuery{
+		Sort:   params.Get("sort"),
+		Cursor: params.Get("cursor"),
+		Search: strings.TrimSpace(params.Get("q")),
+		Limit:  defaultPageSize,
+
+		SubscriptionFilter: subscriptionFilter(params),
+	}
+
+	switch q.Sort {
+	case "":
+		q.Sort = models.SortCreatedAt
+	case models.SortCreatedAt, models.SortLastActive:
+	default:
+		writeJSONError(w, http.StatusBadRequest, "sort must be created_at or last_active")
+		return
+	}
+
+	switch params.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Asc = true
+	default:
+		writeJSONError(w, http.StatusBadRequest, "order must be asc or desc")
+		return
+	}
+
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+		q.Limit = limit
+	}
+
+	page, err := h.store.ListSubscriptions(q)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		writeJSONError(w, http.StatusBadRequest, "Invalid cursor for this sort order")
+		return
+	}
+	if err != nil {
+		log.Printf("Error listing subscriptions: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list subscriptions")
+		return
+	}
+	resp := subscriptionListPage{Subscriptions: make([]subscriptionListItem, len(page.Subscriptions)), NextCursor: page.NextCursor}
+	for i, sub := range page.Subscriptions {
+		resp.Subscriptions[i] = newSubscriptionListItem(sub)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// subscriptionListPage is a page of the subscription listing
+type subscriptionListPage struct {
+	Subscriptions []subscriptionListItem `json:"subscriptions"`
+	NextCursor    string                 `json:"next_cursor,omitempty"`
+}
+
+// subscriptionListItem is a subscription as the unauthenticated listing shows
+// it: without the push keys, which let anyone send to the subscriber, the IP
+// and the user ID, which only admin-authorized privacy requests may look up
+type subscriptionListItem struct {
+	Endpoint        string    `json:"endpoint"`
+	Nation          string    `json:"nation,omitempty"`
+	Region          string    `json:"region,omitempty"`
+	City            string    `json:"city,omitempty"`
+	ASN             int       `json:"asn,omitempty"`
+	ASOrg           string    `json:"as_org,omitempty"`
+	TimeZone        string    `json:"timezone,omitempty"`
+	OS              string    `json:"os,omitempty"`
+	OSVersion       string    `json:"os_version,omitempty"`
+	Browser         string    `json:"browser,omitempty"`
+	BrowserVersion  string    `json:"browser_version,omitempty"`
+	DeviceType      string    `json:"device_type,omitempty"`
+	Engine          string    `json:"engine,omitempty"`
+	DeviceVendor    string    `json:"device_vendor,omitempty"`
+	PushService     string    `json:"push_service,omitempty"`
+	Platform        string    `json:"platform,omitempty"`
+	PlatformVersion string    `json:"platform_version,omitempty"`
+	Tags            []string  `json:"tags,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	LastActive      time.Time `json:"last_active"`
+}
+
+func newSubscriptionListItem(sub models.Subscription) subscriptionListItem {
+	return subscriptionListItem{
+		Endpoint:        sub.Endpoint,
+		Nation:          sub.Nation,
+		Region:          sub.Region,
+		City:            sub.City,
+		ASN:             sub.ASN,
+		ASOrg:           sub.ASOrg,
+		TimeZone:        sub.TimeZone,
+		OS:              sub.OS,
+		OSVersion:       sub.OSVersion,
+		Browser:         sub.Browser,
+		BrowserVersion:  sub.BrowserVersion,
+		DeviceType:      sub.DeviceType,
+		Engine:          sub.Engine,
+		DeviceVendor:    sub.DeviceVendor,
+		PushService:     sub.PushService,
+		Platform:        sub.Platform,
+		PlatformVersion: sub.PlatformVersion,
+		Tags:            sub.Tags,
+		CreatedAt:       sub.CreatedAt,
+		LastActive:      sub.LastActive,
+	}
+}
+
+// subscriptionFilter reads the exact-match subscription filters from query parameters
+func subscriptionFilter(params url.Values) models.SubscriptionFilter {
+	return models.SubscriptionFilter{
+		Nation:      params.Get("nation"),
+		OS:          params.Get("os"),
+		Browser:     params.Get("browser"),
+		PushService: params.Get("push_service"),
+	}
+}
+
+// countSubscriptionsBy returns the subscription breakdown for dimension, or an empty map on error
+func (h *Handler) countSubscriptionsBy(dimension string, f models.SubscriptionFilter) map[string]int {
+	counts, err := h.store.CountSubscriptionsBy(dimension, f)
+	if err != nil {
+		log.Printf("Error counting subscriptions by %s: %v", dimension, err)
+		return make(map[string]int)
+	}
+	return counts
+}
+
+// countActiveSince returns the number of clients seen since the given time, or 0 on error
+func (h *Handler) countActiveSince(since time.Time) int {
+	count, err := h.store.CountActiveSince(since)
+	if err != nil {
+		log.Printf("Error counting active clients: %v", err)
+		return 0
+	}
+	return count
+}
+
+// ServeDashboard serves the dashboard HTML page
+func ServeDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	// Ask for the Client Hints that are not sent by default, so /subscribe gets them
+	w.Header().Set("Accept-CH", utils.AcceptCH)
+	http.ServeFile(w, r, "static/index.html")
+}
@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"webpush/database"
+	"webpush/metrics"
+	"webpush/models"
+	"webpush/utils"
+)
+
+// delivery is one push message waiting to be sent to one subscription
+type delivery struct {
+	sub     models.Subscription
+	payload []byte
+	opts    models.SendOptions
+	done    chan deliveryResult
+
+	// pendingID is the stored pending delivery this resumes, deleted once it is
+	// sent or saved again; 0 for new deliveries
+	pendingID int64
+}
+
+// deliveryResult is the outcome of a delivery.
+// Deferred is set when the dispatcher stopped before sending and the delivery was persisted.
+type deliveryResult struct {
+	StatusCode int
+	Body       string
+	Err        error
+	Deferred   bool
+}
+
+// dispatcher sends queued deliveries. Each push service host has its own queue,
+// worked by up to the limiter's per-host concurrency, so a host that is paced or
+// paused by its rate limit only holds up its own deliveries. slots bounds the
+// sends in flight across all hosts.
+type dispatcher struct {
+	jobs    database.JobStore
+	vapid   VAPIDKeys
+	limiter *utils.PushRateLimiter
+	slots   chan struct{}
+
+	mu       sync.Mutex
+	hosts    map[string]*hostQueue
+	queued   int
+	inFlight int
+	started  bool
+	stopped  bool
+	workers  sync.WaitGroup
+}
+
+// hostQueue holds the deliveries waiting for one push service host
+type hostQueue struct {
+	host    string
+	queue   []*delivery
+	workers int
+}
+
+// newDispatcher returns a stopped dispatcher that persists unsent work to jobs,
+// signs pushes with vapid, paces its sends with limiter and sends at most
+// sendWorkers pushes at a time
+func newDispatcher(jobs database.JobStore, vapid VAPIDKeys, limiter *utils.PushRateLimiter, sendWorkers int) *dispatcher {
+	if sendWorkers < 1 {
+		sendWorkers = 1
+	}
+	return &dispatcher{
+		jobs:    jobs,
+		vapid:   vapid,
+		limiter: limiter,
+		slots:   make(chan struct{}, sendWorkers),
+		hosts:   make(map[string]*hostQueue),
+	}
+}
+
+// pendingAbandonAfter is how long a claimed pending delivery may stay unsent
+// before another resume pass claims it, for instances that crashed while resuming
+const pendingAbandonAfter = time.Hour
+
+// StartDispatcher starts accepting deliveries and resumes those persisted by a
+// previous shutdown, then hourly resumes deliveries persisted by other instances
+// or abandoned by a crash
+func (h *Handler) StartDispatcher() {
+	d := h.dispatcher
+	d.mu.Lock()
+	d.started = true
+	d.mu.Unlock()
+	log.Printf("[Dispatcher] Started with %d concurrent sends", cap(d.slots))
+
+	go func() {
+		for !d.isStopped() {
+			h.resumePendingDeliveries()
+			time.Sleep(retentionInterval)
+		}
+	}()
+}
+
+// StopDispatcher waits for queued and in-flight deliveries to finish until ctx expires.
+// Deliveries still queued at that point are persisted and resumed on next start.
+// Sends already on the wire may then finish until sendCtx expires, so their
+// results are recorded.
+func (h *Handler) StopDispatcher(ctx, sendCtx context.Context) {
+	d := h.dispatcher
+	d.mu.Lock()
+	for (d.queued > 0 || d.inFlight > 0) && ctx.Err() == nil {
+		d.mu.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+		d.mu.Lock()
+	}
+	d.stopped = true
+	var remaining []*delivery
+	for _, q := range d.hosts {
+		remaining = append(remaining, q.queue...)
+		q.queue = nil
+	}
+	d.queued = 0
+	d.mu.Unlock()
+	metrics.QueueDepth.Set(0)
+
+	d.deferDeliveries(remaining)
+
+	done := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("[Dispatcher] Stopped")
+	case <-sendCtx.Done():
+		log.Println("[Dispatcher] Stopped with sends still in flight")
+	}
+}
+
+// isStopped reports whether StopDispatcher was called
+func (d *dispatcher) isStopped() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stopped
+}
+
+// CheckDispatcher reports an error if the dispatcher is not accepting deliveries
+func (h *Handler) CheckDispatcher(ctx context.Context) error {
+	d := h.dispatcher
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.started {
+		return errors.New("dispatcher not started")
+	}
+	if d.stopped {
+		return errors.New("dispatcher stopped")
+	}
+	return nil
+}
+
+// dispatch queues the deliveries and waits for all of them to finish or be deferred.
+// Results are returned in the same order as the deliveries.
+func (d *dispatcher) dispatch(deliveries []*delivery) []deliveryResult {
+	for _, dl := range deliveries {
+		dl.done = make(chan deliveryResult, 1)
+	}
+
+	d.mu.Lock()
+	if d.stopped || !d.started {
+		d.mu.Unlock()
+		d.deferDeliveries(deliveries)
+	} else {
+		for _, dl := range deliveries {
+			d.enqueue(dl)
+		}
+		metrics.QueueDepth.Set(float64(d.queued))
+		d.mu.Unlock()
+	}
+
+	results := make([]deliveryResult, len(deliveries))
+	for i, dl := range deliveries {
+		results[i] = <-dl.done
+	}
+	return results
+}
+
+// enqueue adds a delivery to its host's queue and starts another worker for the
+// host if it has fewer than the per-host concurrency. d.mu must be held.
+func (d *dispatcher) enqueue(dl *delivery) {
+	host := utils.PushServiceHost(dl.sub.Endpoint)
+	q, ok := d.hosts[host]
+	if !ok {
+		q = &hostQueue{host: host}
+		d.hosts[host] = q
+	}
+	q.queue = append(q.queue, dl)
+	d.queued++
+
+	if q.workers < d.limiter.Concurrency() {
+		q.workers++
+		d.workers.Add(1)
+		go d.worker(q)
+	}
+}
+
+// worker sends deliveries from a host's queue until it is empty or the dispatcher stops
+func (d *dispatcher) worker(q *hostQueue) {
+	defer d.workers.Done()
+
+	for {
+		d.mu.Lock()
+		if len(q.queue) == 0 || d.stopped {
+			q.workers--
+			if q.workers == 0 && len(q.queue) == 0 {
+				delete(d.hosts, q.host)
+			}
+			d.mu.Unlock()
+			return
+		}
+		dl := q.queue[0]
+		q.queue[0] = nil
+		q.queue = q.queue[1:]
+		d.queued--
+		d.inFlight++
+		metrics.QueueDepth.Set(float64(d.queued))
+		d.mu.Unlock()
+
+		d.finish(dl, d.deliver(dl))
+
+		d.mu.Lock()
+		d.inFlight--
+		d.mu.Unlock()
+	}
+}
+
+// maxThrottleRetries is how often a delivery is retried after the push service
+// answered 429 or 503; the rate limiter pauses the host before each retry
+const maxThrottleRetries = 2
+
+// deliver sends one delivery and reads the error body, if any, before closing the response
+func (d *dispatcher) deliver(dl *delivery) deliveryResult {
+	for attempt := 0; ; attempt++ {
+		resp, err := d.send(dl.payload, dl.sub, dl.opts)
+		if err != nil {
+			return deliveryResult{Err: err}
+		}
+
+		result := deliveryResult{StatusCode: resp.StatusCode}
+		if resp.StatusCode >= 400 {
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			result.Body = string(bodyBytes)
+		} else {
+			// Drain the body so the connection can be reused
+			io.Copy(io.Discard, resp.Body)
+		}
+		resp.Body.Close()
+
+		throttled := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+		if !throttled || attempt == maxThrottleRetries {
+			return result
+		}
+	}
+}
+
+// deferDeliveries persists deliveries that could not be sent and releases their waiters
+func (d *dispatcher) deferDeliveries(deliveries []*delivery) {
+	if len(deliveries) == 0 {
+		return
+	}
+
+	pending := make([]models.PendingDelivery, len(deliveries))
+	for i, dl := range deliveries {
+		pending[i] = models.PendingDelivery{Endpoint: dl.sub.Endpoint, Payload: dl.payload, SendOptions: dl.opts}
+	}
+	if err := d.jobs.SavePendingDeliveries(pending); err != nil {
+		// Resumed deliveries keep their claimed rows and are claimed again once abandoned
+		log.Printf("[Dispatcher] Error persisting %d pending deliveries: %v", len(pending), err)
+		for _, dl := range deliveries {
+			dl.done <- deliveryResult{Deferred: true}
+		}
+		return
+	}
+	log.Printf("[Dispatcher] Persisted %d pending deliveries", len(pending))
+
+	for _, dl := range deliveries {
+		d.finish(dl, deliveryResult{Deferred: true})
+	}
+}
+
+// finish reports the result of dl and deletes the pending delivery it resumed, if any
+func (d *dispatcher) finish(dl *delivery, res deliveryResult) {
+	if dl.pendingID != 0 {
+		if err := d.jobs.DeletePendingDelivery(dl.pendingID); err != nil {
+			log.Printf("[Dispatcher] Error deleting resumed pending delivery: %v", err)
+		}
+	}
+	dl.done <- res
+}
+
+// resumePendingDeliveries claims and sends deliveries persisted by a shutdown.
+// Each stays stored until it is sent, so a crash while resuming loses none.
+func (h *Handler) resumePendingDeliveries() {
+	pending, err := h.store.ClaimPendingDeliveries(time.Now().Add(-pendingAbandonAfter))
+	if err != nil {
+		log.Printf("[Dispatcher] Error loading pending deliveries: %v", err)
+		return
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	var deliveries []*delivery
+	for _, p := range pending {
+		sub, err := h.store.GetSubscription(p.Endpoint)
+		if err != nil {
+			log.Printf("[Dispatcher] Error loading subscription of a pending delivery: %v", err)
+			continue
+		}
+		if sub == nil {
+			// Unsubscribed since the delivery was persisted
+			h.store.DeletePendingDelivery(p.ID)
+			continue
+		}
+		deliveries = append(deliveries, &delivery{sub: *sub, payload: p.Payload, opts: p.SendOptions, pendingID: p.ID})
+	}
+	log.Printf("[Dispatcher] Resuming %d pending deliveries", len(deliveries))
+
+	tally := h.newTally()
+	defer tally.flush()
+
+	sent := 0
+	for i, res := range h.dispatcher.dispatch(deliveries) {
+		sub := deliveries[i].sub
+		switch {
+		case res.Deferred:
+		case res.Err != nil:
+			tally.add(sub, models.PushFailed, 0)
+		case res.StatusCode == 404 || res.StatusCode == 410:
+			tally.add(sub, models.PushExpired, res.StatusCode)
+			h.store.RemoveSubscription(sub.Endpoint)
+			metrics.SubscriptionsRemoved.WithLabelValues("expired").Inc()
+		case res.StatusCode >= 400:
+			tally.add(sub, models.PushFailed, res.StatusCode)
+		default:
+			tally.add(sub, models.PushSent, res.StatusCode)
+			sent++
+		}
+	}
+	h.store.IncrementPushCount(sent)
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+	"webpush/database"
+	"webpush/metrics"
+)
+
+// maxImportSize bounds the body of an import request; larger files go through the import command
+const maxImportSize = 256 << 20
+
+// exportContentTypes maps export formats to their media type
+var exportContentTypes = map[string]string{
+	database.FormatCSV:    "text/csv; charset=utf-8",
+	database.FormatNDJSON: "application/x-ndjson",
+}
+
+// ExportHandler streams all subscriptions, including their keys, as CSV or
+// NDJSON (GET /admin/export?format=csv|ndjson, default csv)
+func (h *Handler) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = database.FormatCSV
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "format must be csv or ndjson")
+		return
+	}
+
+	name := fmt.Sprintf("webpush-subscriptions-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+
+	// The response is already streaming, so a failure can only be logged; the client sees a truncated file
+	n, err := database.ExportSubscriptions(w, h.store, format)
+	if err != nil {
+		log.Printf("[Export] Export failed after %d subscriptions: %v", n, err)
+		return
+	}
+	log.Printf("[Export] Exported %d subscriptions as %s", n, format)
+}
+
+// importResponse is the body of an import response
+type importResponse struct {
+	database.ImportResult
+	DryRun bool   `json:"dry_run"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ImportHandler upserts subscriptions from a CSV or NDJSON body
+// (POST /admin/import?format=csv|ndjson&dry_run=true). The format defaults
+// from the Content-Type. Invalid rows are skipped and listed in the response.
+func (h *Handler) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "text/csv":
+			format = database.FormatCSV
+		case "application/x-ndjson", "application/jsonl":
+			format = database.FormatNDJSON
+		}
+	}
+	if _, ok := exportContentTypes[format]; !ok {
+		writeJSONError(w, http.StatusBadRequest, "format must be csv or ndjson, set it with ?format= or the Content-Type")
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	body := http.MaxBytesReader(w, r.Body, maxImportSize)
+	result, err := database.ImportSubscriptions(body, h.store, h.anonymizer, format, dryRun)
+	if !dryRun {
+		metrics.SubscriptionsCreated.Add(float64(result.Created))
+	}
+
+	resp := importResponse{ImportResult: result, DryRun: dryRun}
+	status := http.StatusOK
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		status = http.StatusRequestEntityTooLarge
+		resp.Error = fmt.Sprintf("import stopped at the %d MB limit; use the import command for larger files", maxImportSize>>20)
+	case err != nil:
+		status = http.StatusBadRequest
+		resp.Error = err.Error()
+	}
+	log.Printf("[Import] %d created, %d updated, %d failed (dry run: %t)", result.Created, result.Updated, result.Failed, dryRun)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
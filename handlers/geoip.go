@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"webpush/database"
+	"webpush/metrics"
+	"webpush/models"
+	"webpush/utils"
+)
+
+// geoQueueSize bounds the lookups waiting for a worker; further subscriptions
+// are left without a location until the next backfill
+const geoQueueSize = 1024
+
+// geoJob is a subscription waiting for the location of the IP it subscribed from.
+// ip is the full address, which is never stored unless the IP mode is full.
+type geoJob struct {
+	endpoint string
+	ip       netip.Addr
+	storedIP string
+}
+
+// geoEnricher looks up subscription locations in the background, so that
+// /subscribe never waits on the GeoIP provider
+type geoEnricher struct {
+	store database.SubscriptionStore
+	geoip utils.GeoIPProvider
+
+	queue       chan geoJob
+	stop        chan struct{}
+	stopOnce    sync.Once
+	workers     sync.WaitGroup
+	backfilling atomic.Bool
+}
+
+// newGeoEnricher returns a stopped enricher; it does nothing when geoip is nil
+func newGeoEnricher(store database.SubscriptionStore, geoip utils.GeoIPProvider) *geoEnricher {
+	return &geoEnricher{
+		store: store,
+		geoip: geoip,
+		queue: make(chan geoJob, geoQueueSize),
+		stop:  make(chan struct{}),
+	}
+}
+
+// StartGeoEnricher starts the location lookup workers and, with backfill, a
+// pass over existing subscriptions that have no nation yet
+func (h *Handler) StartGeoEnricher(workers int, backfill bool) {
+	e := h.geo
+	if e.geoip == nil {
+		return
+	}
+	for i := 0; i < workers; i++ {
+		e.workers.Add(1)
+		go e.worker()
+	}
+	log.Printf("[GeoIP] Started %d lookup workers", workers)
+
+	if backfill {
+		e.startBackfill()
+	}
+}
+
+// StopGeoEnricher stops the workers after their current lookup. Queued lookups
+// are dropped; the backfill picks them up on the next start.
+func (h *Handler) StopGeoEnricher() {
+	e := h.geo
+	e.stopOnce.Do(func() { close(e.stop) })
+	e.workers.Wait()
+}
+
+// enqueue queues a lookup without blocking. Returns false if the enricher is
+// disabled, stopped or full.
+func (e *geoEnricher) enqueue(job geoJob) bool {
+	if e.geoip == nil || !job.ip.IsValid() {
+		return false
+	}
+	select {
+	case <-e.stop:
+		return false
+	default:
+	}
+	select {
+	case e.queue <- job:
+		metrics.GeoIPQueueDepth.Set(float64(len(e.queue)))
+		return true
+	default:
+		metrics.GeoIPDropped.Inc()
+		return false
+	}
+}
+
+// worker runs queued lookups until the enricher stops
+func (e *geoEnricher) worker() {
+	defer e.workers.Done()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case job := <-e.queue:
+			metrics.GeoIPQueueDepth.Set(float64(len(e.queue)))
+			e.enrich(job)
+		}
+	}
+}
+
+// enrich looks up job's IP and stores the location on its subscription, unless
+// the subscription was removed or resubscribed from another address meanwhile
+func (e *geoEnricher) enrich(job geoJob) {
+	loc := utils.LookupLocation(e.geoip, job.ip)
+	if loc == (utils.GeoLocation{}) {
+		return
+	}
+
+	sub, err := e.store.GetSubscription(job.endpoint)
+	if err != nil {
+		log.Printf("[GeoIP] Error loading subscription for enrichment: %v", err)
+		return
+	}
+	if sub == nil || sub.IP != job.storedIP {
+		return
+	}
+	setLocation(sub, loc)
+	if _, err := e.store.SetSubscriptionLocation(sub); err != nil {
+		log.Printf("[GeoIP] Error saving location: %v", err)
+	}
+}
+
+// setLocation copies the fields of loc onto sub
+func setLocation(sub *models.Subscription, loc utils.GeoLocation) {
+	sub.Nation = loc.Country
+	sub.Region = loc.Region
+	sub.City = loc.City
+	sub.ASN = loc.ASN
+	sub.ASOrg = loc.ASOrg
+	sub.TimeZone = loc.TimeZone
+}
+
+// backfillPageSize is how many subscriptions the backfill reads at a time
+const backfillPageSize = 500
+
+// startBackfill queues a lookup for every subscription that has an IP but no
+// nation. Returns false if a backfill is already running.
+func (e *geoEnricher) startBackfill() bool {
+	if !e.backfilling.CompareAndSwap(false, true) {
+		return false
+	}
+	go func() {
+		defer e.backfilling.Store(false)
+		n, err := e.backfill()
+		if err != nil {
+			log.Printf("[GeoIP] Backfill stopped after queueing %d subscriptions: %v", n, err)
+			return
+		}
+		log.Printf("[GeoIP] Backfill queued %d subscriptions without a location", n)
+	}()
+	return true
+}
+
+// backfill pages through all subscriptions and queues those missing a nation,
+// waiting for room in the queue rather than dropping them
+func (e *geoEnricher) backfill() (int, error) {
+	q := models.SubscriptionQuery{Sort: models.SortCreatedAt, Asc: true, Limit: backfillPageSize}
+	n := 0
+	for {
+		page, err := e.store.ListSubscriptions(q)
+		if err != nil {
+			return n, err
+		}
+		for _, sub := range page.Subscriptions {
+			if sub.Nation != "" {
+				continue
+			}
+			// Hashed IPs cannot be located; truncated ones still give the network's location
+			ip, ok := utils.ParseIP(sub.IP)
+			if !ok {
+				continue
+			}
+			select {
+			case <-e.stop:
+				return n, nil
+			case e.queue <- geoJob{endpoint: sub.Endpoint, ip: ip, storedIP: sub.IP}:
+				metrics.GeoIPQueueDepth.Set(float64(len(e.queue)))
+				n++
+			}
+		}
+		if page.NextCursor == "" {
+			return n, nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+// GeoIPBackfillHandler starts a location backfill of subscriptions without a
+// nation (POST /admin/geoip/backfill). The backfill runs in the background.
+func (h *Handler) GeoIPBackfillHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	if h.geo.geoip == nil {
+		writeJSONError(w, http.StatusConflict, "GeoIP lookups are disabled")
+		return
+	}
+	if !h.geo.startBackfill() {
+		writeJSONError(w, http.StatusConflict, "A backfill is already running")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "started"})
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	"webpush/config"
+	"webpush/database"
+	"webpush/models"
+	"webpush/utils"
+)
+
+// Handler serves the HTTP API and runs the background delivery and stats jobs.
+// Its dependencies are injected through New rather than read from package globals.
+type Handler struct {
+	store        database.Store
+	vapid        VAPIDKeys
+	clientIP     *utils.ClientIPResolver
+	anonymizer   *utils.IPAnonymizer
+	userAgents   *utils.UserAgentParser
+	onlineWindow time.Duration
+
+	latestMu sync.Mutex
+	latest   *models.Subscription
+
+	dispatcher *dispatcher
+	geo        *geoEnricher
+
+	readinessMu     sync.RWMutex
+	readinessChecks []readinessCheck
+
+	statsPrunerLastRun atomic.Int64
+
+	backupMu   sync.Mutex
+	backupDir  string
+	backupKeep int
+
+	adminToken string
+
+	idempotencyTTL time.Duration
+}
+
+// New returns a Handler backed by the given store that signs pushes with
+// vapid. geoip locates subscribing clients in the background and may be nil to
+// skip GeoIP lookups; clientIP determines their address and anonymizer the
+// form in which it is stored. userAgents detects their browser, OS and device.
+// limiter paces pushes per push service host.
+func New(store database.Store, vapid VAPIDKeys, geoip utils.GeoIPProvider, clientIP *utils.ClientIPResolver, anonymizer *utils.IPAnonymizer, userAgents *utils.UserAgentParser, limiter *utils.PushRateLimiter, cfg config.Config) *Handler {
+	return &Handler{
+		store:        store,
+		vapid:        vapid,
+		clientIP:     clientIP,
+		anonymizer:   anonymizer,
+		userAgents:   userAgents,
+		onlineWindow: cfg.OnlineWindow,
+		dispatcher:   newDispatcher(store, vapid, limiter, cfg.SendWorkers),
+		geo:          newGeoEnricher(store, geoip),
+		backupDir:    cfg.BackupDir,
+		backupKeep:   cfg.BackupKeep,
+		adminToken:   cfg.AdminToken,
+
+		idempotencyTTL: cfg.IdempotencyTTL,
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+	"webpush/models"
+)
+
+// readinessTimeout bounds how long a single readiness check may take
+const readinessTimeout = 2 * time.Second
+
+// readinessCheck is a named dependency probe run by /readyz
+type readinessCheck struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// RegisterReadinessCheck adds a check that must pass for the server to report ready
+func (h *Handler) RegisterReadinessCheck(name string, fn func(context.Context) error) {
+	h.readinessMu.Lock()
+	defer h.readinessMu.Unlock()
+	h.readinessChecks = append(h.readinessChecks, readinessCheck{name: name, fn: fn})
+}
+
+// HealthzHandler reports that the process is alive
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.HealthResponse{Status: "ok"})
+}
+
+// ReadyzHandler runs all readiness checks concurrently and reports per-check status and latency.
+// Responds 503 if any check fails.
+func (h *Handler) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	h.readinessMu.RLock()
+	checks := append([]readinessCheck(nil), h.readinessChecks...)
+	h.readinessMu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	results := make([]models.CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c readinessCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := c.fn(ctx)
+			results[i] = models.CheckResult{
+				Status:    "ok",
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				results[i].Status = "fail"
+				results[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	resp := models.HealthResponse{Status: "ok", Checks: make(map[string]models.CheckResult)}
+	for i, c := range checks {
+		resp.Checks[c.name] = results[i]
+		if results[i].Status != "ok" {
+			resp.Status = "fail"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
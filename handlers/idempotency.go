@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+	"webpush/models"
+)
+
+// IdempotencyKeyHeader names the request header that makes a send safe to retry
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	maxIdempotencyKeyLen = 255
+	maxIdempotentBody    = 1 << 20 // largest request body fingerprinted
+
+	// idempotencyAbandonAfter is how long a key stays in progress before a retry may
+	// take it over, for requests cut short by a crash or restart
+	idempotencyAbandonAfter = time.Hour
+)
+
+// Idempotent makes next replayable with an Idempotency-Key header. The first
+// request with a key runs next and its response is stored for idempotencyTTL;
+// retries with the same key and body get the stored response, or 202 while the
+// first request is still running. A key reused for a different request gets 409.
+// A 5xx response is not stored; the key is released so a retry runs next again.
+// Requests without the header run next as usual.
+func (h *Handler) Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || r.Method != http.MethodPost || h.idempotencyTTL <= 0 {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			writeJSONError(w, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now()
+		rec := models.IdempotencyRecord{Key: key, Fingerprint: requestFingerprint(r.URL.Path, body), CreatedAt: now}
+		existing, err := h.store.ClaimIdempotencyKey(rec, now.Add(-h.idempotencyTTL), now.Add(-idempotencyAbandonAfter))
+		if err != nil {
+			log.Printf("[Idempotency] Error claiming key: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to check the Idempotency-Key")
+			return
+		}
+		if existing != nil {
+			replayIdempotent(w, existing, rec.Fingerprint)
+			return
+		}
+
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rw, r)
+		if rw.status >= http.StatusInternalServerError {
+			// A server error may not have sent anything, so the key is freed for a retry
+			if err := h.store.ReleaseIdempotencyKey(key); err != nil {
+				log.Printf("[Idempotency] Error releasing key: %v", err)
+			}
+			return
+		}
+		if err := h.store.CompleteIdempotencyKey(key, rw.status, rw.Header().Get("Content-Type"), rw.body.Bytes()); err != nil {
+			log.Printf("[Idempotency] Error storing the response: %v", err)
+		}
+	}
+}
+
+// replayIdempotent answers a retry of the request that claimed rec
+func replayIdempotent(w http.ResponseWriter, rec *models.IdempotencyRecord, fingerprint string) {
+	switch {
+	case rec.Fingerprint != fingerprint:
+		writeJSONError(w, http.StatusConflict, "Idempotency-Key was already used for a different request")
+	case rec.StatusCode == 0:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     "in_progress",
+			"started_at": rec.CreatedAt.UTC(),
+		})
+	default:
+		if rec.ContentType != "" {
+			w.Header().Set("Content-Type", rec.ContentType)
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(rec.StatusCode)
+		w.Write(rec.Response)
+	}
+}
+
+// requestFingerprint identifies a request by its path and body
+func requestFingerprint(path string, body []byte) string {
+	sum := sha256.New()
+	sum.Write([]byte(path))
+	sum.Write([]byte{0})
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// StartIdempotencyPruner starts a background goroutine that deletes idempotency
+// keys older than the configured window
+func (h *Handler) StartIdempotencyPruner() {
+	if h.idempotencyTTL <= 0 {
+		return
+	}
+	go func() {
+		for {
+			n, err := h.store.PruneIdempotencyKeys(time.Now().Add(-h.idempotencyTTL))
+			if err != nil {
+				log.Printf("[Idempotency] Error pruning keys: %v", err)
+			} else if n > 0 {
+				log.Printf("[Idempotency] Deleted %d keys older than %s", n, h.idempotencyTTL)
+			}
+			time.Sleep(retentionInterval)
+		}
+	}()
+}
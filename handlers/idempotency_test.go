@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"webpush/database"
+	"webpush/models"
+)
+
+// countingHandler answers with status and counts how often it ran
+type countingHandler struct {
+	status int
+	calls  int
+}
+
+func (c *countingHandler) serve(w http.ResponseWriter, r *http.Request) {
+	c.calls++
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(c.status)
+	w.Write([]byte(`{"call":` + strconv.Itoa(c.calls) + `}`))
+}
+
+func newIdempotentHandler() *Handler {
+	return &Handler{store: database.NewMemoryStore(), idempotencyTTL: time.Hour}
+}
+
+func idempotentRequest(key, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/send-broadcast", strings.NewReader(body))
+	r.Header.Set(IdempotencyKeyHeader, key)
+	return r
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	h := newIdempotentHandler()
+	next := &countingHandler{status: http.StatusOK}
+	handler := h.Idempotent(next.serve)
+
+	first := httptest.NewRecorder()
+	handler(first, idempotentRequest("k1", `{"title":"hi"}`))
+	retry := httptest.NewRecorder()
+	handler(retry, idempotentRequest("k1", `{"title":"hi"}`))
+
+	if next.calls != 1 {
+		t.Errorf("next ran %d times, want 1", next.calls)
+	}
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() {
+		t.Errorf("retry = %d %q, want %d %q", retry.Code, retry.Body, first.Code, first.Body)
+	}
+	if got := retry.Header().Get("Idempotent-Replayed"); got != "true" {
+		t.Errorf("Idempotent-Replayed = %q, want true", got)
+	}
+	if got := retry.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+}
+
+func TestIdempotentFingerprintMismatch(t *testing.T) {
+	h := newIdempotentHandler()
+	next := &countingHandler{status: http.StatusOK}
+	handler := h.Idempotent(next.serve)
+
+	handler(httptest.NewRecorder(), idempotentRequest("k1", `{"title":"hi"}`))
+	w := httptest.NewRecorder()
+	handler(w, idempotentRequest("k1", `{"title":"bye"}`))
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if next.calls != 1 {
+		t.Errorf("next ran %d times, want 1", next.calls)
+	}
+}
+
+func TestIdempotentInProgress(t *testing.T) {
+	h := newIdempotentHandler()
+	body := `{"title":"hi"}`
+	rec := models.IdempotencyRecord{Key: "k1", Fingerprint: requestFingerprint("/send-broadcast", []byte(body)), CreatedAt: time.Now()}
+	if _, err := h.store.ClaimIdempotencyKey(rec, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("ClaimIdempotencyKey: %v", err)
+	}
+
+	next := &countingHandler{status: http.StatusOK}
+	w := httptest.NewRecorder()
+	h.Idempotent(next.serve)(w, idempotentRequest("k1", body))
+
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusAccepted)
+	}
+	if got := w.Header().Get("Retry-After"); got == "" {
+		t.Error("Retry-After not set")
+	}
+	if next.calls != 0 {
+		t.Errorf("next ran %d times, want 0", next.calls)
+	}
+}
+
+func TestIdempotentServerErrorReleasesKey(t *testing.T) {
+	h := newIdempotentHandler()
+	next := &countingHandler{status: http.StatusServiceUnavailable}
+	handler := h.Idempotent(next.serve)
+
+	handler(httptest.NewRecorder(), idempotentRequest("k1", `{"title":"hi"}`))
+	next.status = http.StatusOK
+	w := httptest.NewRecorder()
+	handler(w, idempotentRequest("k1", `{"title":"hi"}`))
+
+	if next.calls != 2 {
+		t.Errorf("next ran %d times, want 2", next.calls)
+	}
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after 5xx = %d replayed %q, want a fresh 200", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+
+	// The successful retry is what gets stored
+	handler(httptest.NewRecorder(), idempotentRequest("k1", `{"title":"hi"}`))
+	if next.calls != 2 {
+		t.Errorf("next ran %d times after success, want 2", next.calls)
+	}
+}
+
+func TestIdempotentClientErrorStored(t *testing.T) {
+	h := newIdempotentHandler()
+	next := &countingHandler{status: http.StatusBadRequest}
+	handler := h.Idempotent(next.serve)
+
+	handler(httptest.NewRecorder(), idempotentRequest("k1", `{}`))
+	w := httptest.NewRecorder()
+	handler(w, idempotentRequest("k1", `{}`))
+
+	if next.calls != 1 || w.Code != http.StatusBadRequest {
+		t.Errorf("retry after 4xx = %d with %d calls, want a replayed 400", w.Code, next.calls)
+	}
+}
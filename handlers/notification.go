@@ -1,250 +1,359 @@
-package handlers
-
-import (
-	"encoding/json"
-	"io"
-	"log"
-	"net/http"
-	"time"
-	"webpush/database"
-	"webpush/models"
-
-	webpush "github.com/SherClockHolmes/webpush-go"
-)
-
-// SendNotificationHandler handles API requests to send push notifications
-func SendNotificationHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req models.SendRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		log.Printf("Failed to decode request: %v\n", err)
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
-	}
-
-	log.Printf("[Push] Sending notification to endpoint: %s", req.Subscription.Endpoint)
-
-	// Create the push subscription
-	s := &webpush.Subscription{
-		Endpoint: req.Subscription.Endpoint,
-		Keys: webpush.Keys{
-			P256dh: req.Subscription.Keys.P256dh,
-			Auth:   req.Subscription.Keys.Auth,
-		},
-	}
-
-	// Create notification payload
-	payload := models.NotificationPayload{
-		Title:   req.Title,
-		Body:    req.Body,
-		Icon:    req.Icon,
-		Badge:   req.Badge,
-		Vibrate: []int{200, 100, 200},
-	}
-
-	payloadJSON, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Failed to marshal payload: %v\n", err)
-		http.Error(w, "Failed to marshal payload", http.StatusInternalServerError)
-		return
-	}
-
-	// Send the notification
-	resp, err := webpush.SendNotification(payloadJSON, s, &webpush.Options{
-		Subscriber:      "mailto:example@example.com",
-		VAPIDPublicKey:  VapidPublicKey,
-		VAPIDPrivateKey: VapidPrivateKey,
-		TTL:             30,
-	})
-
-	if err != nil {
-		log.Printf("[Push] Error sending notification: %v", err)
-		http.Error(w, "Failed to send notification: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	log.Printf("[Push] Notification response status: %d", resp.StatusCode)
-
-	if resp.StatusCode == 404 || resp.StatusCode == 410 {
-		log.Printf("[Push] Subscription is no longer valid (status %d). Removing from disk.", resp.StatusCode)
-		RemoveLatestSubscription()
-		LatestSubscription = nil
-		http.Error(w, "Subscription is no longer valid", http.StatusGone)
-		return
-	}
-
-	if resp.StatusCode >= 400 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		log.Printf("[Push] Error response body: %s", string(bodyBytes))
-		http.Error(w, "Failed to send notification: "+string(bodyBytes), resp.StatusCode)
-		return
-	}
-
-	log.Printf("[Push] Notification sent successfully")
-	database.IncrementPushCount(1)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "sent"})
-}
-
-// StartAutoSender starts a background goroutine that sends notifications periodically
-func StartAutoSender() {
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-
-			if LatestSubscription != nil {
-				log.Println("[AutoPush] Sending scheduled notification...")
-				s := &webpush.Subscription{
-					Endpoint: LatestSubscription.Endpoint,
-					Keys: webpush.Keys{
-						P256dh: LatestSubscription.Keys.P256dh,
-						Auth:   LatestSubscription.Keys.Auth,
-					},
-				}
-
-				payload := models.NotificationPayload{
-					Title:   "Scheduled Notification",
-					Body:    "This is an automatic notification from the backend.",
-					Icon:    "",
-					Badge:   "",
-					Vibrate: []int{200, 100, 200},
-				}
-
-				payloadJSON, _ := json.Marshal(payload)
-				resp, err := webpush.SendNotification(payloadJSON, s, &webpush.Options{
-					Subscriber:      "mailto:example@example.com",
-					VAPIDPublicKey:  VapidPublicKey,
-					VAPIDPrivateKey: VapidPrivateKey,
-					TTL:             30,
-				})
-
-				if err != nil {
-					log.Printf("[AutoPush] Error sending notification: %v\n", err)
-				} else {
-					log.Printf("[AutoPush] Notification response status: %d\n", resp.StatusCode)
-				}
-			}
-		}
-	}()
-}
-
-// SendBroadcastHandler sends a notification to all subscriptions
-func SendBroadcastHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req struct {
-		Title string `json:"title"`
-		Body  string `json:"body"`
-		Icon  string `json:"icon"`
-	}
-
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		log.Printf("Failed to decode broadcast request: %v\n", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
-		return
-	}
-
-	subs := LoadSubscriptions()
-	if len(subs) == 0 {
-		log.Println("[Broadcast] No subscriptions found.")
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"sent":   0,
-			"failed": 0,
-		})
-		return
-	}
-
-	payload := models.NotificationPayload{
-		Title:   req.Title,
-		Body:    req.Body,
-		Icon:    req.Icon,
-		Badge:   "",
-		Vibrate: []int{200, 100, 200},
-	}
-
-	payloadJSON, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("[Broadcast] Error marshaling payload: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to marshal payload"})
-		return
-	}
-
-	log.Printf("[Broadcast] Sending to %d subscriptions.", len(subs))
-	var validSubs []models.Subscription
-	sent := 0
-	failed := 0
-
-	for _, sub := range subs {
-		s := &webpush.Subscription{
-			Endpoint: sub.Endpoint,
-			Keys: webpush.Keys{
-				P256dh: sub.Keys.P256dh,
-				Auth:   sub.Keys.Auth,
-			},
-		}
-
-		resp, err := webpush.SendNotification(payloadJSON, s, &webpush.Options{
-			Subscriber:      "mailto:example@example.com",
-			VAPIDPublicKey:  VapidPublicKey,
-			VAPIDPrivateKey: VapidPrivateKey,
-			TTL:             30,
-		})
-
-		if err != nil {
-			log.Printf("[Broadcast] Error sending to %s: %v", sub.Endpoint, err)
-			failed++
-			continue
-		}
-
-		log.Printf("[Broadcast] Response status for %s: %d", sub.Endpoint, resp.StatusCode)
-
-		if resp.StatusCode == 404 || resp.StatusCode == 410 {
-			log.Printf("[Broadcast] Subscription %s is no longer valid (status %d). Removing.", sub.Endpoint, resp.StatusCode)
-			failed++
-			continue
-		}
-
-		if resp.StatusCode >= 400 {
-			bodyBytes, _ := io.ReadAll(resp.Body)
-			log.Printf("[Broadcast] Error response body for %s: %s", sub.Endpoint, string(bodyBytes))
-			failed++
-			continue
-		}
-
-		log.Printf("[Broadcast] Notification sent to: %s", sub.Endpoint)
-		validSubs = append(validSubs, sub)
-		sent++
-	}
-
-	database.IncrementPushCount(sent)
-	SaveSubscriptions(validSubs)
-
-	if len(validSubs) == 0 {
-		LatestSubscription = nil
-	} else {
-		LatestSubscription = &validSubs[len(validSubs)-1]
-	}
-
-	log.Printf("[Broadcast] Sent: %d, Failed: %d", sent, failed)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"sent":   sent,
-		"failed": failed,
-	})
-}
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+	"webpush/metrics"
+	"webpush/models"
+	"webpush/utils"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// SendNotificationHandler handles API requests to send push notifications
+func (h *Handler) SendNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.SendRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Printf("Failed to decode request: %v\n", err)
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := validateSendOptions(req.SendOptions); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("[Push] Sending notification to endpoint: %s", req.Subscription.Endpoint)
+
+	// Create notification payload
+	payload := models.NotificationPayload{
+		Title:   req.Title,
+		Body:    req.Body,
+		Icon:    req.Icon,
+		Badge:   req.Badge,
+		Vibrate: []int{200, 100, 200},
+	}
+
+	payloadJSON, truncated, tooLarge := fitPayload(payload, payloadLimit([]models.Subscription{req.Subscription}), req.Truncate)
+	if tooLarge != nil {
+		writePayloadTooLarge(w, tooLarge)
+		return
+	}
+	if truncated {
+		log.Printf("[Push] Body truncated to fit the push message size limit")
+	}
+
+	// Send the notification, retrying like queued deliveries when the push service throttles
+	res := h.dispatcher.deliver(&delivery{sub: req.Subscription, payload: payloadJSON, opts: req.SendOptions})
+
+	tally := h.newTally()
+	defer tally.flush()
+	sub := h.storedSubscription(req.Subscription)
+
+	if res.Err != nil {
+		log.Printf("[Push] Error sending notification: %v", res.Err)
+		tally.add(sub, models.PushFailed, 0)
+		http.Error(w, "Failed to send notification: "+res.Err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[Push] Notification response status: %d", res.StatusCode)
+
+	if res.StatusCode == 404 || res.StatusCode == 410 {
+		tally.add(sub, models.PushExpired, res.StatusCode)
+		log.Printf("[Push] Subscription is no longer valid (status %d). Removing.", res.StatusCode)
+		if err := h.store.RemoveSubscription(req.Subscription.Endpoint); err != nil {
+			log.Printf("[Push] Error removing subscription: %v", err)
+		} else {
+			metrics.SubscriptionsRemoved.WithLabelValues("expired").Inc()
+		}
+		if latest := h.latestSubscription(); latest != nil && latest.Endpoint == req.Subscription.Endpoint {
+			h.setLatestSubscription(nil)
+		}
+		http.Error(w, "Subscription is no longer valid", http.StatusGone)
+		return
+	}
+
+	if res.StatusCode >= 400 {
+		log.Printf("[Push] Error response body: %s", res.Body)
+		tally.add(sub, models.PushFailed, res.StatusCode)
+		http.Error(w, "Failed to send notification: "+res.Body, res.StatusCode)
+		return
+	}
+
+	log.Printf("[Push] Notification sent successfully")
+	tally.add(sub, models.PushSent, res.StatusCode)
+	h.store.IncrementPushCount(1)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "sent", "truncated": truncated})
+}
+
+// defaultTTL is how long push services keep a message for an offline client
+// when the request does not say, in seconds
+const defaultTTL = 30
+
+// validUrgencies are the Urgency header values defined by RFC 8030
+var validUrgencies = map[string]bool{
+	string(webpush.UrgencyVeryLow): true,
+	string(webpush.UrgencyLow):     true,
+	string(webpush.UrgencyNormal):  true,
+	string(webpush.UrgencyHigh):    true,
+}
+
+// validateSendOptions checks the TTL and urgency of a send or broadcast request
+func validateSendOptions(opts models.SendOptions) error {
+	if opts.TTL < 0 {
+		return errors.New("ttl must not be negative")
+	}
+	if opts.Urgency != "" && !validUrgencies[opts.Urgency] {
+		return errors.New("urgency must be very-low, low, normal or high")
+	}
+	return nil
+}
+
+// pushOptions returns the webpush options for sending to a push service with
+// vapid, applying its record size, TTL cap and Urgency support
+func pushOptions(service string, opts models.SendOptions, vapid VAPIDKeys, client *http.Client) *webpush.Options {
+	quirks := utils.QuirksOf(service)
+
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+	if quirks.MaxTTL > 0 && ttl > quirks.MaxTTL {
+		ttl = quirks.MaxTTL
+	}
+
+	var urgency webpush.Urgency
+	if quirks.Urgency {
+		urgency = webpush.Urgency(opts.Urgency)
+	}
+
+	return &webpush.Options{
+		Subscriber:      "mailto:example@example.com",
+		VAPIDPublicKey:  vapid.Public,
+		VAPIDPrivateKey: vapid.Private,
+		RecordSize:      quirks.MaxRecordSize,
+		TTL:             ttl,
+		Urgency:         urgency,
+		HTTPClient:      client,
+	}
+}
+
+// send delivers an encrypted payload to a subscription, paced by the rate limit
+// of its push service host and bounded by the dispatcher's send slots, and
+// records send metrics
+func (d *dispatcher) send(payload []byte, sub models.Subscription, opts models.SendOptions) (*http.Response, error) {
+	s := &webpush.Subscription{
+		Endpoint: sub.Endpoint,
+		Keys: webpush.Keys{
+			P256dh: sub.Keys.P256dh,
+			Auth:   sub.Keys.Auth,
+		},
+	}
+
+	service := sub.PushService
+	if service == "" {
+		service = utils.ClassifyPushService(sub.Endpoint)
+	}
+
+	pushService := utils.PushServiceHost(sub.Endpoint)
+	done := d.limiter.Acquire(pushService)
+
+	// Take a send slot only once the host's rate limit allows the request,
+	// so that waiting for one host does not hold up the others
+	d.slots <- struct{}{}
+	start := time.Now()
+	resp, err := webpush.SendNotification(payload, s, pushOptions(service, opts, d.vapid, d.limiter.Client()))
+	elapsed := time.Since(start)
+	<-d.slots
+
+	if err != nil {
+		done(0, "")
+	} else {
+		done(resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	switch {
+	case err != nil:
+		metrics.ObservePush(pushService, "failed", 0, elapsed)
+	case resp.StatusCode == 404 || resp.StatusCode == 410:
+		metrics.ObservePush(pushService, "expired", resp.StatusCode, elapsed)
+	case resp.StatusCode >= 400:
+		metrics.ObservePush(pushService, "failed", resp.StatusCode, elapsed)
+	default:
+		metrics.ObservePush(pushService, "sent", resp.StatusCode, elapsed)
+	}
+
+	return resp, err
+}
+
+// StartAutoSender starts a background goroutine that sends notifications periodically
+func (h *Handler) StartAutoSender() {
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			if latest := h.latestSubscription(); latest != nil {
+				log.Println("[AutoPush] Sending scheduled notification...")
+				payload := models.NotificationPayload{
+					Title:   "Scheduled Notification",
+					Body:    "This is an automatic notification from the backend.",
+					Icon:    "",
+					Badge:   "",
+					Vibrate: []int{200, 100, 200},
+				}
+
+				payloadJSON, _ := json.Marshal(payload)
+				res := h.dispatcher.deliver(&delivery{sub: *latest, payload: payloadJSON})
+
+				if res.Err != nil {
+					log.Printf("[AutoPush] Error sending notification: %v\n", res.Err)
+				} else {
+					log.Printf("[AutoPush] Notification response status: %d\n", res.StatusCode)
+				}
+			}
+		}
+	}()
+}
+
+// SendBroadcastHandler sends a notification to all subscriptions
+func (h *Handler) SendBroadcastHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Title    string `json:"title"`
+		Body     string `json:"body"`
+		Icon     string `json:"icon"`
+		Truncate bool   `json:"truncate"`
+		models.SendOptions
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Printf("Failed to decode broadcast request: %v\n", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+	if err := validateSendOptions(req.SendOptions); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	subs := h.LoadSubscriptions()
+	if len(subs) == 0 {
+		log.Println("[Broadcast] No subscriptions found.")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sent":   0,
+			"failed": 0,
+		})
+		return
+	}
+
+	payload := models.NotificationPayload{
+		Title:   req.Title,
+		Body:    req.Body,
+		Icon:    req.Icon,
+		Badge:   "",
+		Vibrate: []int{200, 100, 200},
+	}
+
+	payloadJSON, truncated, tooLarge := fitPayload(payload, payloadLimit(subs), req.Truncate)
+	if tooLarge != nil {
+		writePayloadTooLarge(w, tooLarge)
+		return
+	}
+	if truncated {
+		log.Printf("[Broadcast] Body truncated to fit the push message size limit")
+	}
+
+	log.Printf("[Broadcast] Sending to %d subscriptions.", len(subs))
+	var validSubs []models.Subscription
+	sent := 0
+	failed := 0
+	pending := 0
+	tally := h.newTally()
+	defer tally.flush()
+
+	deliveries := make([]*delivery, len(subs))
+	for i, sub := range subs {
+		deliveries[i] = &delivery{sub: sub, payload: payloadJSON, opts: req.SendOptions}
+	}
+
+	for i, res := range h.dispatcher.dispatch(deliveries) {
+		sub := subs[i]
+
+		if res.Deferred {
+			// Not sent before shutdown; it will be resumed on next start
+			validSubs = append(validSubs, sub)
+			pending++
+			continue
+		}
+
+		if res.Err != nil {
+			log.Printf("[Broadcast] Error sending to %s: %v", sub.Endpoint, res.Err)
+			tally.add(sub, models.PushFailed, 0)
+			failed++
+			continue
+		}
+
+		log.Printf("[Broadcast] Response status for %s: %d", sub.Endpoint, res.StatusCode)
+
+		if res.StatusCode == 404 || res.StatusCode == 410 {
+			log.Printf("[Broadcast] Subscription %s is no longer valid (status %d). Removing.", sub.Endpoint, res.StatusCode)
+			tally.add(sub, models.PushExpired, res.StatusCode)
+			if err := h.store.RemoveSubscription(sub.Endpoint); err != nil {
+				log.Printf("[Broadcast] Error removing %s: %v", sub.Endpoint, err)
+			} else {
+				metrics.SubscriptionsRemoved.WithLabelValues("expired").Inc()
+			}
+			failed++
+			continue
+		}
+
+		if res.StatusCode >= 400 {
+			log.Printf("[Broadcast] Error response body for %s: %s", sub.Endpoint, res.Body)
+			tally.add(sub, models.PushFailed, res.StatusCode)
+			failed++
+			continue
+		}
+
+		log.Printf("[Broadcast] Notification sent to: %s", sub.Endpoint)
+		tally.add(sub, models.PushSent, res.StatusCode)
+		validSubs = append(validSubs, sub)
+		sent++
+	}
+
+	h.store.IncrementPushCount(sent)
+
+	if len(validSubs) == 0 {
+		h.setLatestSubscription(nil)
+	} else {
+		h.setLatestSubscription(&validSubs[len(validSubs)-1])
+	}
+
+	log.Printf("[Broadcast] Sent: %d, Failed: %d, Pending: %d", sent, failed, pending)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sent":      sent,
+		"failed":    failed,
+		"pending":   pending,
+		"truncated": truncated,
+	})
+}
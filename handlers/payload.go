@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+	"webpush/models"
+	"webpush/utils"
+)
+
+// payloadTooLarge describes a notification that does not fit in a push message
+type payloadTooLarge struct {
+	Error  string         `json:"error"`
+	Size   int            `json:"size"`   // bytes of the JSON payload
+	Limit  int            `json:"limit"`  // largest payload all targeted push services accept
+	Fields map[string]int `json:"fields"` // bytes of each text field
+}
+
+// payloadLimit returns the largest payload that the push services of all subs accept
+func payloadLimit(subs []models.Subscription) int {
+	limit := 0
+	for _, sub := range subs {
+		service := sub.PushService
+		if service == "" {
+			service = utils.ClassifyPushService(sub.Endpoint)
+		}
+		if n := utils.MaxPayloadSize(utils.QuirksOf(service).MaxRecordSize); limit == 0 || n < limit {
+			limit = n
+		}
+	}
+	return limit
+}
+
+// fitPayload marshals p and checks it against limit. With truncate, a body that
+// is too long is shortened at a word boundary to the longest text that fits;
+// truncated reports whether that happened. tooLarge is set when p does not fit.
+func fitPayload(p models.NotificationPayload, limit int, truncate bool) (data []byte, truncated bool, tooLarge *payloadTooLarge) {
+	data, _ = json.Marshal(p)
+	if len(data) <= limit {
+		return data, false, nil
+	}
+
+	if truncate {
+		// JSON escaping makes the bytes per rune vary, so search for the longest body that fits
+		body := p.Body
+		var best []byte
+		lo, hi := 0, utf8.RuneCountInString(body)-1
+		for lo <= hi {
+			mid := (lo + hi) / 2
+			p.Body = utils.TruncateText(body, mid)
+			if d, _ := json.Marshal(p); len(d) <= limit {
+				best, lo = d, mid+1
+			} else {
+				hi = mid - 1
+			}
+		}
+		if best != nil {
+			return best, true, nil
+		}
+		p.Body = body
+	}
+
+	return nil, false, describeTooLarge(p, len(data), limit, truncate)
+}
+
+// describeTooLarge explains which fields of an oversized payload take the space
+func describeTooLarge(p models.NotificationPayload, size, limit int, truncated bool) *payloadTooLarge {
+	fields := map[string]int{
+		"title": len(p.Title),
+		"body":  len(p.Body),
+		"icon":  len(p.Icon),
+		"badge": len(p.Badge),
+		"tag":   len(p.Tag),
+	}
+	names := make([]string, 0, len(fields))
+	for name, n := range fields {
+		if n > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return fields[names[i]] > fields[names[j]] })
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s %d", name, fields[name])
+	}
+
+	msg := fmt.Sprintf("Notification payload is %d bytes, push services accept at most %d (%s bytes)", size, limit, strings.Join(parts, ", "))
+	if truncated {
+		msg += "; it does not fit even with the body shortened"
+	} else {
+		msg += "; shorten it or set truncate to shorten the body"
+	}
+	return &payloadTooLarge{Error: msg, Size: size, Limit: limit, Fields: fields}
+}
+
+// writePayloadTooLarge writes a 413 response describing an oversized payload
+func writePayloadTooLarge(w http.ResponseWriter, e *payloadTooLarge) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(e)
+}
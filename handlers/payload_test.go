@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+	"webpush/models"
+	"webpush/utils"
+)
+
+// payloadSize returns the marshalled size of p
+func payloadSize(p models.NotificationPayload) int {
+	data, _ := json.Marshal(p)
+	return len(data)
+}
+
+func TestFitPayload(t *testing.T) {
+	ascii := models.NotificationPayload{Title: "Sale", Body: strings.Repeat("lots of words ", 300)}
+	multibyte := models.NotificationPayload{Title: "セール", Body: strings.Repeat("こんにちは世界、お元気ですか ", 200)}
+	escaped := models.NotificationPayload{Title: "Quotes", Body: strings.Repeat(`"<&>" `, 800)}
+
+	tests := []struct {
+		name          string
+		p             models.NotificationPayload
+		limit         int
+		truncate      bool
+		wantTruncated bool
+		wantTooLarge  bool
+	}{
+		{"exactly at the limit", ascii, payloadSize(ascii), false, false, false},
+		{"exactly at the limit with truncate", ascii, payloadSize(ascii), true, false, false},
+		{"one byte over", ascii, payloadSize(ascii) - 1, false, false, true},
+		{"one byte over with truncate", ascii, payloadSize(ascii) - 1, true, true, false},
+		{"multibyte text truncated", multibyte, utils.MaxPayloadSize(4096), true, true, false},
+		{"multibyte text too large", multibyte, utils.MaxPayloadSize(4096), false, false, true},
+		{"escaped text truncated", escaped, utils.MaxPayloadSize(4096), true, true, false},
+		{"does not fit with an empty body", models.NotificationPayload{Title: strings.Repeat("t", 200), Body: "body"}, 100, true, false, true},
+	}
+	for _, tt := range tests {
+		data, truncated, tooLarge := fitPayload(tt.p, tt.limit, tt.truncate)
+		if truncated != tt.wantTruncated || (tooLarge != nil) != tt.wantTooLarge {
+			t.Errorf("%s: truncated %v, too large %v, want %v, %v", tt.name, truncated, tooLarge != nil, tt.wantTruncated, tt.wantTooLarge)
+			continue
+		}
+		if tooLarge != nil {
+			if data != nil || tooLarge.Size != payloadSize(tt.p) || tooLarge.Limit != tt.limit {
+				t.Errorf("%s: data %d bytes, size %d, limit %d, want no data, size %d, limit %d", tt.name, len(data), tooLarge.Size, tooLarge.Limit, payloadSize(tt.p), tt.limit)
+			}
+			continue
+		}
+		if len(data) > tt.limit {
+			t.Errorf("%s: payload is %d bytes, over the limit of %d", tt.name, len(data), tt.limit)
+		}
+
+		var got models.NotificationPayload
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: payload is not JSON: %v", tt.name, err)
+		}
+		if got.Title != tt.p.Title {
+			t.Errorf("%s: title = %q, want it unchanged", tt.name, got.Title)
+		}
+		if !truncated {
+			if got.Body != tt.p.Body {
+				t.Errorf("%s: body changed without truncation", tt.name)
+			}
+			continue
+		}
+		if !utf8.ValidString(got.Body) || !strings.HasSuffix(got.Body, utils.Ellipsis) {
+			t.Errorf("%s: truncated body %q is not valid text ending in %q", tt.name, got.Body, utils.Ellipsis)
+		}
+		if !strings.HasPrefix(tt.p.Body, strings.TrimSuffix(got.Body, utils.Ellipsis)) {
+			t.Errorf("%s: truncated body is not a prefix of the original", tt.name)
+		}
+	}
+}
+
+func TestDescribeTooLarge(t *testing.T) {
+	p := models.NotificationPayload{Title: "Hello", Body: strings.Repeat("b", 5000), Icon: "/icon.png"}
+
+	e := describeTooLarge(p, 5077, 3993, false)
+	want := "Notification payload is 5077 bytes, push services accept at most 3993 (body 5000, icon 9, title 5 bytes); shorten it or set truncate to shorten the body"
+	if e.Error != want {
+		t.Errorf("Error = %q, want %q", e.Error, want)
+	}
+	if e.Size != 5077 || e.Limit != 3993 {
+		t.Errorf("size %d, limit %d, want 5077, 3993", e.Size, e.Limit)
+	}
+	wantFields := map[string]int{"title": 5, "body": 5000, "icon": 9, "badge": 0, "tag": 0}
+	for name, n := range wantFields {
+		if e.Fields[name] != n {
+			t.Errorf("Fields[%s] = %d, want %d", name, e.Fields[name], n)
+		}
+	}
+
+	if e := describeTooLarge(p, 5077, 3993, true); !strings.HasSuffix(e.Error, "; it does not fit even with the body shortened") {
+		t.Errorf("Error with truncate = %q, want it to say the body was shortened", e.Error)
+	}
+}
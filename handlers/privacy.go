@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"webpush/metrics"
+	"webpush/models"
+)
+
+// maxPrivacyRequestSize bounds the body of an access or erasure request
+const maxPrivacyRequestSize = 64 << 10
+
+// PrivacyAccessHandler returns everything stored about a data subject: its
+// subscriptions with their metadata and tags, and their delivery and click
+// history (POST /privacy/access)
+func (h *Handler) PrivacyAccessHandler(w http.ResponseWriter, r *http.Request) {
+	subs, ok := h.dataSubject(w, r)
+	if !ok {
+		return
+	}
+
+	data := models.SubjectData{
+		Subscriptions: make([]models.SubscriptionData, 0, len(subs)),
+		ExportedAt:    time.Now().UTC(),
+	}
+	for _, sub := range subs {
+		deliveries, err := h.store.GetDeliveries(sub.Endpoint)
+		if err != nil {
+			log.Printf("[Privacy] Error loading delivery log: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load stored data")
+			return
+		}
+		if deliveries == nil {
+			deliveries = []models.Delivery{}
+		}
+		data.Subscriptions = append(data.Subscriptions, models.SubscriptionData{Subscription: sub, Deliveries: deliveries})
+	}
+	log.Printf("[Privacy] Access request answered with %d subscriptions", len(subs))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(data)
+}
+
+// PrivacyEraseHandler deletes a data subject's subscriptions together with
+// their delivery logs and pending deliveries (POST /privacy/erase)
+func (h *Handler) PrivacyEraseHandler(w http.ResponseWriter, r *http.Request) {
+	subs, ok := h.dataSubject(w, r)
+	if !ok {
+		return
+	}
+
+	erased := 0
+	for _, sub := range subs {
+		found, err := h.store.EraseSubscription(sub.Endpoint)
+		if err != nil {
+			log.Printf("[Privacy] Error erasing subscription: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to erase stored data")
+			return
+		}
+		if found {
+			erased++
+			metrics.SubscriptionsRemoved.WithLabelValues("erased").Inc()
+		}
+		if latest := h.latestSubscription(); latest != nil && latest.Endpoint == sub.Endpoint {
+			h.setLatestSubscription(nil)
+		}
+	}
+	log.Printf("[Privacy] Erased %d subscriptions", erased)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"erased": erased})
+}
+
+// dataSubject reads a privacy request and returns the subscriptions it
+// identifies, writing an error response if it cannot. An endpoint must come
+// with its auth secret, which only the subscribed browser knows; user IDs are
+// not secret, so looking them up requires the admin token.
+func (h *Handler) dataSubject(w http.ResponseWriter, r *http.Request) ([]models.Subscription, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	var req models.PrivacyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPrivacyRequestSize)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return nil, false
+	}
+
+	switch {
+	case req.UserID != "" && req.Endpoint == "":
+		if !h.authorizeAdmin(w, r) {
+			return nil, false
+		}
+		subs, err := h.subscriptionsOfUser(req.UserID)
+		if err != nil {
+			log.Printf("[Privacy] Error loading subscriptions by user ID: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load stored data")
+			return nil, false
+		}
+		return subs, true
+
+	case req.Endpoint != "" && req.Auth != "" && req.UserID == "":
+		sub, err := h.store.GetSubscription(req.Endpoint)
+		if err != nil {
+			log.Printf("[Privacy] Error loading subscription: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load stored data")
+			return nil, false
+		}
+		// An unknown endpoint and a wrong secret get the same answer
+		if sub == nil || !sameKey(sub.Keys.Auth, req.Auth) {
+			writeJSONError(w, http.StatusNotFound, "No subscription with this endpoint and auth secret")
+			return nil, false
+		}
+		return []models.Subscription{*sub}, true
+
+	default:
+		writeJSONError(w, http.StatusBadRequest, "Send endpoint and auth, or user_id")
+		return nil, false
+	}
+}
+
+// subscriptionsOfUser returns all subscriptions carrying the external user ID
+func (h *Handler) subscriptionsOfUser(userID string) ([]models.Subscription, error) {
+	q := models.SubscriptionQuery{
+		Sort:               models.SortCreatedAt,
+		Asc:                true,
+		Limit:              maxPageSize,
+		SubscriptionFilter: models.SubscriptionFilter{UserID: userID},
+	}
+	var subs []models.Subscription
+	for {
+		page, err := h.store.ListSubscriptions(q)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, page.Subscriptions...)
+		if page.NextCursor == "" {
+			return subs, nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+// sameKey compares two base64url subscription keys in constant time, ignoring padding
+func sameKey(stored, given string) bool {
+	stored, given = strings.TrimRight(stored, "="), strings.TrimRight(given, "=")
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(given)) == 1
+}
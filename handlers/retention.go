@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"log"
+	"time"
+)
+
+// retentionInterval is how often expired IPs and delivery log entries are removed
+const retentionInterval = time.Hour
+
+// StartRetentionPruner starts a background goroutine that blanks subscription
+// IPs older than ipRetention and deletes delivery log entries older than
+// deliveryRetention. A zero retention keeps that data forever.
+func (h *Handler) StartRetentionPruner(ipRetention, deliveryRetention time.Duration) {
+	if ipRetention <= 0 && deliveryRetention <= 0 {
+		return
+	}
+	go func() {
+		for {
+			h.pruneRetained(ipRetention, deliveryRetention)
+			time.Sleep(retentionInterval)
+		}
+	}()
+}
+
+// pruneRetained runs one retention pass
+func (h *Handler) pruneRetained(ipRetention, deliveryRetention time.Duration) {
+	now := time.Now()
+	if ipRetention > 0 {
+		n, err := h.store.ClearSubscriptionIPs(now.Add(-ipRetention))
+		if err != nil {
+			log.Printf("[Retention] Error clearing subscription IPs: %v", err)
+		} else if n > 0 {
+			log.Printf("[Retention] Cleared %d subscription IPs recorded more than %s ago", n, ipRetention)
+		}
+	}
+	if deliveryRetention > 0 {
+		n, err := h.store.PruneDeliveries(now.Add(-deliveryRetention))
+		if err != nil {
+			log.Printf("[Retention] Error pruning the delivery log: %v", err)
+		} else if n > 0 {
+			log.Printf("[Retention] Deleted %d delivery log entries older than %s", n, deliveryRetention)
+		}
+	}
+}
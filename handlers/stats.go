@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+	"webpush/database"
+	"webpush/models"
+	"webpush/utils"
+)
+
+// Retention of time series buckets per resolution
+var timeSeriesRetention = map[string]time.Duration{
+	models.ResolutionMinute: 48 * time.Hour,
+	models.ResolutionHour:   90 * 24 * time.Hour,
+}
+
+// Default window returned when the request has no from parameter
+var timeSeriesDefaultWindow = map[string]time.Duration{
+	models.ResolutionMinute: time.Hour,
+	models.ResolutionHour:   24 * time.Hour,
+	models.ResolutionDay:    30 * 24 * time.Hour,
+}
+
+// pushTally accumulates push outcomes in memory so a broadcast is written in one transaction
+type pushTally struct {
+	store      database.Store
+	counts     map[models.PushStatKey]models.PushCounts
+	deliveries []models.Delivery
+}
+
+// newTally returns an empty tally that flushes to the handler's store
+func (h *Handler) newTally() *pushTally {
+	return &pushTally{
+		store:  h.store,
+		counts: make(map[models.PushStatKey]models.PushCounts),
+	}
+}
+
+// add counts one event for the subscription's push service and browser and
+// logs it as a delivery. statusCode is 0 for clicks and transport errors.
+func (t *pushTally) add(sub models.Subscription, event models.PushEvent, statusCode int) {
+	key := models.PushStatKey{
+		PushService: utils.PushServiceHost(sub.Endpoint),
+		Browser:     sub.Browser,
+	}
+	c := t.counts[key]
+	switch event {
+	case models.PushSent:
+		c.Sent++
+	case models.PushFailed:
+		c.Failed++
+	case models.PushExpired:
+		c.Expired++
+	case models.PushClicked:
+		c.Clicked++
+	}
+	t.counts[key] = c
+
+	t.deliveries = append(t.deliveries, models.Delivery{
+		Endpoint:   sub.Endpoint,
+		Event:      event,
+		StatusCode: statusCode,
+		CreatedAt:  time.Now(),
+	})
+}
+
+// flush writes the accumulated counts to the time series and the delivery log
+func (t *pushTally) flush() {
+	if err := t.store.RecordPushCounts(time.Now(), t.counts); err != nil {
+		log.Printf("[Stats] Error recording push counts: %v", err)
+	}
+	if err := t.store.RecordDeliveries(t.deliveries); err != nil {
+		log.Printf("[Stats] Error recording deliveries: %v", err)
+	}
+}
+
+// HandleClick records that a notification was clicked, reported by the service worker.
+// Clicks for unknown endpoints are rejected with 404, so they cannot inflate the statistics.
+func (h *Handler) HandleClick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.EndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Endpoint == "" {
+		http.Error(w, "Invalid click", http.StatusBadRequest)
+		return
+	}
+
+	sub, err := h.store.GetSubscription(req.Endpoint)
+	if err != nil {
+		log.Printf("Error loading subscription: %v", err)
+		http.Error(w, "Failed to record click", http.StatusInternalServerError)
+		return
+	}
+	if sub == nil {
+		http.Error(w, "Unknown subscription", http.StatusNotFound)
+		return
+	}
+
+	tally := h.newTally()
+	tally.add(*sub, models.PushClicked, 0)
+	tally.flush()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetTimeSeriesHandler returns bucketed push statistics.
+// Query parameters: resolution (minute, hour, day), from and to (RFC 3339),
+// group_by (push_service or browser).
+func (h *Handler) GetTimeSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	resolution := q.Get("resolution")
+	if resolution == "" {
+		resolution = models.ResolutionHour
+	}
+	window, ok := timeSeriesDefaultWindow[resolution]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "resolution must be minute, hour or day")
+		return
+	}
+
+	from, to, err := timeRange(q, window)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	groupBy := q.Get("group_by")
+	if groupBy != "" && groupBy != "push_service" && groupBy != "browser" {
+		writeJSONError(w, http.StatusBadRequest, "group_by must be push_service or browser")
+		return
+	}
+
+	series, err := h.store.GetPushTimeSeries(resolution, database.BucketStart(from, resolution), to, groupBy)
+	if err != nil {
+		log.Printf("[Stats] Error loading time series: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load statistics")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.TimeSeriesResponse{
+		Resolution: resolution,
+		GroupBy:    groupBy,
+		From:       from,
+		To:         to,
+		Series:     series,
+	})
+}
+
+// timeRange reads the from and to query parameters (RFC 3339). to defaults to
+// now and from to window before to.
+func timeRange(q url.Values, window time.Duration) (from, to time.Time, err error) {
+	to = time.Now()
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, errors.New("to must be an RFC 3339 timestamp")
+		}
+	}
+	from = to.Add(-window)
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, errors.New("from must be an RFC 3339 timestamp")
+		}
+	}
+	return from, to, nil
+}
+
+// pushServiceStatsWindow is the period reported when the request has no from parameter
+const pushServiceStatsWindow = 7 * 24 * time.Hour
+
+// GetPushServiceStatsHandler returns delivery outcomes and subscriber counts per
+// push service (fcm, mozilla, apple, wns, other). Query parameters: from and to (RFC 3339).
+func (h *Handler) GetPushServiceStatsHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, err := timeRange(r.URL.Query(), pushServiceStatsWindow)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Hourly buckets are exact but only kept for a while; older periods are read by day
+	resolution := models.ResolutionHour
+	if time.Since(from) > timeSeriesRetention[models.ResolutionHour] {
+		resolution = models.ResolutionDay
+	}
+	series, err := h.store.GetPushTimeSeries(resolution, database.BucketStart(from, resolution), to, "push_service")
+	if err != nil {
+		log.Printf("[Stats] Error loading time series: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load statistics")
+		return
+	}
+
+	// The time series is kept per endpoint host; hosts are folded into their service
+	byService := make(map[string]*models.PushServiceStats)
+	service := func(name string) *models.PushServiceStats {
+		s, ok := byService[name]
+		if !ok {
+			s = &models.PushServiceStats{Service: name, Hosts: []string{}}
+			byService[name] = s
+		}
+		return s
+	}
+	for _, ts := range series {
+		s := service(utils.ClassifyPushServiceHost(ts.Key))
+		s.Hosts = append(s.Hosts, ts.Key)
+		for _, p := range ts.Points {
+			s.Sent += p.Sent
+			s.Failed += p.Failed
+			s.Expired += p.Expired
+			s.Clicked += p.Clicked
+		}
+	}
+	for name, count := range h.countSubscriptionsBy(models.BreakdownService, models.SubscriptionFilter{}) {
+		service(name).Subscriptions = count
+	}
+
+	resp := models.PushServiceStatsResponse{From: from, To: to, Services: []models.PushServiceStats{}}
+	for _, s := range byService {
+		if attempts := s.Sent + s.Failed + s.Expired; attempts > 0 {
+			s.SuccessRate = float64(s.Sent) / float64(attempts)
+		}
+		sort.Strings(s.Hosts)
+		resp.Services = append(resp.Services, *s)
+	}
+	sort.Slice(resp.Services, func(i, j int) bool { return resp.Services[i].Service < resp.Services[j].Service })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// statsPrunerInterval is how often expired time series buckets are dropped
+const statsPrunerInterval = time.Hour
+
+// StartStatsPruner starts a background goroutine that drops expired time series buckets
+func (h *Handler) StartStatsPruner() {
+	go func() {
+		for {
+			for resolution, retention := range timeSeriesRetention {
+				if err := h.store.PruneTimeSeries(resolution, time.Now().Add(-retention)); err != nil {
+					log.Printf("[Stats] Error pruning %s buckets: %v", resolution, err)
+				}
+			}
+			h.statsPrunerLastRun.Store(time.Now().Unix())
+			time.Sleep(statsPrunerInterval)
+		}
+	}()
+}
+
+// CheckStatsPruner reports an error if the pruner has not run within two intervals
+func (h *Handler) CheckStatsPruner(ctx context.Context) error {
+	last := h.statsPrunerLastRun.Load()
+	if last == 0 {
+		return errors.New("stats pruner not started")
+	}
+	if since := time.Since(time.Unix(last, 0)); since > 2*statsPrunerInterval {
+		return fmt.Errorf("stats pruner last ran %s ago", since.Round(time.Second))
+	}
+	return nil
+}
+
+// storedSubscription returns the stored copy of sub, which carries the parsed
+// browser and other metadata, falling back to sub itself if it is not stored
+func (h *Handler) storedSubscription(sub models.Subscription) models.Subscription {
+	stored, err := h.store.GetSubscription(sub.Endpoint)
+	if err != nil {
+		log.Printf("Error loading subscription: %v", err)
+	}
+	if stored == nil {
+		return sub
+	}
+	return *stored
+}
+
+// writeJSONError writes an error response in the {"error": "..."} format used by the API
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -1,112 +1,155 @@
-package handlers
-
-import (
-	"encoding/json"
-	"log"
-	"net/http"
-	"strings"
-	"webpush/database"
-	"webpush/models"
-	"webpush/utils"
-)
-
-var (
-	LatestSubscription *models.Subscription
-)
-
-// HandleSubscribe processes new push subscription requests
-func HandleSubscribe(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var sub models.Subscription
-	err := json.NewDecoder(r.Body).Decode(&sub)
-	if err != nil {
-		http.Error(w, "Invalid subscription", http.StatusBadRequest)
-		return
-	}
-
-	// Collect IP address
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		ip = r.RemoteAddr
-	} else {
-		// X-Forwarded-For may contain multiple IPs
-		ip = strings.Split(ip, ",")[0]
-	}
-	sub.IP = ip
-
-	// Collect User-Agent
-	ua := r.Header.Get("User-Agent")
-	sub.OS, sub.OSVersion, sub.Browser, sub.BrowserVersion = utils.ParseUserAgent(ua)
-
-	// Use platformVersion from userAgentData if available (more accurate for Windows)
-	if sub.Platform != "" && sub.PlatformVersion != "" {
-		sub.OS = sub.Platform
-		sub.OSVersion = utils.ParsePlatformVersion(sub.Platform, sub.PlatformVersion)
-	}
-
-	// Collect nation (GeoIP lookup)
-	nation := utils.LookupNation(ip)
-	sub.Nation = nation
-
-	LatestSubscription = &sub
-
-	// Save subscription to database
-	err = database.SaveSubscription(&sub)
-	if err != nil {
-		log.Printf("Error saving subscription: %v", err)
-		http.Error(w, "Failed to save subscription", http.StatusInternalServerError)
-		return
-	}
-
-	log.Printf("Subscription received: %s | IP: %s | Nation: %s | OS: %s %s | Browser: %s %s\n",
-		sub.Endpoint, sub.IP, sub.Nation, sub.OS, sub.OSVersion, sub.Browser, sub.BrowserVersion)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-}
-
-// LoadSubscriptions reads all subscriptions from database
-func LoadSubscriptions() []models.Subscription {
-	subs, err := database.GetAllSubscriptions()
-	if err != nil {
-		log.Printf("Error loading subscriptions: %v", err)
-		return []models.Subscription{}
-	}
-	return subs
-}
-
-// SaveSubscriptions saves valid subscriptions to database
-func SaveSubscriptions(subs []models.Subscription) error {
-	// First, get all current subscriptions
-	currentSubs, err := database.GetAllSubscriptions()
-	if err != nil {
-		log.Printf("Error getting current subscriptions: %v", err)
-		return err
-	}
-
-	// Create a map of valid endpoints
-	validEndpoints := make(map[string]bool)
-	for _, sub := range subs {
-		validEndpoints[sub.Endpoint] = true
-	}
-
-	// Remove subscriptions that are no longer valid
-	for _, currentSub := range currentSubs {
-		if !validEndpoints[currentSub.Endpoint] {
-			database.RemoveSubscription(currentSub.Endpoint)
-		}
-	}
-
-	return nil
-}
-
-// RemoveLatestSubscription removes the latest subscription
-func RemoveLatestSubscription() {
-	if LatestSubscription != nil {
-		database.RemoveSubscription(LatestSubscription.Endpoint)
-	}
-}
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"webpush/metrics"
+	"webpush/models"
+	"webpush/utils"
+)
+
+// subscribeRequest is a PushSubscription as sent by the page, with the
+// navigator.userAgentData hints used for detection. It holds only what a
+// client may set; user IDs, tags, location and the like are never taken from it.
+type subscribeRequest struct {
+	Endpoint       string `json:"endpoint"`
+	ExpirationTime *int64 `json:"expirationTime,omitempty"`
+	Keys           struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+
+	Platform        string        `json:"platform,omitempty"`
+	PlatformVersion string        `json:"platform_version,omitempty"`
+	Brands          []utils.Brand `json:"brands,omitempty"`
+	Mobile          *bool         `json:"mobile,omitempty"`
+}
+
+// HandleSubscribe processes new push subscription requests
+func (h *Handler) HandleSubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req subscribeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Endpoint == "" || req.Keys.P256dh == "" || req.Keys.Auth == "" {
+		http.Error(w, "Invalid subscription", http.StatusBadRequest)
+		return
+	}
+	sub := models.Subscription{Endpoint: req.Endpoint, ExpirationTime: req.ExpirationTime}
+	sub.Keys.P256dh, sub.Keys.Auth = req.Keys.P256dh, req.Keys.Auth
+
+	// Collect IP address, from forwarding headers only when set by a trusted proxy,
+	// and keep only as much of it as the IP mode allows
+	ip := h.clientIP.ClientIP(r)
+	sub.IP = h.anonymizer.Anonymize(ip)
+
+	// Detect browser, OS and device from Client Hints, preferring the page's
+	// userAgentData over the Sec-CH-UA headers, and from the User-Agent otherwise
+	hints := utils.ParseClientHints(r.Header).Override(utils.ClientHints{
+		Brands:          req.Brands,
+		Platform:        req.Platform,
+		PlatformVersion: req.PlatformVersion,
+		Mobile:          req.Mobile,
+	})
+	client := h.userAgents.DetectClient(r.Header.Get("User-Agent"), hints)
+	sub.OS, sub.OSVersion = client.OS, client.OSVersion
+	sub.Browser, sub.BrowserVersion = client.Browser, client.BrowserVersion
+	sub.Engine = client.Engine
+	sub.DeviceType, sub.DeviceVendor = client.DeviceType, client.DeviceVendor
+	sub.Platform, sub.PlatformVersion = hints.Platform, hints.PlatformVersion
+	sub.PushService = utils.ClassifyPushService(sub.Endpoint)
+
+	h.setLatestSubscription(&sub)
+
+	existing, err := h.store.GetSubscription(sub.Endpoint)
+	if err != nil {
+		log.Printf("Error checking subscription: %v", err)
+	}
+
+	// The location is looked up in the background once the subscription is saved,
+	// unless it is a resubscription from the same address
+	locate := true
+	if existing != nil && sub.IP != "" && existing.IP == sub.IP {
+		sub.Nation, sub.Region, sub.City = existing.Nation, existing.Region, existing.City
+		sub.ASN, sub.ASOrg, sub.TimeZone = existing.ASN, existing.ASOrg, existing.TimeZone
+		locate = sub.Nation == ""
+	}
+
+	// Save subscription to database
+	err = h.store.SaveSubscription(&sub)
+	if err != nil {
+		log.Printf("Error saving subscription: %v", err)
+		http.Error(w, "Failed to save subscription", http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		metrics.SubscriptionsCreated.Inc()
+	}
+	if locate {
+		h.geo.enqueue(geoJob{endpoint: sub.Endpoint, ip: ip, storedIP: sub.IP})
+	}
+
+	// The browser is logged as a product token, e.g. Chrome/120.0.0.0, which the
+	// log redaction does not mistake for an IP address
+	log.Printf("Subscription received: %s | IP: %s | OS: %s %s | Browser: %s/%s\n",
+		sub.Endpoint, sub.IP, sub.OS, sub.OSVersion, sub.Browser, sub.BrowserVersion)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandleHeartbeat records that a subscribed client is still alive.
+// Responds 404 when the endpoint is unknown so the client can resubscribe.
+func (h *Handler) HandleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.EndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Endpoint == "" {
+		http.Error(w, "Invalid heartbeat", http.StatusBadRequest)
+		return
+	}
+
+	found, err := h.store.TouchSubscription(req.Endpoint)
+	if err != nil {
+		log.Printf("Error recording heartbeat: %v", err)
+		http.Error(w, "Failed to record heartbeat", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Unknown subscription", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LoadSubscriptions reads all subscriptions from database
+func (h *Handler) LoadSubscriptions() []models.Subscription {
+	subs, err := h.store.GetAllSubscriptions()
+	if err != nil {
+		log.Printf("Error loading subscriptions: %v", err)
+		return []models.Subscription{}
+	}
+	return subs
+}
+
+// latestSubscription returns the most recently subscribed or delivered-to subscription
+func (h *Handler) latestSubscription() *models.Subscription {
+	h.latestMu.Lock()
+	defer h.latestMu.Unlock()
+	return h.latest
+}
+
+// setLatestSubscription replaces the latest subscription; nil clears it
+func (h *Handler) setLatestSubscription(sub *models.Subscription) {
+	h.latestMu.Lock()
+	defer h.latestMu.Unlock()
+	h.latest = sub
+}
@@ -1,56 +1,67 @@
-package handlers
-
-import (
-	"log"
-	"net/http"
-	"os"
-	"strings"
-)
-
-const (
-	PublicKeyFile  = "data/vapid_public.txt"
-	PrivateKeyFile = "data/vapid_private.txt"
-)
-
-var (
-	VapidPublicKey  string
-	VapidPrivateKey string
-)
-
-// InitVAPIDKeys loads VAPID keys from files
-func InitVAPIDKeys() error {
-	// Read VAPID public key
-	pubKeyData, err := os.ReadFile(PublicKeyFile)
-	if err != nil {
-		log.Fatalf("Failed to read VAPID public key from %s: %v\n", PublicKeyFile, err)
-		log.Println("Please generate VAPID keys at https://www.attheminute.com/vapid-key-generator")
-		log.Println("and place them in data/vapid_public.txt and data/vapid_private.txt")
-		return err
-	}
-	VapidPublicKey = strings.TrimSpace(string(pubKeyData))
-
-	// Read VAPID private key
-	privKeyData, err := os.ReadFile(PrivateKeyFile)
-	if err != nil {
-		log.Fatalf("Failed to read VAPID private key from %s: %v\n", PrivateKeyFile, err)
-		log.Println("Please generate VAPID keys at https://www.attheminute.com/vapid-key-generator")
-		log.Println("and place them in data/vapid_public.txt and data/vapid_private.txt")
-		return err
-	}
-	VapidPrivateKey = strings.TrimSpace(string(privKeyData))
-
-	// Validate keys are not empty
-	if VapidPublicKey == "" || VapidPrivateKey == "" {
-		log.Fatal("VAPID keys are empty. Please generate keys at https://www.attheminute.com/vapid-key-generator")
-	}
-
-	log.Println("✓ VAPID keys loaded successfully")
-	log.Printf("Public Key: %s", VapidPublicKey)
-	return nil
-}
-
-// GetVAPIDPublicKeyHandler returns the VAPID public key
-func GetVAPIDPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(VapidPublicKey))
-}
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	PublicKeyFile  = "data/vapid_public.txt"
+	PrivateKeyFile = "data/vapid_private.txt"
+)
+
+// vapidKeyHelp tells where to get VAPID keys when they are missing
+const vapidKeyHelp = "generate VAPID keys at https://www.attheminute.com/vapid-key-generator and place them in data/vapid_public.txt and data/vapid_private.txt"
+
+// VAPIDKeys is the key pair that identifies this server to push services
+type VAPIDKeys struct {
+	Public  string
+	Private string
+}
+
+// LoadVAPIDKeys loads VAPID keys from files
+func LoadVAPIDKeys() (VAPIDKeys, error) {
+	var keys VAPIDKeys
+
+	// Read VAPID public key
+	pubKeyData, err := os.ReadFile(PublicKeyFile)
+	if err != nil {
+		return keys, fmt.Errorf("reading the public key from %s: %w; %s", PublicKeyFile, err, vapidKeyHelp)
+	}
+	keys.Public = strings.TrimSpace(string(pubKeyData))
+
+	// Read VAPID private key
+	privKeyData, err := os.ReadFile(PrivateKeyFile)
+	if err != nil {
+		return keys, fmt.Errorf("reading the private key from %s: %w; %s", PrivateKeyFile, err, vapidKeyHelp)
+	}
+	keys.Private = strings.TrimSpace(string(privKeyData))
+
+	// Validate keys are not empty
+	if keys.Public == "" || keys.Private == "" {
+		return keys, errors.New("VAPID keys are empty; " + vapidKeyHelp)
+	}
+
+	log.Println("✓ VAPID keys loaded successfully")
+	log.Printf("Public Key: %s", keys.Public)
+	return keys, nil
+}
+
+// CheckVAPIDKeys reports an error if the Handler has no VAPID keys
+func (h *Handler) CheckVAPIDKeys(ctx context.Context) error {
+	if h.vapid.Public == "" || h.vapid.Private == "" {
+		return errors.New("VAPID keys not loaded")
+	}
+	return nil
+}
+
+// GetVAPIDPublicKeyHandler returns the VAPID public key
+func (h *Handler) GetVAPIDPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(h.vapid.Public))
+}
@@ -1,43 +1,233 @@
-package main
-
-import (
-	"log"
-	"net/http"
-	"webpush/database"
-	"webpush/handlers"
-)
-
-func main() {
-	// Initialize database
-	if err := database.InitDB("data/webpush.db"); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
-	}
-	log.Println("Database initialized")
-
-	// Initialize VAPID keys
-	if err := handlers.InitVAPIDKeys(); err != nil {
-		log.Fatalf("Failed to initialize VAPID keys: %v", err)
-	}
-
-	// Setup HTTP routes
-	// Dashboard routes
-	http.HandleFunc("/", handlers.ServeDashboard)
-	http.HandleFunc("/api/stats", handlers.GetDashboardStatsHandler)
-
-	// Push notification routes
-	http.HandleFunc("/vapid-public-key", handlers.GetVAPIDPublicKeyHandler)
-	http.HandleFunc("/subscribe", handlers.HandleSubscribe)
-	http.HandleFunc("/send-notification", handlers.SendNotificationHandler)
-	http.HandleFunc("/send-broadcast", handlers.SendBroadcastHandler)
-
-	// Serve static files
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-
-	// Serve service worker from root
-	http.Handle("/sw.js", http.FileServer(http.Dir("static")))
-
-	port := ":10040"
-	log.Printf("WebPush Server starting on http://localhost%s\n", port)
-	log.Printf("Dashboard available at http://localhost%s\n", port)
-	log.Fatal(http.ListenAndServe(port, nil))
-}
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"webpush/config"
+	"webpush/database"
+	"webpush/handlers"
+	"webpush/metrics"
+	"webpush/utils"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "backup":
+			runBackup(os.Args[2:])
+			return
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "rotate-key":
+			runRotateKey(os.Args[2:])
+			return
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		}
+	}
+
+	dryRun := flag.Bool("dry-run", false, "log the schema migrations startup would apply, then exit")
+	flag.Parse()
+
+	cfg := config.Load()
+	if cfg.LogRedactIPs {
+		log.SetOutput(utils.NewRedactingWriter(os.Stderr))
+	}
+
+	// Initialize database
+	store, err := database.Open(cfg.DBDriver, cfg.DBDSN)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	if err := migrateOnStartup(store, cfg.AutoMigrate, *dryRun); err != nil {
+		store.Close()
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+	if *dryRun {
+		store.Close()
+		return
+	}
+	if err := setupEncryption(store, cfg); err != nil {
+		store.Close()
+		log.Fatalf("Failed to set up encryption: %v", err)
+	}
+	log.Printf("Database initialized (%s)", cfg.DBDriver)
+
+	geo, err := utils.NewGeoIPProvider(cfg.GeoIPProvider, cfg.GeoIPDB, cfg.GeoIPASNDB, cfg.GeoIPReloadInterval)
+	if err != nil {
+		store.Close()
+		log.Fatalf("Failed to set up GeoIP: %v", err)
+	}
+	if geo != nil {
+		geo = utils.NewGeoIPCache(geo, cfg.GeoIPCacheSize, cfg.GeoIPCacheTTL)
+		defer geo.Close()
+	}
+
+	clientIP, err := utils.NewClientIPResolver(cfg.TrustedProxies)
+	if err != nil {
+		store.Close()
+		log.Fatalf("Invalid WEBPUSH_TRUSTED_PROXIES: %v", err)
+	}
+
+	anonymizer, err := utils.NewIPAnonymizer(cfg.IPMode, cfg.IPHashSalt)
+	if err != nil {
+		store.Close()
+		log.Fatalf("Invalid WEBPUSH_IP_MODE: %v", err)
+	}
+
+	userAgents, err := utils.NewUserAgentParser(cfg.UARulesFile)
+	if err != nil {
+		store.Close()
+		log.Fatalf("Invalid WEBPUSH_UA_RULES: %v", err)
+	}
+
+	limiter, err := utils.NewPushRateLimiter(cfg.PushRate, cfg.PushHostRates, cfg.PushConcurrency)
+	if err != nil {
+		store.Close()
+		log.Fatalf("Invalid WEBPUSH_PUSH_HOST_RATES: %v", err)
+	}
+
+	// Initialize VAPID keys
+	vapid, err := handlers.LoadVAPIDKeys()
+	if err != nil {
+		store.Close()
+		log.Fatalf("Failed to initialize VAPID keys: %v", err)
+	}
+
+	h := handlers.New(store, vapid, geo, clientIP, anonymizer, userAgents, limiter, cfg)
+
+	// Drop expired time series buckets in the background
+	h.StartStatsPruner()
+
+	// Forget client IPs and delivery log entries past their retention
+	h.StartRetentionPruner(cfg.IPRetention, cfg.DeliveryRetention)
+
+	// Forget idempotency keys once their replay window has passed
+	h.StartIdempotencyPruner()
+
+	// Snapshot the database on a schedule
+	h.StartBackupScheduler(cfg.BackupInterval)
+
+	// Send queued deliveries, including any left over from the last shutdown
+	h.StartDispatcher()
+
+	// Locate new subscribers in the background and backfill those without a location
+	h.StartGeoEnricher(cfg.GeoIPWorkers, cfg.GeoIPBackfill)
+
+	// Dependencies that must be healthy before the server reports ready
+	h.RegisterReadinessCheck("database", store.Ping)
+	h.RegisterReadinessCheck("vapid_keys", h.CheckVAPIDKeys)
+	h.RegisterReadinessCheck("scheduler", h.CheckStatsPruner)
+	h.RegisterReadinessCheck("dispatcher", h.CheckDispatcher)
+
+	// Setup HTTP routes
+	// Dashboard routes
+	handle("/", handlers.ServeDashboard)
+	handle("/api/stats", h.GetDashboardStatsHandler)
+	handle("/api/subscriptions", h.GetSubscriptionsHandler)
+	handle("/api/stats/timeseries", h.GetTimeSeriesHandler)
+	handle("/api/stats/services", h.GetPushServiceStatsHandler)
+
+	// Push notification routes
+	handle("/vapid-public-key", h.GetVAPIDPublicKeyHandler)
+	handle("/subscribe", h.HandleSubscribe)
+	handle("/heartbeat", h.HandleHeartbeat)
+	handle("/click", h.HandleClick)
+	handle("/send-notification", h.Idempotent(h.SendNotificationHandler))
+	handle("/send-broadcast", h.Idempotent(h.SendBroadcastHandler))
+
+	// Data subject access and erasure
+	handle("/privacy/access", h.PrivacyAccessHandler)
+	handle("/privacy/erase", h.PrivacyEraseHandler)
+
+	// Health probes
+	http.HandleFunc("/healthz", handlers.HealthzHandler)
+	http.HandleFunc("/readyz", h.ReadyzHandler)
+
+	// Admin routes
+	if cfg.AdminToken == "" {
+		log.Println("WEBPUSH_ADMIN_TOKEN is not set, /admin/ endpoints are disabled")
+	}
+	handle("/admin/backup", h.BackupHandler)
+	handle("/admin/export", h.ExportHandler)
+	handle("/admin/import", h.ImportHandler)
+	handle("/admin/geoip/backfill", h.GeoIPBackfillHandler)
+
+	// Prometheus metrics
+	http.Handle("/metrics", metrics.Handler())
+
+	// Serve static files
+	http.Handle("/static/", metrics.Instrument("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static")))))
+
+	// Serve service worker from root
+	http.Handle("/sw.js", metrics.Instrument("/sw.js", http.FileServer(http.Dir("static"))))
+
+	port := ":10040"
+	server := &http.Server{Addr: port}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Printf("WebPush Server starting on http://localhost%s\n", port)
+		log.Printf("Dashboard available at http://localhost%s\n", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	shutdown(server, h, store, cfg.DrainTimeout)
+}
+
+// shutdown stops accepting requests, drains in-flight requests and deliveries
+// for up to drainTimeout, persists unsent deliveries and closes the database
+func shutdown(server *http.Server, h *handlers.Handler, store database.Store, drainTimeout time.Duration) {
+	log.Printf("Shutting down, draining for up to %s", drainTimeout)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	// Handlers waiting on deferred deliveries return shortly after the drain deadline;
+	// sends already on the wire get the same grace to record their results
+	serverCtx, cancelServer := context.WithTimeout(context.Background(), drainTimeout+5*time.Second)
+	defer cancelServer()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.Shutdown(serverCtx)
+	}()
+
+	h.StopDispatcher(drainCtx, serverCtx)
+	h.StopGeoEnricher()
+
+	if err := <-serverDone; err != nil {
+		log.Printf("HTTP server did not drain cleanly: %v", err)
+	}
+
+	if err := store.Close(); err != nil {
+		log.Printf("Error closing database: %v", err)
+	}
+	log.Println("Shutdown complete")
+}
+
+// handle registers a handler with request latency metrics labelled by its route
+func handle(pattern string, h http.HandlerFunc) {
+	http.Handle(pattern, metrics.Instrument(pattern, h))
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// SubscriptionsCreated counts new subscriptions (updates of known endpoints are not counted)
+	SubscriptionsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webpush_subscriptions_created_total",
+		Help: "Number of new push subscriptions.",
+	})
+
+	// SubscriptionsRemoved counts removed subscriptions by reason
+	SubscriptionsRemoved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webpush_subscriptions_removed_total",
+		Help: "Number of removed push subscriptions.",
+	}, []string{"reason"})
+
+	// PushesTotal counts push attempts by result, push service response code and push service host
+	PushesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webpush_pushes_total",
+		Help: "Number of push messages sent to push services.",
+	}, []string{"result", "status_code", "push_service"})
+
+	// SendDuration observes how long a push service takes to accept a message
+	SendDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webpush_send_duration_seconds",
+		Help:    "Time taken to deliver a push message to the push service.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"push_service"})
+
+	// QueueDepth is the number of deliveries waiting to be sent
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "webpush_queue_depth",
+		Help: "Number of push deliveries waiting to be sent.",
+	})
+
+	// PushRateLimit is the requests/sec currently allowed per push service host, 0 for unlimited
+	PushRateLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "webpush_push_rate_limit",
+		Help: "Push requests per second currently allowed to a push service host.",
+	}, []string{"push_service"})
+
+	// PushRateWait observes how long pushes wait for their turn under the rate limit
+	PushRateWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webpush_push_rate_wait_seconds",
+		Help:    "Time a push waited for the rate limit of its push service host.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"push_service"})
+
+	// PushThrottled counts 429 and 503 responses that slowed down a push service host
+	PushThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webpush_push_throttled_total",
+		Help: "Number of push requests a push service answered with 429 or 503.",
+	}, []string{"push_service"})
+
+	// HTTPRequestDuration observes HTTP request latency per route
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webpush_http_request_duration_seconds",
+		Help:    "HTTP request latency by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	// GeoIPLookupDuration observes GeoIP lookup latency by result
+	GeoIPLookupDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webpush_geoip_lookup_duration_seconds",
+		Help:    "Time taken to resolve a client IP to a location.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+
+	// GeoIPCacheRequests counts GeoIP cache lookups by result (hit or miss)
+	GeoIPCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webpush_geoip_cache_requests_total",
+		Help: "Number of GeoIP cache lookups.",
+	}, []string{"result"})
+
+	// GeoIPQueueDepth is the number of subscriptions waiting for a location lookup
+	GeoIPQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "webpush_geoip_queue_depth",
+		Help: "Number of subscriptions waiting for a GeoIP lookup.",
+	})
+
+	// GeoIPDropped counts location lookups skipped because the queue was full
+	GeoIPDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webpush_geoip_dropped_total",
+		Help: "Number of GeoIP lookups dropped because the queue was full.",
+	})
+)
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObservePush records the outcome and latency of one push attempt.
+// statusCode is 0 when the request never reached the push service.
+func ObservePush(pushService, result string, statusCode int, elapsed time.Duration) {
+	code := "error"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	PushesTotal.WithLabelValues(result, code, pushService).Inc()
+	SendDuration.WithLabelValues(pushService).Observe(elapsed.Seconds())
+}
+
+// Instrument wraps a handler to record request latency under the given route name
+func Instrument(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		HTTPRequestDuration.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"webpush/config"
+	"webpush/database"
+)
+
+// runMigrate implements the migrate subcommand: it applies pending schema
+// migrations, or with -dry-run lists them without changing the database
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list pending migrations without applying them")
+	status := flags.Bool("status", false, "print the current schema version and pending migrations")
+	flags.Parse(args)
+
+	cfg := config.Load()
+	store, err := database.Open(cfg.DBDriver, cfg.DBDSN)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
+
+	migrator, ok := store.(database.Migrator)
+	if !ok {
+		fmt.Printf("The %s driver has no schema to migrate\n", cfg.DBDriver)
+		return
+	}
+
+	if *status || *dryRun {
+		version, err := migrator.SchemaVersion()
+		if err != nil {
+			log.Fatalf("Failed to read schema version: %v", err)
+		}
+		pending, err := migrator.PendingMigrations()
+		if err != nil {
+			log.Fatalf("Failed to list migrations: %v", err)
+		}
+		fmt.Printf("Schema version: %d\n", version)
+		printMigrations("Pending", pending)
+		return
+	}
+
+	applied, err := migrator.Migrate()
+	if err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+	printMigrations("Applied", applied)
+}
+
+// migrateOnStartup brings the schema up to date before the server starts.
+// With dryRun it only logs what would be applied; with auto disabled it
+// fails if any migration is pending.
+func migrateOnStartup(store database.Store, auto, dryRun bool) error {
+	migrator, ok := store.(database.Migrator)
+	if !ok {
+		return nil
+	}
+
+	pending, err := migrator.PendingMigrations()
+	if err != nil {
+		return err
+	}
+
+	if dryRun || !auto {
+		for _, m := range pending {
+			log.Printf("[Migrate] Pending %04d_%s", m.Version, m.Name)
+		}
+		if dryRun || len(pending) == 0 {
+			return nil
+		}
+		return fmt.Errorf("%d pending migration(s) and WEBPUSH_AUTO_MIGRATE is off; run the migrate command first", len(pending))
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+	_, err = migrator.Migrate()
+	return err
+}
+
+// printMigrations lists migrations under a heading
+func printMigrations(heading string, migrations []database.Migration) {
+	if len(migrations) == 0 {
+		fmt.Printf("%s migrations: none\n", heading)
+		return
+	}
+	names := make([]string, len(migrations))
+	for i, m := range migrations {
+		names[i] = fmt.Sprintf("  %04d_%s", m.Version, m.Name)
+	}
+	fmt.Printf("%s migrations:\n%s\n", heading, strings.Join(names, "\n"))
+}
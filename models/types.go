@@ -1,46 +1,263 @@
-package models
-
-// Subscription represents a web push subscription with client metadata
-type Subscription struct {
-	Endpoint string `json:"endpoint"`
-	Keys     struct {
-		P256dh string `json:"p256dh"`
-		Auth   string `json:"auth"`
-	} `json:"keys"`
-	IP              string `json:"ip,omitempty"`
-	Nation          string `json:"nation,omitempty"`
-	OS              string `json:"os,omitempty"`
-	OSVersion       string `json:"os_version,omitempty"`
-	Browser         string `json:"browser,omitempty"`
-	BrowserVersion  string `json:"browser_version,omitempty"`
-	Platform        string `json:"platform,omitempty"`
-	PlatformVersion string `json:"platform_version,omitempty"`
-}
-
-// NotificationPayload defines the structure of a push notification
-type NotificationPayload struct {
-	Title   string `json:"title"`
-	Body    string `json:"body"`
-	Icon    string `json:"icon"`
-	Badge   string `json:"badge"`
-	Tag     string `json:"tag"`
-	Vibrate []int  `json:"vibrate"`
-}
-
-// SendRequest is the request format for sending a notification
-type SendRequest struct {
-	Subscription Subscription `json:"subscription"`
-	Title        string       `json:"title"`
-	Body         string       `json:"body"`
-	Icon         string       `json:"icon"`
-	Badge        string       `json:"badge"`
-}
-
-// DashboardStats aggregates statistics for the dashboard view
-type DashboardStats struct {
-	TotalClients  int            `json:"total_clients"`
-	OnlineClients int            `json:"online_clients"`
-	TotalPushes   int            `json:"total_pushes"`
-	Countries     map[string]int `json:"countries"`
-	Subscriptions []Subscription `json:"subscriptions"`
-}
+package models
+
+import "time"
+
+// Subscription represents a web push subscription with client metadata
+type Subscription struct {
+	// ID is the storage row id, used to order and page through subscriptions
+	ID       int64  `json:"-"`
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+	IP              string    `json:"ip,omitempty"`
+	Nation          string    `json:"nation,omitempty"`
+	Region          string    `json:"region,omitempty"`
+	City            string    `json:"city,omitempty"`
+	ASN             int       `json:"asn,omitempty"`
+	ASOrg           string    `json:"as_org,omitempty"`
+	TimeZone        string    `json:"timezone,omitempty"`
+	OS              string    `json:"os,omitempty"`
+	OSVersion       string    `json:"os_version,omitempty"`
+	Browser         string    `json:"browser,omitempty"`
+	BrowserVersion  string    `json:"browser_version,omitempty"`
+	DeviceType      string    `json:"device_type,omitempty"`
+	Engine          string    `json:"engine,omitempty"`
+	DeviceVendor    string    `json:"device_vendor,omitempty"`
+	PushService     string    `json:"push_service,omitempty"` // e.g. fcm or mozilla, classified from the endpoint host
+	Platform        string    `json:"platform,omitempty"`
+	PlatformVersion string    `json:"platform_version,omitempty"`
+	ExpirationTime  *int64    `json:"expirationTime,omitempty"`
+	UserID          string    `json:"user_id,omitempty"`
+	Tags            []string  `json:"tags,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	LastActive      time.Time `json:"last_active"`
+}
+
+// Subscription listing sort keys
+const (
+	SortCreatedAt  = "created_at"
+	SortLastActive = "last_active"
+)
+
+// SubscriptionQuery selects a page of subscriptions for the listing API
+type SubscriptionQuery struct {
+	Sort   string // SortCreatedAt or SortLastActive
+	Asc    bool   // oldest first instead of newest first
+	Limit  int
+	Cursor string // NextCursor from the previous page
+
+	// Search matches a substring of the endpoint, case-insensitively
+	Search string
+
+	SubscriptionFilter
+}
+
+// SubscriptionFilter selects subscriptions by exact field values; empty fields match all
+type SubscriptionFilter struct {
+	Nation      string
+	OS          string
+	Browser     string
+	PushService string // host of the endpoint, e.g. fcm.googleapis.com
+	UserID      string // only for lookups behind the admin token, never from the public listing
+}
+
+// Breakdown dimensions subscriptions can be counted by
+const (
+	BreakdownNation         = "nation"
+	BreakdownBrowser        = "browser"
+	BreakdownBrowserVersion = "browser_version" // browser and major version, e.g. "Chrome 120"
+	BreakdownOS             = "os"
+	BreakdownOSVersion      = "os_version"   // OS and version, e.g. "Android 14"
+	BreakdownPushService    = "push_service" // endpoint host, e.g. fcm.googleapis.com
+	BreakdownService        = "service"      // classified push service, e.g. fcm
+)
+
+// SubscriptionPage is one page of the subscription listing
+type SubscriptionPage struct {
+	Subscriptions []Subscription `json:"subscriptions"`
+	NextCursor    string         `json:"next_cursor,omitempty"`
+}
+
+// NotificationPayload defines the structure of a push notification
+type NotificationPayload struct {
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	Icon    string `json:"icon"`
+	Badge   string `json:"badge"`
+	Tag     string `json:"tag"`
+	Vibrate []int  `json:"vibrate"`
+}
+
+// SendRequest is the request format for sending a notification
+type SendRequest struct {
+	Subscription Subscription `json:"subscription"`
+	Title        string       `json:"title"`
+	Body         string       `json:"body"`
+	Icon         string       `json:"icon"`
+	Badge        string       `json:"badge"`
+	Truncate     bool         `json:"truncate"` // shorten a body that does not fit instead of rejecting the request
+	SendOptions
+}
+
+// SendOptions are the delivery options of a send or broadcast request. They are
+// adjusted to each push service: TTLs above its cap are lowered and the urgency
+// is left out where it is not supported.
+type SendOptions struct {
+	TTL     int    `json:"ttl,omitempty"`     // seconds the push service keeps an undelivered message; 0 for the default
+	Urgency string `json:"urgency,omitempty"` // very-low, low, normal or high
+}
+
+// EndpointRequest identifies a subscription in heartbeat and click reports
+type EndpointRequest struct {
+	Endpoint string `json:"endpoint"`
+}
+
+// PrivacyRequest identifies a data subject for the access and erasure endpoints:
+// a subscription, proved by its auth secret, or an external user ID
+type PrivacyRequest struct {
+	Endpoint string `json:"endpoint,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+	UserID   string `json:"user_id,omitempty"`
+}
+
+// SubjectData is everything stored about a data subject
+type SubjectData struct {
+	Subscriptions []SubscriptionData `json:"subscriptions"`
+	ExportedAt    time.Time          `json:"exported_at"`
+}
+
+// SubscriptionData is one subscription with its delivery and click history
+type SubscriptionData struct {
+	Subscription
+	Deliveries []Delivery `json:"deliveries"`
+}
+
+// DashboardStats aggregates statistics for the dashboard view. The breakdown
+// maps count only the subscriptions matching the requested filter.
+type DashboardStats struct {
+	TotalClients   int            `json:"total_clients"`
+	OnlineClients  int            `json:"online_clients"`
+	ActiveToday    int            `json:"active_today"`
+	ActiveThisWeek int            `json:"active_this_week"`
+	OnlineWindow   int            `json:"online_window_seconds"`
+	TotalPushes    int            `json:"total_pushes"`
+	Countries      map[string]int `json:"countries"`
+	Browsers       map[string]int `json:"browsers"`
+	OS             map[string]int `json:"operating_systems"`
+
+	BrowserVersions map[string]int `json:"browser_versions"`
+	OSVersions      map[string]int `json:"os_versions"`
+	PushServices    map[string]int `json:"push_services"`
+	Services        map[string]int `json:"services"`
+}
+
+// Delivery is an entry in the delivery log: one push attempt or click for a subscription
+type Delivery struct {
+	Endpoint   string    `json:"endpoint"`
+	Event      PushEvent `json:"event"`
+	StatusCode int       `json:"status_code,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// PendingDelivery is a push message persisted at shutdown before it could be sent.
+// ID is set by the store when the delivery is claimed.
+type PendingDelivery struct {
+	ID       int64
+	Endpoint string
+	Payload  []byte
+	SendOptions
+}
+
+// IdempotencyRecord is a request sent with an Idempotency-Key and, once it
+// finished, the response to replay for retries of it
+type IdempotencyRecord struct {
+	Key         string
+	Fingerprint string // hash of the request path and body
+	StatusCode  int    // 0 while the request is in progress
+	ContentType string
+	Response    []byte
+	CreatedAt   time.Time
+}
+
+// Time series resolutions for push statistics
+const (
+	ResolutionMinute = "minute"
+	ResolutionHour   = "hour"
+	ResolutionDay    = "day"
+)
+
+// PushEvent is a push outcome counted in the time series
+type PushEvent string
+
+const (
+	PushSent    PushEvent = "sent"
+	PushFailed  PushEvent = "failed"
+	PushExpired PushEvent = "expired"
+	PushClicked PushEvent = "clicked"
+)
+
+// PushStatKey identifies the breakdown a push count belongs to
+type PushStatKey struct {
+	PushService string
+	Browser     string
+}
+
+// PushCounts holds push outcome counters for one bucket
+type PushCounts struct {
+	Sent    int `json:"sent"`
+	Failed  int `json:"failed"`
+	Expired int `json:"expired"`
+	Clicked int `json:"clicked"`
+}
+
+// TimeSeriesPoint is the push counts for a single time bucket
+type TimeSeriesPoint struct {
+	Bucket time.Time `json:"bucket"`
+	PushCounts
+}
+
+// TimeSeries is a sequence of points for one breakdown key
+type TimeSeries struct {
+	Key    string            `json:"key"`
+	Points []TimeSeriesPoint `json:"points"`
+}
+
+// TimeSeriesResponse is returned by the time series stats API
+type TimeSeriesResponse struct {
+	Resolution string       `json:"resolution"`
+	GroupBy    string       `json:"group_by,omitempty"`
+	From       time.Time    `json:"from"`
+	To         time.Time    `json:"to"`
+	Series     []TimeSeries `json:"series"`
+}
+
+// PushServiceStats is the delivery record of one push service over a period
+type PushServiceStats struct {
+	Service       string   `json:"service"`
+	Hosts         []string `json:"hosts"` // endpoint hosts that sent pushes in the period
+	Subscriptions int      `json:"subscriptions"`
+	PushCounts
+	SuccessRate float64 `json:"success_rate"` // sent / (sent + failed + expired); 0 without attempts
+}
+
+// PushServiceStatsResponse is returned by the push service stats API
+type PushServiceStatsResponse struct {
+	From     time.Time          `json:"from"`
+	To       time.Time          `json:"to"`
+	Services []PushServiceStats `json:"services"`
+}
+
+// CheckResult is the outcome of a single readiness check
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// HealthResponse is returned by the health and readiness endpoints
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
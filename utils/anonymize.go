@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"regexp"
+)
+
+// IP storage modes for WEBPUSH_IP_MODE
+const (
+	IPModeFull     = "full"     // store the address as is
+	IPModeTruncate = "truncate" // store the /24 (IPv4) or /48 (IPv6) network
+	IPModeHash     = "hash"     // store a salted hash, usable to match but not to recover the address
+	IPModeDrop     = "drop"     // store nothing; the address is only used for the GeoIP lookup
+)
+
+// Prefix lengths kept by truncation
+const (
+	truncateBitsIPv4 = 24
+	truncateBitsIPv6 = 48
+)
+
+// IPAnonymizer turns client addresses into the form that is stored
+type IPAnonymizer struct {
+	mode string
+	salt []byte
+}
+
+// NewIPAnonymizer returns an anonymizer for mode. The hash mode requires a salt,
+// which must stay the same for hashes to keep matching.
+func NewIPAnonymizer(mode, salt string) (*IPAnonymizer, error) {
+	switch mode {
+	case IPModeFull, IPModeTruncate, IPModeDrop:
+	case IPModeHash:
+		if salt == "" {
+			return nil, errors.New("the hash IP mode requires WEBPUSH_IP_HASH_SALT")
+		}
+	default:
+		return nil, fmt.Errorf("unknown IP mode %q, want full, truncate, hash or drop", mode)
+	}
+	return &IPAnonymizer{mode: mode, salt: []byte(salt)}, nil
+}
+
+// Mode returns the configured IP mode
+func (a *IPAnonymizer) Mode() string {
+	return a.mode
+}
+
+// Anonymize returns the stored form of ip, or "" for the zero Addr and the drop mode
+func (a *IPAnonymizer) Anonymize(ip netip.Addr) string {
+	if !ip.IsValid() {
+		return ""
+	}
+	switch a.mode {
+	case IPModeTruncate:
+		return TruncateIP(ip).Addr().String()
+	case IPModeHash:
+		mac := hmac.New(sha256.New, a.salt)
+		mac.Write(ip.AsSlice())
+		return hex.EncodeToString(mac.Sum(nil)[:16])
+	case IPModeDrop:
+		return ""
+	default:
+		return ip.String()
+	}
+}
+
+// AnonymizeString returns the stored form of an address recorded elsewhere,
+// e.g. in an imported file. Addresses are anonymized as by Anonymize; in the
+// hash mode an already hashed value is kept. Anything else is dropped.
+func (a *IPAnonymizer) AnonymizeString(s string) string {
+	if ip, ok := ParseIP(s); ok {
+		return a.Anonymize(ip)
+	}
+	if a.mode == IPModeHash && ipHashPattern.MatchString(s) {
+		return s
+	}
+	return ""
+}
+
+// ipHashPattern matches the hex digest stored by the hash mode
+var ipHashPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// TruncateIP returns the /24 network of an IPv4 address or the /48 of an IPv6 address
+func TruncateIP(ip netip.Addr) netip.Prefix {
+	bits := truncateBitsIPv6
+	if ip.Is4() {
+		bits = truncateBitsIPv4
+	}
+	prefix, _ := ip.Prefix(bits)
+	return prefix
+}
+
+// ipCandidate matches text that may be an IPv4 or IPv6 address, with or
+// without a port. Candidates are checked with ParseIP before they are redacted.
+var ipCandidate = regexp.MustCompile(`\[?[0-9A-Fa-f]*[:.][0-9A-Fa-f:.]*\]?(:[0-9]+)?`)
+
+// RedactIPs replaces every IP address in s by its truncated network, e.g.
+// "203.0.113.7:51234" by "203.0.113.0/24". Only addresses standing alone are
+// redacted, not parts of words or versions such as "Chrome/120.0.0.0".
+func RedactIPs(s []byte) []byte {
+	var out []byte
+	last := 0
+	for _, loc := range ipCandidate.FindAllIndex(s, -1) {
+		start := loc[0]
+		ip, end, ok := parseIPCandidate(s, start, loc[1])
+		if !ok || !standsAlone(s, start, end) {
+			continue
+		}
+		out = append(out, s[last:start]...)
+		out = append(out, TruncateIP(ip).String()...)
+		last = end
+	}
+	if last == 0 {
+		return s
+	}
+	return append(out, s[last:]...)
+}
+
+// parseIPCandidate parses s[start:end] as an address, dropping trailing dots
+// and colons that end a sentence or a "key:" label rather than the address.
+// It returns the end of the address.
+func parseIPCandidate(s []byte, start, end int) (netip.Addr, int, bool) {
+	for end > start {
+		if ip, ok := ParseIP(string(s[start:end])); ok {
+			return ip, end, true
+		}
+		if c := s[end-1]; c != '.' && c != ':' {
+			break
+		}
+		end--
+	}
+	return netip.Addr{}, end, false
+}
+
+// standsAlone reports whether s[start:end] is delimited like an address:
+// not inside a word or number, and not the version of a product token such as
+// "Chrome/120.0.0.0". A URL host, after "//", still counts.
+func standsAlone(s []byte, start, end int) bool {
+	if end < len(s) && isWordByte(s[end]) {
+		return false
+	}
+	if start == 0 {
+		return true
+	}
+	switch prev := s[start-1]; {
+	case isWordByte(prev), prev == '.', prev == '-':
+		return false
+	case prev == '/':
+		return start == 1 || !isWordByte(s[start-2])
+	}
+	return true
+}
+
+// isWordByte reports whether c is an ASCII letter, digit or underscore
+func isWordByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// redactingWriter redacts IP addresses from everything written through it
+type redactingWriter struct {
+	w io.Writer
+}
+
+// NewRedactingWriter returns a writer that redacts IP addresses before writing
+// to w. Intended for log output, where each write is one complete line.
+func NewRedactingWriter(w io.Writer) io.Writer {
+	return &redactingWriter{w: w}
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if !bytes.ContainsAny(p, ".:") {
+		return r.w.Write(p)
+	}
+	if _, err := r.w.Write(RedactIPs(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
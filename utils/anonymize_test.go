@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestRedactIPs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"client 203.0.113.7 subscribed", "client 203.0.113.0/24 subscribed"},
+		{"from 203.0.113.7:51234", "from 203.0.113.0/24"},
+		{"203.0.113.7", "203.0.113.0/24"},
+		{"IP: 192.0.2.1, 192.0.2.200", "IP: 192.0.2.0/24, 192.0.2.0/24"},
+		{"ip=198.51.100.4;", "ip=198.51.100.0/24;"},
+		{"(192.0.2.1)", "(192.0.2.0/24)"},
+		{`"192.0.2.1"`, `"192.0.2.0/24"`},
+		{"http://192.0.2.1/path", "http://192.0.2.0/24/path"},
+
+		// Punctuation after the address is kept
+		{"request from 203.0.113.7.", "request from 203.0.113.0/24."},
+		{"peer 203.0.113.7: refused", "peer 203.0.113.0/24: refused"},
+
+		// IPv6, including addresses ending in "::" and with ports
+		{"peer 2001:db8:1234:5678::1 connected", "peer 2001:db8:1234::/48 connected"},
+		{"peer 2001:db8:1234:: connected", "peer 2001:db8:1234::/48 connected"},
+		{"peer [2001:db8:1234::1]:443", "peer 2001:db8:1234::/48"},
+		{"peer [2001:db8:1234::1]", "peer 2001:db8:1234::/48"},
+		{"ip ::ffff:203.0.113.7", "ip 203.0.113.0/24"},
+		{"loopback ::1", "loopback ::/48"},
+
+		// Versions, times and other dotted or colon-separated text are left alone
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/120.0.0.0 Safari/537.36", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/120.0.0.0 Safari/537.36"},
+		{"Edg/120.0.2210.91", "Edg/120.0.2210.91"},
+		{"2026/10/19 07:02:10 started", "2026/10/19 07:02:10 started"},
+		{"HTTP/1.1 200", "HTTP/1.1 200"},
+		{"release v1.2.3.4", "release v1.2.3.4"},
+		{"build 1.2.3.4a", "build 1.2.3.4a"},
+		{"build 1.2.3.4-rc1", "build 1.2.3.0/24-rc1"},
+		{"version 1.2.3.4.5", "version 1.2.3.4.5"},
+		{"id-1.2.3.4", "id-1.2.3.4"},
+		{"send/abc:APA91bH", "send/abc:APA91bH"},
+		{"took 1.5s", "took 1.5s"},
+		{"no addresses here", "no addresses here"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := string(RedactIPs([]byte(tt.in))); got != tt.want {
+			t.Errorf("RedactIPs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewRedactingWriter(&buf)
+	line := "Subscription received | IP: 203.0.113.7 | Browser: Chrome/120.0.0.0\n"
+	if n, err := w.Write([]byte(line)); err != nil || n != len(line) {
+		t.Fatalf("Write = %d, %v, want %d", n, err, len(line))
+	}
+	if want := "Subscription received | IP: 203.0.113.0/24 | Browser: Chrome/120.0.0.0\n"; buf.String() != want {
+		t.Errorf("written %q, want %q", buf.String(), want)
+	}
+}
+
+func TestIPAnonymizer(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.7")
+	hash, _ := NewIPAnonymizer(IPModeHash, "salt")
+	hashed := hash.Anonymize(ip)
+
+	tests := []struct {
+		mode string
+		in   string
+		want string
+	}{
+		{IPModeFull, "203.0.113.7", "203.0.113.7"},
+		{IPModeFull, "[2001:db8::1]:443", "2001:db8::1"},
+		{IPModeTruncate, "203.0.113.7", "203.0.113.0"},
+		{IPModeTruncate, "2001:db8:1234:5678::1", "2001:db8:1234::"},
+		{IPModeDrop, "203.0.113.7", ""},
+		{IPModeHash, "203.0.113.7", hashed},
+
+		// Recorded values that are no address: a hash is kept only in the hash mode
+		{IPModeHash, hashed, hashed},
+		{IPModeFull, hashed, ""},
+		{IPModeTruncate, "not-an-ip", ""},
+		{IPModeFull, "", ""},
+	}
+	for _, tt := range tests {
+		a, err := NewIPAnonymizer(tt.mode, "salt")
+		if err != nil {
+			t.Fatalf("NewIPAnonymizer(%s): %v", tt.mode, err)
+		}
+		if got := a.AnonymizeString(tt.in); got != tt.want {
+			t.Errorf("%s: AnonymizeString(%q) = %q, want %q", tt.mode, tt.in, got, tt.want)
+		}
+	}
+
+	if len(hashed) != 32 || hashed == ip.String() {
+		t.Errorf("hash mode stored %q", hashed)
+	}
+	if _, err := NewIPAnonymizer(IPModeHash, ""); err == nil {
+		t.Error("hash mode without salt accepted")
+	}
+	if _, err := NewIPAnonymizer("partial", ""); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
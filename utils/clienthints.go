@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"net/http"
+	"strings"
+)
+
+// AcceptCH lists the User-Agent Client Hints the server asks browsers for. The
+// low-entropy hints are sent anyway; the others only after a response from the
+// same origin carried this list in an Accept-CH header.
+const AcceptCH = "Sec-CH-UA, Sec-CH-UA-Mobile, Sec-CH-UA-Platform, Sec-CH-UA-Platform-Version, Sec-CH-UA-Full-Version-List"
+
+// Brand is one entry of a brand list, as in Sec-CH-UA and navigator.userAgentData
+type Brand struct {
+	Brand   string `json:"brand"`
+	Version string `json:"version"`
+}
+
+// ClientHints are the User-Agent Client Hints of a Chromium-based browser,
+// from request headers or from navigator.userAgentData. Empty fields were not sent.
+type ClientHints struct {
+	Brands          []Brand // full versions when known, else major versions
+	Platform        string  // e.g. "Windows", "macOS", "Android"
+	PlatformVersion string
+	Mobile          *bool
+}
+
+// ParseClientHints reads the Sec-CH-UA headers of a request
+func ParseClientHints(h http.Header) ClientHints {
+	var c ClientHints
+	c.Brands = parseBrandList(h.Get("Sec-CH-UA-Full-Version-List"))
+	if len(c.Brands) == 0 {
+		c.Brands = parseBrandList(h.Get("Sec-CH-UA"))
+	}
+	c.Platform = unquote(strings.TrimSpace(h.Get("Sec-CH-UA-Platform")))
+	c.PlatformVersion = unquote(strings.TrimSpace(h.Get("Sec-CH-UA-Platform-Version")))
+	switch strings.TrimSpace(h.Get("Sec-CH-UA-Mobile")) {
+	case "?1":
+		mobile := true
+		c.Mobile = &mobile
+	case "?0":
+		mobile := false
+		c.Mobile = &mobile
+	}
+	return c
+}
+
+// parseBrandList parses a structured-field brand list such as
+// `"Chromium";v="120", "Google Chrome";v="120", "Not_A Brand";v="8"`
+func parseBrandList(v string) []Brand {
+	var brands []Brand
+	for _, item := range splitQuoted(v, ',') {
+		params := splitQuoted(item, ';')
+		b := Brand{Brand: unquote(strings.TrimSpace(params[0]))}
+		for _, param := range params[1:] {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && key == "v" {
+				b.Version = unquote(strings.TrimSpace(value))
+			}
+		}
+		if b.Brand != "" {
+			brands = append(brands, b)
+		}
+	}
+	return brands
+}
+
+// Override returns c with the fields that are set in other replacing its own.
+// Used to let the page's high-entropy userAgentData win over request headers.
+func (c ClientHints) Override(other ClientHints) ClientHints {
+	if len(other.Brands) > 0 {
+		c.Brands = other.Brands
+	}
+	if other.Platform != "" && other.Platform != c.Platform {
+		c.Platform, c.PlatformVersion = other.Platform, ""
+	}
+	if other.PlatformVersion != "" {
+		c.PlatformVersion = other.PlatformVersion
+	}
+	if other.Mobile != nil {
+		c.Mobile = other.Mobile
+	}
+	return c
+}
+
+// brandNames maps Client Hints brands to the browser names used in statistics
+var brandNames = map[string]string{
+	"Google Chrome":    "Chrome",
+	"Microsoft Edge":   "Edge",
+	"Opera":            "Opera",
+	"Opera GX":         "Opera GX",
+	"Brave":            "Brave",
+	"Samsung Internet": "Samsung Internet",
+	"Vivaldi":          "Vivaldi",
+	"YaBrowser":        "Yandex",
+	"Yandex":           "Yandex",
+	"DuckDuckGo":       "DuckDuckGo",
+}
+
+// Browser returns the browser named by the brand list, or "" when it only
+// names the Chromium engine, which every Chromium-based browser lists
+func (c ClientHints) Browser() (name, version string) {
+	for _, b := range c.Brands {
+		if b.Brand == "Chromium" || isGreaseBrand(b.Brand) {
+			continue
+		}
+		if name, ok := brandNames[b.Brand]; ok {
+			return name, b.Version
+		}
+		return b.Brand, b.Version
+	}
+	return "", ""
+}
+
+// isGreaseBrand reports whether brand is one of the made-up entries browsers
+// add to brand lists, such as "Not_A Brand" or "Not)A;Brand"
+func isGreaseBrand(brand string) bool {
+	return strings.Contains(brand, "Not") && strings.Contains(brand, "Brand")
+}
+
+// platformNames maps Client Hints platforms to the OS names used in statistics
+var platformNames = map[string]string{
+	"Chrome OS":   "ChromeOS",
+	"Chromium OS": "ChromeOS",
+}
+
+// ClientInfo is the browser, OS and device detected for a client
+type ClientInfo struct {
+	OS             string
+	OSVersion      string
+	Browser        string
+	BrowserVersion string
+	Engine         string
+	DeviceType     string
+	DeviceVendor   string
+}
+
+// DetectClient combines the User-Agent string with Client Hints. Hints are
+// preferred where present, since Chromium freezes most of the User-Agent
+// (e.g. always reporting Windows 10 and macOS 10.15.7) and Chromium-based
+// browsers such as Brave, Opera and Samsung Internet look like Chrome in it.
+func (p *UserAgentParser) DetectClient(ua string, hints ClientHints) ClientInfo {
+	parsed := p.Parse(ua)
+	c := ClientInfo{
+		OS:             parsed.OS,
+		OSVersion:      parsed.OSVersion,
+		Browser:        parsed.Browser,
+		BrowserVersion: parsed.BrowserVersion,
+		Engine:         parsed.Engine,
+		DeviceType:     parsed.DeviceType,
+		DeviceVendor:   parsed.DeviceVendor,
+	}
+
+	if name, version := hints.Browser(); name != "" {
+		c.Browser, c.BrowserVersion = name, version
+		c.Engine = "Blink"
+	}
+
+	if hints.Platform != "" && hints.Platform != "Unknown" {
+		platform := hints.Platform
+		if name, ok := platformNames[platform]; ok {
+			platform = name
+		}
+		if platform != c.OS {
+			c.OS, c.OSVersion = platform, ""
+		}
+		if hints.PlatformVersion != "" {
+			c.OSVersion = ParsePlatformVersion(platform, hints.PlatformVersion)
+			if platform != "Windows" {
+				c.OSVersion = trimZeroVersion(c.OSVersion)
+			}
+		}
+	}
+
+	// Sec-CH-UA-Mobile is ?0 on tablets too, so it only decides between phone and desktop
+	if hints.Mobile != nil {
+		switch {
+		case *hints.Mobile:
+			c.DeviceType = DeviceMobile
+		case c.DeviceType == DeviceMobile || c.DeviceType == "":
+			c.DeviceType = DeviceDesktop
+		}
+	}
+	return c
+}
+
+// trimZeroVersion drops trailing ".0" components, e.g. "14.0.0" becomes "14"
+func trimZeroVersion(v string) string {
+	for strings.HasSuffix(v, ".0") {
+		v = strings.TrimSuffix(v, ".0")
+	}
+	return v
+}
@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// namedProxyRanges are shorthands accepted in the trusted proxy list
+var namedProxyRanges = map[string][]string{
+	"loopback": {"127.0.0.0/8", "::1/128"},
+	"private":  {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+}
+
+// ClientIPResolver determines the client address of a request. Forwarding
+// headers are only believed when they were added by a trusted proxy, since
+// anyone can send them.
+type ClientIPResolver struct {
+	trusted []netip.Prefix
+}
+
+// NewClientIPResolver returns a resolver trusting proxies in the given list
+// of CIDRs, single IPs, "loopback" and "private". An empty list trusts no
+// proxy, so the connection's peer address is always used.
+func NewClientIPResolver(trustedProxies []string) (*ClientIPResolver, error) {
+	r := &ClientIPResolver{}
+	for _, entry := range trustedProxies {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if named, ok := namedProxyRanges[strings.ToLower(entry)]; ok {
+			for _, cidr := range named {
+				r.trusted = append(r.trusted, netip.MustParsePrefix(cidr))
+			}
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			r.trusted = append(r.trusted, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: want a CIDR, an IP, loopback or private", entry)
+		}
+		addr = addr.Unmap().WithZone("")
+		r.trusted = append(r.trusted, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return r, nil
+}
+
+// isTrusted reports whether addr is a trusted proxy
+func (r *ClientIPResolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that made req, or the zero Addr
+// if it cannot be determined.
+//
+// When the peer is a trusted proxy, the forwarding chain is read from the
+// Forwarded header (RFC 7239), else X-Forwarded-For, else X-Real-IP. The chain
+// is walked from the nearest hop outwards, skipping trusted proxies; the first
+// address that is not a trusted proxy is the client. Addresses further out were
+// supplied by the client itself and are ignored.
+func (r *ClientIPResolver) ClientIP(req *http.Request) netip.Addr {
+	peer, ok := ParseIP(req.RemoteAddr)
+	if !ok || !r.isTrusted(peer) {
+		return peer
+	}
+
+	hops, ok := forwardedHops(req.Header)
+	if !ok {
+		return peer
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := ParseIP(hops[i])
+		if !ok {
+			// "unknown", an obfuscated identifier or garbage: nothing beyond it can be trusted
+			break
+		}
+		client = addr
+		if !r.isTrusted(addr) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedHops returns the forwarding chain from the most trusted header
+// present, ordered from the original client to the nearest proxy
+func forwardedHops(h http.Header) ([]string, bool) {
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		return parseForwarded(values), true
+	}
+	if values := h.Values("X-Forwarded-For"); len(values) > 0 {
+		var hops []string
+		for _, v := range values {
+			for _, hop := range strings.Split(v, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		return hops, len(hops) > 0
+	}
+	if v := strings.TrimSpace(h.Get("X-Real-IP")); v != "" {
+		return []string{v}, true
+	}
+	return nil, false
+}
+
+// parseForwarded returns the for= node of each element of RFC 7239 Forwarded
+// header values, in order. An element without for= yields "" so that it still
+// ends the trusted part of the chain.
+func parseForwarded(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, element := range splitQuoted(v, ',') {
+			node := ""
+			for _, pair := range splitQuoted(element, ';') {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(strings.TrimSpace(key), "for") {
+					node = unquote(strings.TrimSpace(value))
+				}
+			}
+			hops = append(hops, node)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits s at sep, ignoring separators inside quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\' && quoted:
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote removes the quotes and backslash escapes of an RFC 7230 quoted-string
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// ParseIP parses an IPv4 or IPv6 address with or without a port, as found in
+// RemoteAddr and forwarding headers: "192.0.2.1", "192.0.2.1:443", "2001:db8::1",
+// "[2001:db8::1]" or "[2001:db8::1]:443". IPv4-mapped IPv6 addresses are
+// returned as IPv4 and zones are dropped.
+func ParseIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		if addrPort, err := netip.ParseAddrPort(s); err == nil {
+			addr = addrPort.Addr()
+		} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+			if addr, err = netip.ParseAddr(s[1 : len(s)-1]); err != nil {
+				return netip.Addr{}, false
+			}
+		} else {
+			return netip.Addr{}, false
+		}
+	}
+	return addr.Unmap().WithZone(""), true
+}
@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParseIP(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // "" for not an address
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{" 192.0.2.1 ", "192.0.2.1"},
+		{"192.0.2.1:443", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"::1", "::1"},
+
+		// IPv4-mapped addresses are returned as IPv4
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]:8080", "192.0.2.1"},
+
+		// Zones are dropped
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%eth0]:443", "fe80::1"},
+		{"[fe80::1%25eth0]", "fe80::1"},
+
+		{"", ""},
+		{"unknown", ""},
+		{"_hidden", ""},
+		{"192.0.2", ""},
+		{"192.0.2.1:port", ""},
+		{"2001:db8::1:443", "2001:db8::1:443"}, // a valid IPv6 address, not one with a port
+		{"[2001:db8::1", ""},
+		{"example.com", ""},
+	}
+	for _, tt := range tests {
+		got, ok := ParseIP(tt.in)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("ParseIP(%q) = %v, want not an address", tt.in, got)
+			}
+			continue
+		}
+		if !ok || got != netip.MustParseAddr(tt.want) {
+			t.Errorf("ParseIP(%q) = %v, %v, want %s", tt.in, got, ok, tt.want)
+		}
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"single", []string{"for=192.0.2.60"}, []string{"192.0.2.60"}},
+		{"parameters", []string{"for=192.0.2.60;proto=http;by=203.0.113.43"}, []string{"192.0.2.60"}},
+		{"case-insensitive key", []string{"For=192.0.2.60"}, []string{"192.0.2.60"}},
+		{"spaces", []string{" for = 192.0.2.60 ; proto=https "}, []string{"192.0.2.60"}},
+		{"chain", []string{"for=192.0.2.43, for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"several headers", []string{"for=192.0.2.43", "for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"quoted IPv6 with port", []string{`for="[2001:db8:cafe::17]:4711"`}, []string{"[2001:db8:cafe::17]:4711"}},
+		{"quoted IPv4", []string{`for="192.0.2.60"`}, []string{"192.0.2.60"}},
+		{"separators inside quotes", []string{`for="a,b;c", for=192.0.2.1`}, []string{"a,b;c", "192.0.2.1"}},
+		{"escaped quote", []string{`for="x\"y", for=192.0.2.1`}, []string{`x"y`, "192.0.2.1"}},
+		{"unknown", []string{"for=unknown, for=192.0.2.1"}, []string{"unknown", "192.0.2.1"}},
+		{"obfuscated", []string{`for="_hidden", for=192.0.2.1`}, []string{"_hidden", "192.0.2.1"}},
+		{"element without for", []string{"proto=https, for=192.0.2.1"}, []string{"", "192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseForwarded(tt.values); !slices.Equal(got, tt.want) {
+				t.Errorf("parseForwarded(%q) = %q, want %q", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"loopback", "10.0.0.0/8", "2001:db8:ffff::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string][]string
+		want    string // "" for the zero Addr
+	}{
+		{"direct client", "198.51.100.7:5000", nil, "198.51.100.7"},
+		{"direct IPv6 client", "[2001:db8::7]:5000", nil, "2001:db8::7"},
+		{"IPv4-mapped peer", "[::ffff:198.51.100.7]:5000", nil, "198.51.100.7"},
+		{"zoned peer", "[fe80::7%eth0]:5000", nil, "fe80::7"},
+		{"unparsable peer", "@", nil, ""},
+
+		// Headers from peers that are not trusted proxies are ignored
+		{"untrusted peer with XFF", "198.51.100.7:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9"}}, "198.51.100.7"},
+		{"untrusted peer with Forwarded", "198.51.100.7:5000", map[string][]string{"Forwarded": {"for=203.0.113.9"}}, "198.51.100.7"},
+		{"untrusted peer with X-Real-IP", "198.51.100.7:5000", map[string][]string{"X-Real-IP": {"203.0.113.9"}}, "198.51.100.7"},
+
+		{"trusted peer without headers", "127.0.0.1:5000", nil, "127.0.0.1"},
+		{"XFF", "127.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+		{"XFF with port", "127.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9:1234"}}, "203.0.113.9"},
+		{"XFF through trusted proxies", "127.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9, 10.1.2.3, 10.4.5.6"}}, "203.0.113.9"},
+		{"XFF split over headers", "127.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9", "10.1.2.3"}}, "203.0.113.9"},
+
+		// A client can prepend anything to X-Forwarded-For; only the nearest untrusted hop counts
+		{"spoofed XFF", "127.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"1.2.3.4, 203.0.113.9"}}, "203.0.113.9"},
+		{"spoofed trusted XFF", "127.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"10.9.9.9, 203.0.113.9, 10.1.2.3"}}, "203.0.113.9"},
+		{"XFF garbage", "127.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9, garbage"}}, "127.0.0.1"},
+		{"XFF IPv4-mapped", "127.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"::ffff:203.0.113.9"}}, "203.0.113.9"},
+		{"XFF only trusted", "127.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"10.1.2.3"}}, "10.1.2.3"},
+		{"empty XFF", "127.0.0.1:5000", map[string][]string{"X-Forwarded-For": {" , "}}, "127.0.0.1"},
+
+		{"X-Real-IP", "127.0.0.1:5000", map[string][]string{"X-Real-IP": {"203.0.113.9"}}, "203.0.113.9"},
+		{"XFF before X-Real-IP", "127.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9"}, "X-Real-IP": {"198.51.100.1"}}, "203.0.113.9"},
+
+		{"Forwarded", "127.0.0.1:5000", map[string][]string{"Forwarded": {"for=203.0.113.9;proto=https"}}, "203.0.113.9"},
+		{"Forwarded before XFF", "127.0.0.1:5000", map[string][]string{"Forwarded": {"for=203.0.113.9"}, "X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.9"},
+		{"Forwarded quoted IPv6", "127.0.0.1:5000", map[string][]string{"Forwarded": {`for="[2001:db8:cafe::17]:4711"`}}, "2001:db8:cafe::17"},
+		{"Forwarded chain", "127.0.0.1:5000", map[string][]string{"Forwarded": {"for=198.51.100.1, for=203.0.113.9, for=10.1.2.3"}}, "203.0.113.9"},
+		{"Forwarded trusted IPv6 proxy", "127.0.0.1:5000", map[string][]string{"Forwarded": {`for=203.0.113.9, for="[2001:db8:ffff::1]"`}}, "203.0.113.9"},
+		{"Forwarded unknown", "127.0.0.1:5000", map[string][]string{"Forwarded": {"for=203.0.113.9, for=unknown"}}, "127.0.0.1"},
+		{"Forwarded unknown behind trusted proxy", "127.0.0.1:5000", map[string][]string{"Forwarded": {"for=unknown, for=10.1.2.3"}}, "10.1.2.3"},
+		{"Forwarded obfuscated", "127.0.0.1:5000", map[string][]string{"Forwarded": {`for=203.0.113.9, for="_gazonk"`}}, "127.0.0.1"},
+		{"Forwarded element without for", "127.0.0.1:5000", map[string][]string{"Forwarded": {"for=203.0.113.9, proto=https"}}, "127.0.0.1"},
+		{"Forwarded zoned", "127.0.0.1:5000", map[string][]string{"Forwarded": {`for="[fe80::9%eth0]"`}}, "fe80::9"},
+		{"IPv6 loopback peer", "[::1]:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+		{"IPv4-mapped trusted peer", "[::ffff:10.1.2.3]:5000", map[string][]string{"X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: tt.remote, Header: http.Header{}}
+			for k, values := range tt.headers {
+				for _, v := range values {
+					req.Header.Add(k, v)
+				}
+			}
+			got := resolver.ClientIP(req)
+			var want netip.Addr
+			if tt.want != "" {
+				want = netip.MustParseAddr(tt.want)
+			}
+			if got != want {
+				t.Errorf("ClientIP = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestClientIPNoTrustedProxies(t *testing.T) {
+	resolver, err := NewClientIPResolver(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{RemoteAddr: "127.0.0.1:5000", Header: http.Header{"X-Forwarded-For": {"203.0.113.9"}}}
+	if got := resolver.ClientIP(req); got != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("ClientIP = %v, want the peer when no proxy is trusted", got)
+	}
+}
+
+func TestNewClientIPResolver(t *testing.T) {
+	tests := []struct {
+		entries []string
+		trusted []string
+		ok      bool
+	}{
+		{[]string{"loopback"}, []string{"127.0.0.1", "127.255.0.1", "::1"}, true},
+		{[]string{"PRIVATE"}, []string{"10.1.1.1", "172.16.0.1", "192.168.1.1", "fd00::1"}, true},
+		{[]string{"192.0.2.0/24"}, []string{"192.0.2.77"}, true},
+		{[]string{"192.0.2.77/24"}, []string{"192.0.2.1"}, true}, // host bits are masked
+		{[]string{" 198.51.100.1 ", ""}, []string{"198.51.100.1"}, true},
+		{[]string{"::ffff:198.51.100.1"}, []string{"198.51.100.1"}, true},
+		{[]string{"fe80::1%eth0"}, []string{"fe80::1"}, true},
+		{[]string{"proxy.internal"}, nil, false},
+		{[]string{"10.0.0.0/33"}, nil, false},
+	}
+	for _, tt := range tests {
+		r, err := NewClientIPResolver(tt.entries)
+		if (err == nil) != tt.ok {
+			t.Errorf("NewClientIPResolver(%q) error = %v, want ok %v", tt.entries, err, tt.ok)
+			continue
+		}
+		for _, ip := range tt.trusted {
+			if !r.isTrusted(netip.MustParseAddr(ip)) {
+				t.Errorf("NewClientIPResolver(%q) does not trust %s", tt.entries, ip)
+			}
+		}
+		if r != nil && r.isTrusted(netip.MustParseAddr("203.0.113.9")) {
+			t.Errorf("NewClientIPResolver(%q) trusts 203.0.113.9", tt.entries)
+		}
+	}
+}
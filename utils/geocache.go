@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"container/list"
+	"net/netip"
+	"sync"
+	"time"
+	"webpush/metrics"
+)
+
+// GeoIPCache wraps a provider with an LRU cache of lookup results. Entries
+// expire after a TTL so that database updates and ip-api answers are picked
+// up eventually. Failed lookups are not cached.
+type GeoIPCache struct {
+	provider GeoIPProvider
+	size     int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[netip.Addr]*list.Element
+	order   *list.List // most recently used at the front
+}
+
+// geoCacheEntry is one cached lookup result
+type geoCacheEntry struct {
+	ip      netip.Addr
+	loc     GeoLocation
+	expires time.Time
+}
+
+// NewGeoIPCache returns a cache of at most size results from provider, each kept for ttl
+func NewGeoIPCache(provider GeoIPProvider, size int, ttl time.Duration) *GeoIPCache {
+	return &GeoIPCache{
+		provider: provider,
+		size:     size,
+		ttl:      ttl,
+		entries:  make(map[netip.Addr]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Lookup returns the cached location of ip, or looks it up and caches the result
+func (c *GeoIPCache) Lookup(ip netip.Addr) (GeoLocation, error) {
+	if loc, ok := c.cached(ip); ok {
+		return loc, nil
+	}
+	metrics.GeoIPCacheRequests.WithLabelValues("miss").Inc()
+
+	loc, err := c.provider.Lookup(ip)
+	if err != nil {
+		return loc, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &geoCacheEntry{ip: ip, loc: loc, expires: time.Now().Add(c.ttl)}
+	if el, ok := c.entries[ip]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return loc, nil
+	}
+	c.entries[ip] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*geoCacheEntry).ip)
+	}
+	return loc, nil
+}
+
+// cached returns the location of ip if a live result is cached
+func (c *GeoIPCache) cached(ip netip.Addr) (GeoLocation, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[ip]
+	if !ok {
+		return GeoLocation{}, false
+	}
+	entry := el.Value.(*geoCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, ip)
+		return GeoLocation{}, false
+	}
+	c.order.MoveToFront(el)
+	metrics.GeoIPCacheRequests.WithLabelValues("hit").Inc()
+	return entry.loc, true
+}
+
+// Close closes the wrapped provider
+func (c *GeoIPCache) Close() error {
+	return c.provider.Close()
+}
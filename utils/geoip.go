@@ -1,38 +1,139 @@
-package utils
-
-import (
-	"io"
-	"net/http"
-	"strings"
-)
-
-// LookupNation returns a country code for an IP using ip-api.com
-// Returns empty string on any error (best effort, non-blocking)
-func LookupNation(ip string) string {
-	if ip == "" {
-		return ""
-	}
-
-	// Only use the IP part if port is present
-	if strings.Contains(ip, ":") {
-		ip = strings.Split(ip, ":")[0]
-	}
-
-	url := "http://ip-api.com/line/" + ip + "?fields=countryCode"
-	resp, err := http.Get(url)
-	if err != nil {
-		return ""
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return ""
-	}
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return ""
-	}
-
-	return strings.TrimSpace(string(data))
-}
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+	"webpush/metrics"
+)
+
+// GeoIP provider names for WEBPUSH_GEOIP_PROVIDER
+const (
+	GeoIPProviderMMDB  = "mmdb"
+	GeoIPProviderIPAPI = "ip-api"
+	GeoIPProviderOff   = "off"
+)
+
+// GeoLocation is what a GeoIP provider knows about an IP address.
+// Fields the provider or database does not have are left empty.
+type GeoLocation struct {
+	Country  string // ISO 3166-1 alpha-2 code, e.g. "DE"
+	Region   string // first-level subdivision, e.g. "Bavaria"
+	City     string
+	ASN      int    // autonomous system number
+	ASOrg    string // autonomous system organization
+	TimeZone string // IANA time zone, e.g. "Europe/Berlin"
+}
+
+// GeoIPProvider resolves IP addresses to locations
+type GeoIPProvider interface {
+	Lookup(ip netip.Addr) (GeoLocation, error)
+	Close() error
+}
+
+// NewGeoIPProvider returns the provider selected by name. The mmdb provider
+// reads the database files at cityPath and asnPath (optional) and reloads them
+// every reloadInterval when they change. The "off" provider returns nil.
+func NewGeoIPProvider(name, cityPath, asnPath string, reloadInterval time.Duration) (GeoIPProvider, error) {
+	switch name {
+	case GeoIPProviderMMDB:
+		return OpenMMDB(cityPath, asnPath, reloadInterval)
+	case GeoIPProviderIPAPI:
+		log.Println("[GeoIP] Using ip-api.com: subscriber IPs are sent to a third party over plain HTTP")
+		return NewIPAPIProvider(), nil
+	case GeoIPProviderOff:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown GeoIP provider %q", name)
+	}
+}
+
+// LookupLocation returns the location of a client IP using provider.
+// Returns an empty location on any error (best effort) or when provider is nil.
+func LookupLocation(provider GeoIPProvider, ip netip.Addr) GeoLocation {
+	if provider == nil || !ip.IsValid() {
+		return GeoLocation{}
+	}
+
+	start := time.Now()
+	loc, err := provider.Lookup(ip)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	} else if loc.Country == "" {
+		result = "not_found"
+	}
+	metrics.GeoIPLookupDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+
+	return loc
+}
+
+// ipAPITimeout bounds a single ip-api.com request
+const ipAPITimeout = 3 * time.Second
+
+// IPAPIProvider looks up IPs with the ip-api.com web service. The free
+// service is plain HTTP and rate limited, so prefer a local mmdb database.
+type IPAPIProvider struct {
+	client *http.Client
+}
+
+// NewIPAPIProvider returns a provider querying ip-api.com
+func NewIPAPIProvider() *IPAPIProvider {
+	return &IPAPIProvider{client: &http.Client{Timeout: ipAPITimeout}}
+}
+
+// Lookup queries ip-api.com for the location of ip
+func (p *IPAPIProvider) Lookup(ip netip.Addr) (GeoLocation, error) {
+	var loc GeoLocation
+
+	url := "http://ip-api.com/json/" + ip.String() + "?fields=status,message,countryCode,regionName,city,timezone,as"
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return loc, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return loc, fmt.Errorf("ip-api.com returned %s", resp.Status)
+	}
+
+	var body struct {
+		Status      string `json:"status"`
+		Message     string `json:"message"`
+		CountryCode string `json:"countryCode"`
+		RegionName  string `json:"regionName"`
+		City        string `json:"city"`
+		TimeZone    string `json:"timezone"`
+		AS          string `json:"as"` // e.g. "AS15169 Google LLC"
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return loc, err
+	}
+	if body.Status != "success" {
+		// "private range" and "reserved range" are not errors, there is just nothing to find
+		if body.Message == "private range" || body.Message == "reserved range" {
+			return loc, nil
+		}
+		return loc, fmt.Errorf("ip-api.com: %s", body.Message)
+	}
+
+	loc.Country = body.CountryCode
+	loc.Region = body.RegionName
+	loc.City = body.City
+	loc.TimeZone = body.TimeZone
+	if number, org, ok := strings.Cut(body.AS, " "); ok && strings.HasPrefix(number, "AS") {
+		loc.ASN, _ = strconv.Atoi(number[2:])
+		loc.ASOrg = org
+	}
+	return loc, nil
+}
+
+// Close is a no-op
+func (p *IPAPIProvider) Close() error {
+	return nil
+}
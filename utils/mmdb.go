@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MMDBProvider looks up IPs in local MaxMind DB files, such as MaxMind
+// GeoLite2/GeoIP2 or DB-IP City, Country and ASN databases. Files are
+// reloaded when they change, so they can be updated (e.g. by geoipupdate)
+// without a restart. Replace them by renaming a new file into place.
+type MMDBProvider struct {
+	mu   sync.RWMutex
+	city *mmdbFile
+	asn  *mmdbFile
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// mmdbFile is one open database file and the modification time it was loaded at
+type mmdbFile struct {
+	path    string
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+// mmdbRecord holds the fields read from a lookup. City, country and ASN
+// databases each fill a subset; DB-IP combined databases fill all of them.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		TimeZone string `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+	ASN   int    `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// OpenMMDB opens the database at cityPath and, if asnPath is set, a separate
+// ASN database. A missing file is not an error: lookups return nothing for it
+// until it appears. With reloadInterval > 0 the files are checked for changes
+// that often.
+func OpenMMDB(cityPath, asnPath string, reloadInterval time.Duration) (*MMDBProvider, error) {
+	p := &MMDBProvider{
+		city: &mmdbFile{path: cityPath},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if asnPath != "" {
+		p.asn = &mmdbFile{path: asnPath}
+	}
+
+	for _, f := range p.files() {
+		next, err := f.reload()
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("[GeoIP] %s not found, locations are unavailable until it is installed", f.path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		*f = *next
+		log.Printf("[GeoIP] Loaded %s (%s, built %s)", f.path, f.reader.Metadata.DatabaseType,
+			time.Unix(int64(f.reader.Metadata.BuildEpoch), 0).UTC().Format("2006-01-02"))
+	}
+
+	if reloadInterval > 0 {
+		go p.watch(reloadInterval)
+	} else {
+		close(p.done)
+	}
+	return p, nil
+}
+
+// files returns the configured database files
+func (p *MMDBProvider) files() []*mmdbFile {
+	if p.asn == nil {
+		return []*mmdbFile{p.city}
+	}
+	return []*mmdbFile{p.city, p.asn}
+}
+
+// reload opens f's file again if it changed since it was loaded. Returns nil
+// without error when it is unchanged.
+func (f *mmdbFile) reload() (*mmdbFile, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if f.reader != nil && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return nil, nil
+	}
+
+	reader, err := maxminddb.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return &mmdbFile{path: f.path, reader: reader, modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// watch reloads changed database files every interval until Close
+func (p *MMDBProvider) watch(interval time.Duration) {
+	defer close(p.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, f := range p.files() {
+			next, err := f.reload()
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					log.Printf("[GeoIP] Keeping the loaded database, reloading %s failed: %v", f.path, err)
+				}
+				continue
+			}
+			if next == nil {
+				continue
+			}
+
+			// Lookups hold the read lock, so the old reader is unused once the swap is done
+			p.mu.Lock()
+			old := f.reader
+			*f = *next
+			p.mu.Unlock()
+			if old != nil {
+				old.Close()
+			}
+			log.Printf("[GeoIP] Reloaded %s (%s)", f.path, next.reader.Metadata.DatabaseType)
+		}
+	}
+}
+
+// Lookup returns the location of ip from the loaded databases
+func (p *MMDBProvider) Lookup(ip netip.Addr) (GeoLocation, error) {
+	var loc GeoLocation
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, f := range p.files() {
+		if f.reader == nil {
+			continue
+		}
+		var rec mmdbRecord
+		if err := f.reader.Lookup(net.IP(ip.Unmap().AsSlice()), &rec); err != nil {
+			return loc, err
+		}
+		mergeMMDBRecord(&loc, rec)
+	}
+	return loc, nil
+}
+
+// mergeMMDBRecord fills the fields of loc that are still empty from rec
+func mergeMMDBRecord(loc *GeoLocation, rec mmdbRecord) {
+	if loc.Country == "" {
+		loc.Country = rec.Country.ISOCode
+		if loc.Country == "" {
+			loc.Country = rec.RegisteredCountry.ISOCode
+		}
+	}
+	if loc.Region == "" && len(rec.Subdivisions) > 0 {
+		loc.Region = rec.Subdivisions[0].Names["en"]
+	}
+	if loc.City == "" {
+		loc.City = rec.City.Names["en"]
+	}
+	if loc.TimeZone == "" {
+		loc.TimeZone = rec.Location.TimeZone
+	}
+	if loc.ASN == 0 {
+		loc.ASN = rec.ASN
+		loc.ASOrg = rec.ASOrg
+	}
+}
+
+// Close stops reloading and closes the database files
+func (p *MMDBProvider) Close() error {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, f := range p.files() {
+		if f.reader != nil {
+			f.reader.Close()
+			f.reader = nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Overhead of the aes128gcm content coding used for push messages (RFC 8188, RFC 8291)
+const (
+	encryptionHeaderSize = 86 // salt (16), record size (4), key ID length (1), sender public key (65)
+	recordOverhead       = 17 // padding delimiter (1) and AEAD tag (16)
+)
+
+// MaxPayloadSize returns the largest payload that fits a record of recordSize bytes
+func MaxPayloadSize(recordSize uint32) int {
+	return int(recordSize) - encryptionHeaderSize - recordOverhead
+}
+
+// Ellipsis marks text shortened by TruncateText
+const Ellipsis = "…"
+
+// TruncateText shortens s to at most n runes including a trailing ellipsis,
+// cutting at a word boundary when one is near the end. Returns s unchanged if
+// it already fits.
+func TruncateText(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	if n <= 0 {
+		return ""
+	}
+
+	runes := []rune(s)[:n-1]
+	// Prefer ending at whitespace, unless that drops more than a fifth of the text
+	for i := len(runes) - 1; i >= len(runes)*4/5; i-- {
+		if unicode.IsSpace(runes[i]) {
+			runes = runes[:i]
+			break
+		}
+	}
+	return strings.TrimRightFunc(string(runes), unicode.IsSpace) + Ellipsis
+}
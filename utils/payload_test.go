@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestMaxPayloadSize(t *testing.T) {
+	tests := []struct {
+		recordSize uint32
+		want       int
+	}{
+		{4096, 3993},
+		{4096 - 1, 3992},
+		{1024, 921},
+		{encryptionHeaderSize + recordOverhead, 0},
+	}
+	for _, tt := range tests {
+		if got := MaxPayloadSize(tt.recordSize); got != tt.want {
+			t.Errorf("MaxPayloadSize(%d) = %d, want %d", tt.recordSize, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly", 7, "exactly"},
+		{"abcdefghij", 5, "abcd…"},
+		{"abcdefghij", 1, "…"},
+		{"abcdefghij", 0, ""},
+
+		// Cut at a space near the end, without trailing whitespace
+		{"the quick brown fox jumps", 21, "the quick brown fox…"},
+		{"the quick brown fox jumps", 20, "the quick brown…"},
+		{"the quick brown   fox jumps", 19, "the quick brown…"},
+		// but not when that drops too much
+		{"a bcdefghijklmnopqrstu", 12, "a bcdefghij…"},
+
+		// Runes, not bytes, are counted and never split
+		{"こんにちは世界", 4, "こんに…"},
+		{"héllo wörld", 8, "héllo…"},
+		{"👋👋👋👋", 3, "👋👋…"},
+	}
+	for _, tt := range tests {
+		got := TruncateText(tt.in, tt.n)
+		if got != tt.want {
+			t.Errorf("TruncateText(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+		if !utf8.ValidString(got) || utf8.RuneCountInString(got) > max(tt.n, 0) {
+			t.Errorf("TruncateText(%q, %d) = %q, not valid text of at most %d runes", tt.in, tt.n, got, tt.n)
+		}
+	}
+
+	if got := TruncateText(strings.Repeat("x", 100), 10); !strings.HasSuffix(got, Ellipsis) {
+		t.Errorf("truncated text %q does not end with %q", got, Ellipsis)
+	}
+}
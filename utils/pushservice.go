@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Push services recognised from endpoint hosts
+const (
+	PushServiceFCM     = "fcm"     // Firebase Cloud Messaging (Chrome, Edge on Android, Opera, Samsung Internet)
+	PushServiceMozilla = "mozilla" // Mozilla autopush (Firefox)
+	PushServiceApple   = "apple"   // Apple Push Notification service (Safari)
+	PushServiceWNS     = "wns"     // Windows Push Notification Services (Edge on Windows)
+	PushServiceOther   = "other"
+)
+
+// pushServiceHosts maps endpoint host suffixes to push services
+var pushServiceHosts = []struct {
+	suffix  string
+	service string
+}{
+	{"fcm.googleapis.com", PushServiceFCM},
+	{"android.googleapis.com", PushServiceFCM},
+	{"push.services.mozilla.com", PushServiceMozilla},
+	{"push.apple.com", PushServiceApple},
+	{"notify.windows.com", PushServiceWNS},
+}
+
+// PushServiceQuirks are the limits and features that differ between push services
+type PushServiceQuirks struct {
+	MaxRecordSize uint32 // largest encrypted request body accepted, in bytes
+	Urgency       bool   // whether the Urgency header is accepted
+	MaxTTL        int    // longest TTL kept, in seconds; 0 for no cap
+}
+
+// defaultPushServiceQuirks apply to push services without known quirks. RFC 8030
+// requires every push service to accept 4096 byte messages.
+var defaultPushServiceQuirks = PushServiceQuirks{MaxRecordSize: 4096, Urgency: true}
+
+// pushServiceQuirks holds the quirks of the known push services
+var pushServiceQuirks = map[string]PushServiceQuirks{
+	PushServiceFCM:     {MaxRecordSize: 4096, Urgency: true, MaxTTL: 28 * 24 * 3600},
+	PushServiceMozilla: {MaxRecordSize: 4096, Urgency: true, MaxTTL: 60 * 24 * 3600},
+	PushServiceApple:   {MaxRecordSize: 4096, Urgency: true},
+	PushServiceWNS:     {MaxRecordSize: 4096, Urgency: false},
+}
+
+// PushServiceHost returns the host of a push endpoint, e.g. "fcm.googleapis.com"
+// Returns empty string if the endpoint is not a valid URL
+func PushServiceHost(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// ClassifyPushService returns the push service of an endpoint, e.g. PushServiceFCM
+// for https://fcm.googleapis.com/fcm/send/..., or "" if it is not a valid URL
+func ClassifyPushService(endpoint string) string {
+	return ClassifyPushServiceHost(PushServiceHost(endpoint))
+}
+
+// ClassifyPushServiceHost returns the push service an endpoint host belongs to,
+// PushServiceOther for unknown hosts and "" for an empty host
+func ClassifyPushServiceHost(host string) string {
+	if host == "" {
+		return ""
+	}
+	host = strings.ToLower(host)
+	for _, h := range pushServiceHosts {
+		if host == h.suffix || strings.HasSuffix(host, "."+h.suffix) {
+			return h.service
+		}
+	}
+	return PushServiceOther
+}
+
+// QuirksOf returns the quirks of a push service
+func QuirksOf(service string) PushServiceQuirks {
+	if q, ok := pushServiceQuirks[service]; ok {
+		return q
+	}
+	return defaultPushServiceQuirks
+}
@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"webpush/metrics"
+)
+
+// Adaptive slowdown after a push service answers 429 Too Many Requests or 503
+const (
+	minPushRate       = 1.0              // requests/sec a throttled host is never slowed below
+	throttleRecovery  = time.Minute      // time for a throttled host to climb back to its configured rate
+	defaultRetryAfter = time.Second      // pause when the response has no Retry-After
+	maxRetryAfter     = 60 * time.Second // longest pause honoured
+)
+
+// pushRequestTimeout bounds one request to a push service, including reading the response
+const pushRequestTimeout = 30 * time.Second
+
+// PushRateLimiter paces requests to push services per endpoint host: at most a
+// configured number of requests per second and of concurrent requests. When a
+// host answers 429 or 503 its requests pause for the Retry-After time and its
+// rate is halved, then recovers linearly over a minute.
+type PushRateLimiter struct {
+	rate        float64            // requests/sec per host, 0 for unlimited
+	hostRates   map[string]float64 // per-host overrides of rate
+	concurrency int
+	client      *http.Client
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimiter
+}
+
+// hostLimiter is the pacing state of one push service host
+type hostLimiter struct {
+	host    string
+	maxRate float64
+	conns   chan struct{}
+
+	mu          sync.Mutex
+	next        time.Time // earliest start of the next request
+	pausedUntil time.Time
+	floor       float64   // rate right after the last throttle
+	throttledAt time.Time // zero if never throttled
+}
+
+// NewPushRateLimiter returns a limiter allowing rate requests/sec (0 for no
+// limit) and concurrency concurrent requests per host. hostRates overrides the
+// rate for single hosts, as "host=rate" entries.
+func NewPushRateLimiter(rate int, hostRates []string, concurrency int) (*PushRateLimiter, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	l := &PushRateLimiter{
+		rate:        float64(rate),
+		hostRates:   make(map[string]float64),
+		concurrency: concurrency,
+		hosts:       make(map[string]*hostLimiter),
+	}
+	for _, entry := range hostRates {
+		host, v, ok := strings.Cut(entry, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if !ok || host == "" || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid host rate %q, want host=requests per second", entry)
+		}
+		l.hostRates[host] = float64(n)
+	}
+
+	// One client for all pushes, keeping connections to each push service open
+	// between requests. Its connection limit matches the concurrency limit.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = concurrency
+	transport.MaxConnsPerHost = concurrency
+	transport.DialContext = (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	l.client = &http.Client{Transport: transport, Timeout: pushRequestTimeout}
+	return l, nil
+}
+
+// Client returns the HTTP client pushes are sent with
+func (l *PushRateLimiter) Client() *http.Client {
+	return l.client
+}
+
+// Concurrency returns the number of concurrent requests allowed per host
+func (l *PushRateLimiter) Concurrency() int {
+	return l.concurrency
+}
+
+// host returns the limiter of a host, creating it on first use
+func (l *PushRateLimiter) host(host string) *hostLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.hosts[host]
+	if !ok {
+		rate, ok := l.hostRates[host]
+		if !ok {
+			rate = l.rate
+		}
+		h = &hostLimiter{host: host, maxRate: rate, conns: make(chan struct{}, l.concurrency)}
+		l.hosts[host] = h
+		metrics.PushRateLimit.WithLabelValues(host).Set(rate)
+	}
+	return h
+}
+
+// Acquire waits until a request to host may start. The returned function must
+// be called with the response once the request is done: its status code (0 for
+// transport errors) and Retry-After header.
+func (l *PushRateLimiter) Acquire(host string) func(statusCode int, retryAfter string) {
+	h := l.host(host)
+	h.conns <- struct{}{}
+
+	// A throttle while waiting voids the slot, so book another after the pause
+	start := time.Now()
+	for {
+		wait := h.reserve(time.Now())
+		if wait <= 0 {
+			break
+		}
+		time.Sleep(wait)
+		if !h.paused(time.Now()) {
+			break
+		}
+	}
+	metrics.PushRateWait.WithLabelValues(host).Observe(time.Since(start).Seconds())
+
+	return func(statusCode int, retryAfter string) {
+		if statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable {
+			h.throttle(time.Now(), ParseRetryAfter(retryAfter, time.Now()))
+		}
+		<-h.conns
+	}
+}
+
+// currentRate returns the rate allowed at now, 0 for unlimited
+func (h *hostLimiter) currentRate(now time.Time) float64 {
+	if h.maxRate == 0 || h.throttledAt.IsZero() {
+		return h.maxRate
+	}
+	elapsed := now.Sub(h.throttledAt)
+	if elapsed >= throttleRecovery {
+		return h.maxRate
+	}
+	return h.floor + (h.maxRate-h.floor)*float64(elapsed)/float64(throttleRecovery)
+}
+
+// reserve books the next request slot and returns how long to wait for it
+func (h *hostLimiter) reserve(now time.Time) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	start := now
+	if h.pausedUntil.After(start) {
+		start = h.pausedUntil
+	}
+	if h.next.After(start) {
+		start = h.next
+	}
+	rate := h.currentRate(start)
+	if rate > 0 {
+		h.next = start.Add(time.Duration(float64(time.Second) / rate))
+	}
+	if !h.throttledAt.IsZero() {
+		metrics.PushRateLimit.WithLabelValues(h.host).Set(rate)
+	}
+	return start.Sub(now)
+}
+
+// paused reports whether requests to the host are paused at now
+func (h *hostLimiter) paused(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return now.Before(h.pausedUntil)
+}
+
+// throttle pauses the host for retryAfter and halves its rate. Responses to
+// requests that were already in flight during a pause do not halve it again.
+func (h *hostLimiter) throttle(now time.Time, retryAfter time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	metrics.PushThrottled.WithLabelValues(h.host).Inc()
+	paused := now.Before(h.pausedUntil)
+	if until := now.Add(retryAfter); until.After(h.pausedUntil) {
+		h.pausedUntil = until
+	}
+	if paused || h.maxRate == 0 {
+		return
+	}
+
+	h.floor = h.currentRate(now) / 2
+	if h.floor < minPushRate {
+		h.floor = minPushRate
+	}
+	h.throttledAt = now
+	metrics.PushRateLimit.WithLabelValues(h.host).Set(h.floor)
+	log.Printf("[RateLimit] %s is throttling, pausing %s and slowing to %.1f requests/sec", h.host, retryAfter, h.floor)
+}
+
+// ParseRetryAfter returns the wait a Retry-After header asks for, in seconds or
+// as an HTTP date, bounded to 60 seconds. Missing or invalid values give one second.
+func ParseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	d := defaultRetryAfter
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	}
+	if d <= 0 {
+		d = defaultRetryAfter
+	}
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	return d
+}
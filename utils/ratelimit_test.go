@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+var limiterTime = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+func newTestHostLimiter(rate float64) *hostLimiter {
+	return &hostLimiter{host: "push.example", maxRate: rate, conns: make(chan struct{}, 1)}
+}
+
+func TestReservePacing(t *testing.T) {
+	tests := []struct {
+		rate float64
+		want []time.Duration // waits of successive reservations made at the same instant
+	}{
+		{10, []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}},
+		{1, []time.Duration{0, time.Second, 2 * time.Second}},
+		{4, []time.Duration{0, 250 * time.Millisecond, 500 * time.Millisecond}},
+		{0, []time.Duration{0, 0, 0}}, // unlimited
+	}
+	for _, tt := range tests {
+		h := newTestHostLimiter(tt.rate)
+		for i, want := range tt.want {
+			if got := h.reserve(limiterTime); got != want {
+				t.Errorf("rate %v: reservation %d waits %v, want %v", tt.rate, i, got, want)
+			}
+		}
+	}
+
+	// Slots already passed are not made up for
+	h := newTestHostLimiter(10)
+	h.reserve(limiterTime)
+	if got := h.reserve(limiterTime.Add(time.Second)); got != 0 {
+		t.Errorf("reservation after an idle second waits %v, want 0", got)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	tests := []struct {
+		name      string
+		rate      float64
+		throttles []time.Duration // offsets from limiterTime of 429 responses, each with Retry-After 2s
+		at        time.Duration   // offset at which the rate is checked
+		wantRate  float64
+	}{
+		{"halved", 10, []time.Duration{0}, 0, 5},
+		{"recovering", 10, []time.Duration{0}, 30 * time.Second, 7.5},
+		{"recovered", 10, []time.Duration{0}, throttleRecovery, 10},
+		{"long after", 10, []time.Duration{0}, time.Hour, 10},
+		{"not halved again during the pause", 10, []time.Duration{0, time.Second}, 0, 5},
+		{"halved again after the pause", 10, []time.Duration{0, 6 * time.Second}, 6 * time.Second, 2.75},
+		{"never below the minimum", 1, []time.Duration{0}, 0, minPushRate},
+		{"unlimited stays unlimited", 0, []time.Duration{0}, 0, 0},
+	}
+	for _, tt := range tests {
+		h := newTestHostLimiter(tt.rate)
+		for _, at := range tt.throttles {
+			h.throttle(limiterTime.Add(at), 2*time.Second)
+		}
+		if got := h.currentRate(limiterTime.Add(tt.at)); got != tt.wantRate {
+			t.Errorf("%s: rate = %v, want %v", tt.name, got, tt.wantRate)
+		}
+	}
+}
+
+func TestThrottlePauses(t *testing.T) {
+	h := newTestHostLimiter(10)
+	h.throttle(limiterTime, 2*time.Second)
+
+	if !h.paused(limiterTime.Add(time.Second)) || h.paused(limiterTime.Add(2*time.Second)) {
+		t.Errorf("paused until %v, want %v", h.pausedUntil, limiterTime.Add(2*time.Second))
+	}
+	// The first request after the pause waits for it, the next one at the halved rate
+	if got := h.reserve(limiterTime); got != 2*time.Second {
+		t.Errorf("reservation during the pause waits %v, want 2s", got)
+	}
+	if got := h.reserve(limiterTime.Add(2 * time.Second)); got < 190*time.Millisecond || got > 200*time.Millisecond {
+		t.Errorf("next reservation waits %v, want about 200ms at the halved rate", got)
+	}
+
+	// A shorter Retry-After does not end a longer pause early
+	h.throttle(limiterTime.Add(time.Second), 0)
+	if !h.paused(limiterTime.Add(1500 * time.Millisecond)) {
+		t.Error("pause shortened by a later, shorter Retry-After")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"5", 5 * time.Second},
+		{" 5 ", 5 * time.Second},
+		{"60", 60 * time.Second},
+		{"61", maxRetryAfter},
+		{"3600", maxRetryAfter},
+		{limiterTime.Add(10 * time.Second).Format(http.TimeFormat), 10 * time.Second},
+		{limiterTime.Add(time.Hour).Format(http.TimeFormat), maxRetryAfter},
+
+		// Missing, past and invalid values fall back to the default
+		{"", defaultRetryAfter},
+		{"0", defaultRetryAfter},
+		{"-3", defaultRetryAfter},
+		{limiterTime.Add(-time.Minute).Format(http.TimeFormat), defaultRetryAfter},
+		{"soon", defaultRetryAfter},
+		{"1.5", defaultRetryAfter},
+		{"2026-10-19T12:00:10Z", defaultRetryAfter},
+	}
+	for _, tt := range tests {
+		if got := ParseRetryAfter(tt.in, limiterTime); got != tt.want {
+			t.Errorf("ParseRetryAfter(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNewPushRateLimiter(t *testing.T) {
+	tests := []struct {
+		concurrency int
+		want        int
+	}{
+		{0, 1},
+		{-2, 1},
+		{1, 1},
+		{8, 8},
+	}
+	for _, tt := range tests {
+		l, err := NewPushRateLimiter(10, nil, tt.concurrency)
+		if err != nil {
+			t.Fatalf("NewPushRateLimiter(concurrency %d): %v", tt.concurrency, err)
+		}
+		if got := l.Concurrency(); got != tt.want {
+			t.Errorf("concurrency %d: Concurrency() = %d, want %d", tt.concurrency, got, tt.want)
+		}
+		transport := l.Client().Transport.(*http.Transport)
+		if transport.MaxConnsPerHost != tt.want || transport.MaxIdleConnsPerHost != tt.want {
+			t.Errorf("concurrency %d: MaxConnsPerHost %d, MaxIdleConnsPerHost %d, want %d", tt.concurrency, transport.MaxConnsPerHost, transport.MaxIdleConnsPerHost, tt.want)
+		}
+		if got := cap(l.host("push.example").conns); got != tt.want {
+			t.Errorf("concurrency %d: host connection slots = %d, want %d", tt.concurrency, got, tt.want)
+		}
+	}
+}
+
+func TestHostRates(t *testing.T) {
+	l, err := NewPushRateLimiter(10, []string{"FCM.googleapis.com=50", " updates.push.services.mozilla.com = 0 "}, 1)
+	if err != nil {
+		t.Fatalf("NewPushRateLimiter: %v", err)
+	}
+	for host, want := range map[string]float64{
+		"fcm.googleapis.com":                50,
+		"updates.push.services.mozilla.com": 0,
+		"web.push.apple.com":                10,
+	} {
+		if got := l.host(host).maxRate; got != want {
+			t.Errorf("rate of %s = %v, want %v", host, got, want)
+		}
+	}
+
+	for _, entry := range []string{"fcm.googleapis.com", "=5", "fcm.googleapis.com=-1", "fcm.googleapis.com=fast"} {
+		if _, err := NewPushRateLimiter(10, []string{entry}, 1); err == nil {
+			t.Errorf("NewPushRateLimiter(%q) succeeded, want an error", entry)
+		}
+	}
+}
+
+func TestAcquireConcurrency(t *testing.T) {
+	l, err := NewPushRateLimiter(0, nil, 1)
+	if err != nil {
+		t.Fatalf("NewPushRateLimiter: %v", err)
+	}
+	release := l.Acquire("push.example")
+
+	acquired := make(chan func(int, string))
+	go func() { acquired <- l.Acquire("push.example") }()
+	select {
+	case <-acquired:
+		t.Fatal("second request started while the only connection slot was taken")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Other hosts have their own slots
+	l.Acquire("other.example")(http.StatusCreated, "")
+
+	release(http.StatusCreated, "")
+	select {
+	case next := <-acquired:
+		next(http.StatusCreated, "")
+	case <-time.After(time.Second):
+		t.Fatal("second request did not start after the first released its slot")
+	}
+}
@@ -1,178 +1,209 @@
-package utils
-
-import (
-	"strconv"
-	"strings"
-)
-
-// ParseUserAgent extracts OS and browser information from a user agent string
-// Returns: (os, osVersion, browser, browserVersion)
-func ParseUserAgent(ua string) (string, string, string, string) {
-	os := "Unknown"
-	osVersion := ""
-	browser := "Unknown"
-	browserVersion := ""
-
-	// Extract OS and version
-	if strings.Contains(ua, "Windows NT") {
-		os = "Windows"
-		if idx := strings.Index(ua, "Windows NT "); idx != -1 {
-			start := idx + 11
-			end := strings.IndexAny(ua[start:], ";) ")
-			if end != -1 {
-				ntVersion := ua[start : start+end]
-				switch ntVersion {
-				case "10.0":
-					osVersion = "10/11"
-				case "6.3":
-					osVersion = "8.1"
-				case "6.2":
-					osVersion = "8"
-				case "6.1":
-					osVersion = "7"
-				default:
-					osVersion = ntVersion
-				}
-			}
-		}
-	} else if strings.Contains(ua, "Mac OS X") {
-		os = "macOS"
-		if idx := strings.Index(ua, "Mac OS X "); idx != -1 {
-			start := idx + 9
-			end := strings.IndexAny(ua[start:], ";)")
-			if end != -1 {
-				osVersion = strings.ReplaceAll(ua[start:start+end], "_", ".")
-			}
-		}
-	} else if strings.Contains(ua, "Android") {
-		os = "Android"
-		if idx := strings.Index(ua, "Android "); idx != -1 {
-			start := idx + 8
-			end := strings.IndexAny(ua[start:], ";)")
-			if end != -1 {
-				osVersion = ua[start : start+end]
-			}
-		}
-	} else if strings.Contains(ua, "iPhone OS") || strings.Contains(ua, "CPU OS") {
-		os = "iOS"
-		var idx int
-		if strings.Contains(ua, "iPhone OS") {
-			idx = strings.Index(ua, "iPhone OS ")
-			if idx != -1 {
-				start := idx + 10
-				end := strings.IndexAny(ua[start:], " )")
-				if end != -1 {
-					osVersion = strings.ReplaceAll(ua[start:start+end], "_", ".")
-				}
-			}
-		} else if strings.Contains(ua, "CPU OS") {
-			idx = strings.Index(ua, "CPU OS ")
-			if idx != -1 {
-				start := idx + 7
-				end := strings.IndexAny(ua[start:], " )")
-				if end != -1 {
-					osVersion = strings.ReplaceAll(ua[start:start+end], "_", ".")
-				}
-			}
-		}
-	} else if strings.Contains(ua, "iPad") {
-		os = "iPadOS"
-		if idx := strings.Index(ua, "CPU OS "); idx != -1 {
-			start := idx + 7
-			end := strings.IndexAny(ua[start:], " )")
-			if end != -1 {
-				osVersion = strings.ReplaceAll(ua[start:start+end], "_", ".")
-			}
-		}
-	} else if strings.Contains(ua, "Linux") {
-		os = "Linux"
-	}
-
-	// Extract browser and version
-	if strings.Contains(ua, "Edg/") {
-		browser = "Edge"
-		if idx := strings.Index(ua, "Edg/"); idx != -1 {
-			start := idx + 4
-			end := strings.IndexAny(ua[start:], " )")
-			if end != -1 {
-				browserVersion = ua[start : start+end]
-			}
-		}
-	} else if strings.Contains(ua, "Chrome/") {
-		browser = "Chrome"
-		if idx := strings.Index(ua, "Chrome/"); idx != -1 {
-			start := idx + 7
-			end := strings.IndexAny(ua[start:], " )")
-			if end != -1 {
-				browserVersion = ua[start : start+end]
-			}
-		}
-	} else if strings.Contains(ua, "Firefox/") {
-		browser = "Firefox"
-		if idx := strings.Index(ua, "Firefox/"); idx != -1 {
-			start := idx + 8
-			end := strings.IndexAny(ua[start:], " )")
-			if end != -1 {
-				browserVersion = ua[start : start+end]
-			}
-		}
-	} else if strings.Contains(ua, "Safari/") && !strings.Contains(ua, "Chrome/") {
-		browser = "Safari"
-		if idx := strings.Index(ua, "Version/"); idx != -1 {
-			start := idx + 8
-			end := strings.IndexAny(ua[start:], " )")
-			if end != -1 {
-				browserVersion = ua[start : start+end]
-			}
-		}
-	} else if strings.Contains(ua, "OPR/") {
-		browser = "Opera"
-		if idx := strings.Index(ua, "OPR/"); idx != -1 {
-			start := idx + 4
-			end := strings.IndexAny(ua[start:], " )")
-			if end != -1 {
-				browserVersion = ua[start : start+end]
-			}
-		}
-	}
-
-	return os, osVersion, browser, browserVersion
-}
-
-// ParsePlatformVersion converts platform version from userAgentData to human-readable OS version
-func ParsePlatformVersion(platform, platformVersion string) string {
-	if platform == "Windows" {
-		// Parse major version from platformVersion (e.g., "13.0.0" -> 13)
-		parts := strings.Split(platformVersion, ".")
-		if len(parts) > 0 {
-			majorVersion := parts[0]
-			// Convert string to int to compare
-			if major, err := strconv.Atoi(majorVersion); err == nil {
-				if major >= 13 {
-					return "11"
-				} else if major >= 10 {
-					return "10"
-				} else if major >= 6 {
-					// Older Windows versions
-					switch majorVersion {
-					case "6":
-						if len(parts) > 1 {
-							minor := parts[1]
-							switch minor {
-							case "3":
-								return "8.1"
-							case "2":
-								return "8"
-							case "1":
-								return "7"
-							}
-						}
-					}
-				}
-			}
-		}
-		return platformVersion
-	}
-	// For other platforms, return as-is
-	return platformVersion
-}
+package utils
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultUserAgentRules are the rules built into the binary
+//
+//go:embed useragent_rules.json
+var defaultUserAgentRules []byte
+
+// Device types
+const (
+	DeviceMobile   = "mobile"
+	DeviceTablet   = "tablet"
+	DeviceDesktop  = "desktop"
+	DeviceTV       = "tv"
+	DeviceConsole  = "console"
+	DeviceWearable = "wearable"
+)
+
+// unknownName is reported for a browser or OS no rule matches
+const unknownName = "Unknown"
+
+// UserAgent is what a User-Agent string tells about a client. Fields no rule
+// matched are empty, except Browser and OS, which are "Unknown".
+type UserAgent struct {
+	Browser        string
+	BrowserVersion string
+	Engine         string
+	EngineVersion  string
+	OS             string
+	OSVersion      string
+	DeviceType     string
+	DeviceVendor   string
+}
+
+// UserAgentParser parses User-Agent strings with an ordered list of regular
+// expression rules per field; the first matching rule wins
+type UserAgentParser struct {
+	browsers    []uaRule
+	engines     []uaRule
+	os          []uaRule
+	deviceTypes []uaRule
+	vendors     []uaRule
+}
+
+// uaRuleFile is the JSON layout of a rules file
+type uaRuleFile struct {
+	Browsers    []uaRuleDef `json:"browsers"`
+	Engines     []uaRuleDef `json:"engines"`
+	OS          []uaRuleDef `json:"os"`
+	DeviceTypes []uaRuleDef `json:"device_types"`
+	Vendors     []uaRuleDef `json:"vendors"`
+}
+
+// uaRuleDef is one rule as written in a rules file. Version is a template
+// expanded with the match, e.g. "$1" or a fixed "10/11"; it defaults to the
+// first capture group. Unless is a pattern that must not match, since Go
+// regular expressions have no negative lookahead.
+type uaRuleDef struct {
+	Regex   string `json:"regex"`
+	Unless  string `json:"unless,omitempty"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// uaRule is a compiled rule
+type uaRule struct {
+	re      *regexp.Regexp
+	unless  *regexp.Regexp
+	name    string
+	version string
+}
+
+// NewUserAgentParser returns a parser using the rules file at path, or the
+// built-in rules when path is empty
+func NewUserAgentParser(path string) (*UserAgentParser, error) {
+	data := defaultUserAgentRules
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var file uaRuleFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing user agent rules: %w", err)
+	}
+
+	p := &UserAgentParser{}
+	for _, list := range []struct {
+		name string
+		defs []uaRuleDef
+		dst  *[]uaRule
+	}{
+		{"browsers", file.Browsers, &p.browsers},
+		{"engines", file.Engines, &p.engines},
+		{"os", file.OS, &p.os},
+		{"device_types", file.DeviceTypes, &p.deviceTypes},
+		{"vendors", file.Vendors, &p.vendors},
+	} {
+		for i, def := range list.defs {
+			rule, err := compileUARule(def)
+			if err != nil {
+				return nil, fmt.Errorf("user agent rule %s[%d]: %w", list.name, i, err)
+			}
+			*list.dst = append(*list.dst, rule)
+		}
+	}
+	return p, nil
+}
+
+// compileUARule compiles the expressions of a rule definition
+func compileUARule(def uaRuleDef) (uaRule, error) {
+	if def.Name == "" {
+		return uaRule{}, fmt.Errorf("%q has no name", def.Regex)
+	}
+	rule := uaRule{name: def.Name, version: def.Version}
+	var err error
+	if rule.re, err = regexp.Compile(def.Regex); err != nil {
+		return uaRule{}, err
+	}
+	if rule.version == "" && rule.re.NumSubexp() > 0 {
+		rule.version = "$1"
+	}
+	if def.Unless != "" {
+		if rule.unless, err = regexp.Compile(def.Unless); err != nil {
+			return uaRule{}, err
+		}
+	}
+	return rule, nil
+}
+
+// matchUARules returns the name and version of the first rule in rules matching ua
+func matchUARules(rules []uaRule, ua string) (name, version string, ok bool) {
+	for _, rule := range rules {
+		m := rule.re.FindStringSubmatchIndex(ua)
+		if m == nil || (rule.unless != nil && rule.unless.MatchString(ua)) {
+			continue
+		}
+		v := string(rule.re.ExpandString(nil, rule.version, ua, m))
+		return rule.name, strings.ReplaceAll(v, "_", "."), true
+	}
+	return "", "", false
+}
+
+// Parse extracts browser, engine, OS and device information from a User-Agent string
+func (p *UserAgentParser) Parse(ua string) UserAgent {
+	r := UserAgent{Browser: unknownName, OS: unknownName}
+	if ua == "" {
+		return r
+	}
+	if name, version, ok := matchUARules(p.browsers, ua); ok {
+		r.Browser, r.BrowserVersion = name, version
+	}
+	r.Engine, r.EngineVersion, _ = matchUARules(p.engines, ua)
+	if name, version, ok := matchUARules(p.os, ua); ok {
+		r.OS, r.OSVersion = name, version
+	}
+	r.DeviceType, _, _ = matchUARules(p.deviceTypes, ua)
+	r.DeviceVendor, _, _ = matchUARules(p.vendors, ua)
+	return r
+}
+
+// ParsePlatformVersion converts platform version from userAgentData to human-readable OS version
+func ParsePlatformVersion(platform, platformVersion string) string {
+	if platform == "Windows" {
+		// Parse major version from platformVersion (e.g., "13.0.0" -> 13)
+		parts := strings.Split(platformVersion, ".")
+		if len(parts) > 0 {
+			majorVersion := parts[0]
+			// Convert string to int to compare
+			if major, err := strconv.Atoi(majorVersion); err == nil {
+				if major >= 13 {
+					return "11"
+				} else if major >= 10 {
+					return "10"
+				} else if major >= 6 {
+					// Older Windows versions
+					switch majorVersion {
+					case "6":
+						if len(parts) > 1 {
+							minor := parts[1]
+							switch minor {
+							case "3":
+								return "8.1"
+							case "2":
+								return "8"
+							case "1":
+								return "7"
+							}
+						}
+					}
+				}
+			}
+		}
+		return platformVersion
+	}
+	// For other platforms, return as-is
+	return platformVersion
+}
@@ -0,0 +1,243 @@
+package utils
+
+import "testing"
+
+// TestUserAgentCorpus parses real User-Agent strings with the default rules, so
+// that reordering or editing a rule shows up as a changed classification
+func TestUserAgentCorpus(t *testing.T) {
+	p, err := NewUserAgentParser("")
+	if err != nil {
+		t.Fatalf("NewUserAgentParser: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ua   string
+		want UserAgent // EngineVersion is not compared
+	}{
+		// Desktop
+		{
+			"Chrome on Windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			UserAgent{Browser: "Chrome", BrowserVersion: "120.0.0.0", Engine: "Blink", OS: "Windows", OSVersion: "10/11", DeviceType: DeviceDesktop},
+		},
+		{
+			"Chrome on Windows 7",
+			"Mozilla/5.0 (Windows NT 6.1; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/109.0.0.0 Safari/537.36",
+			UserAgent{Browser: "Chrome", BrowserVersion: "109.0.0.0", Engine: "Blink", OS: "Windows", OSVersion: "7", DeviceType: DeviceDesktop},
+		},
+		{
+			"Edge on Windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91",
+			UserAgent{Browser: "Edge", BrowserVersion: "120.0.2210.91", Engine: "Blink", OS: "Windows", OSVersion: "10/11", DeviceType: DeviceDesktop},
+		},
+		{
+			"legacy Edge",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.102 Safari/537.36 Edge/18.19045",
+			UserAgent{Browser: "Edge", BrowserVersion: "18.19045", Engine: "EdgeHTML", OS: "Windows", OSVersion: "10/11", DeviceType: DeviceDesktop},
+		},
+		{
+			"Internet Explorer 11",
+			"Mozilla/5.0 (Windows NT 6.1; Trident/7.0; rv:11.0) like Gecko",
+			UserAgent{Browser: "Internet Explorer", BrowserVersion: "11.0", Engine: "Trident", OS: "Windows", OSVersion: "7", DeviceType: DeviceDesktop},
+		},
+		{
+			"Firefox on Windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			UserAgent{Browser: "Firefox", BrowserVersion: "121.0", Engine: "Gecko", OS: "Windows", OSVersion: "10/11", DeviceType: DeviceDesktop},
+		},
+		{
+			"Yandex on Windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 YaBrowser/24.1.0.0 Safari/537.36",
+			UserAgent{Browser: "Yandex", BrowserVersion: "24.1.0.0", Engine: "Blink", OS: "Windows", OSVersion: "10/11", DeviceType: DeviceDesktop},
+		},
+		{
+			"Vivaldi on Windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Vivaldi/6.5.3206.50",
+			UserAgent{Browser: "Vivaldi", BrowserVersion: "6.5.3206.50", Engine: "Blink", OS: "Windows", OSVersion: "10/11", DeviceType: DeviceDesktop},
+		},
+		{
+			"Brave on Windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Brave/120",
+			UserAgent{Browser: "Brave", BrowserVersion: "120", Engine: "Blink", OS: "Windows", OSVersion: "10/11", DeviceType: DeviceDesktop},
+		},
+		{
+			"Safari on macOS",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15",
+			UserAgent{Browser: "Safari", BrowserVersion: "17.2", Engine: "WebKit", OS: "macOS", OSVersion: "10.15.7", DeviceType: DeviceDesktop, DeviceVendor: "Apple"},
+		},
+		{
+			"Opera on macOS",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 OPR/106.0.0.0",
+			UserAgent{Browser: "Opera", BrowserVersion: "106.0.0.0", Engine: "Blink", OS: "macOS", OSVersion: "10.15.7", DeviceType: DeviceDesktop, DeviceVendor: "Apple"},
+		},
+		{
+			"Chrome on Linux",
+			"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			UserAgent{Browser: "Chrome", BrowserVersion: "120.0.0.0", Engine: "Blink", OS: "Linux", DeviceType: DeviceDesktop},
+		},
+		{
+			"Firefox on Ubuntu",
+			"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			UserAgent{Browser: "Firefox", BrowserVersion: "121.0", Engine: "Gecko", OS: "Linux", DeviceType: DeviceDesktop},
+		},
+		{
+			"Firefox on FreeBSD",
+			"Mozilla/5.0 (X11; FreeBSD amd64; rv:120.0) Gecko/20100101 Firefox/120.0",
+			UserAgent{Browser: "Firefox", BrowserVersion: "120.0", Engine: "Gecko", OS: "FreeBSD", DeviceType: DeviceDesktop},
+		},
+		{
+			"Headless Chrome",
+			"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0.6099.28 Safari/537.36",
+			UserAgent{Browser: "Headless Chrome", BrowserVersion: "120.0.6099.28", Engine: "Blink", OS: "Linux", DeviceType: DeviceDesktop},
+		},
+		{
+			"Chrome on ChromeOS",
+			"Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			UserAgent{Browser: "Chrome", BrowserVersion: "120.0.0.0", Engine: "Blink", OS: "ChromeOS", OSVersion: "14541.0.0", DeviceType: DeviceDesktop},
+		},
+
+		// Android
+		{
+			"Chrome on Pixel",
+			"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36",
+			UserAgent{Browser: "Chrome", BrowserVersion: "120.0.6099.144", Engine: "Blink", OS: "Android", OSVersion: "14", DeviceType: DeviceMobile, DeviceVendor: "Google"},
+		},
+		{
+			"Android WebView",
+			"Mozilla/5.0 (Linux; Android 14; Pixel 8 Build/UQ1A.240105.004; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/120.0.6099.193 Mobile Safari/537.36",
+			UserAgent{Browser: "Chrome WebView", BrowserVersion: "120.0.6099.193", Engine: "Blink", OS: "Android", OSVersion: "14", DeviceType: DeviceMobile, DeviceVendor: "Google"},
+		},
+		{
+			"Samsung Internet on Galaxy S23",
+			"Mozilla/5.0 (Linux; Android 13; SM-S918B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Mobile Safari/537.36",
+			UserAgent{Browser: "Samsung Internet", BrowserVersion: "23.0", Engine: "Blink", OS: "Android", OSVersion: "13", DeviceType: DeviceMobile, DeviceVendor: "Samsung"},
+		},
+		{
+			"Chrome on Galaxy Tab",
+			"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			UserAgent{Browser: "Chrome", BrowserVersion: "120.0.0.0", Engine: "Blink", OS: "Android", OSVersion: "13", DeviceType: DeviceTablet, DeviceVendor: "Samsung"},
+		},
+		{
+			"Samsung Internet on Galaxy Watch",
+			"Mozilla/5.0 (Linux; Android 11; SAMSUNG SM-R890) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/1.0 Chrome/79.0.3945.136 Mobile Safari/537.36",
+			UserAgent{Browser: "Samsung Internet", BrowserVersion: "1.0", Engine: "Blink", OS: "Android", OSVersion: "11", DeviceType: DeviceWearable, DeviceVendor: "Samsung"},
+		},
+		{
+			"DuckDuckGo on Galaxy A53",
+			"Mozilla/5.0 (Linux; Android 13; SM-A536B) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36 DuckDuckGo/5",
+			UserAgent{Browser: "DuckDuckGo", BrowserVersion: "5", Engine: "Blink", OS: "Android", OSVersion: "13", DeviceType: DeviceMobile, DeviceVendor: "Samsung"},
+		},
+		{
+			"Mi Browser on Xiaomi",
+			"Mozilla/5.0 (Linux; Android 12; 2201117TG) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Mobile Safari/537.36 XiaoMi/MiuiBrowser/14.5.7-gn",
+			UserAgent{Browser: "Mi Browser", BrowserVersion: "14.5.7", Engine: "Blink", OS: "Android", OSVersion: "12", DeviceType: DeviceMobile, DeviceVendor: "Xiaomi"},
+		},
+		{
+			"Huawei Browser on HarmonyOS",
+			"Mozilla/5.0 (Linux; Android 10; HarmonyOS; ELS-NX9; HMSCore 6.12.0.302) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.5735.196 HuaweiBrowser/14.0.2.311 Mobile Safari/537.36",
+			UserAgent{Browser: "Huawei Browser", BrowserVersion: "14.0.2.311", Engine: "Blink", OS: "HarmonyOS", DeviceType: DeviceMobile, DeviceVendor: "Huawei"},
+		},
+		{
+			"Chrome on Motorola",
+			"Mozilla/5.0 (Linux; Android 13; moto g 5G (2022)) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+			UserAgent{Browser: "Chrome", BrowserVersion: "120.0.0.0", Engine: "Blink", OS: "Android", OSVersion: "13", DeviceType: DeviceMobile, DeviceVendor: "Motorola"},
+		},
+		{
+			"Chrome on OPPO",
+			"Mozilla/5.0 (Linux; Android 12; CPH2219) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+			UserAgent{Browser: "Chrome", BrowserVersion: "120.0.0.0", Engine: "Blink", OS: "Android", OSVersion: "12", DeviceType: DeviceMobile, DeviceVendor: "OPPO"},
+		},
+		{
+			"Chrome on LG",
+			"Mozilla/5.0 (Linux; Android 13; LM-V600) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+			UserAgent{Browser: "Chrome", BrowserVersion: "120.0.0.0", Engine: "Blink", OS: "Android", OSVersion: "13", DeviceType: DeviceMobile, DeviceVendor: "LG"},
+		},
+		{
+			"Firefox on Android",
+			"Mozilla/5.0 (Android 14; Mobile; rv:121.0) Gecko/121.0 Firefox/121.0",
+			UserAgent{Browser: "Firefox", BrowserVersion: "121.0", Engine: "Gecko", OS: "Android", OSVersion: "14", DeviceType: DeviceMobile},
+		},
+		{
+			"Opera on Android",
+			"Mozilla/5.0 (Linux; Android 13; KB2003) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36 OPR/79.0.4195.76738",
+			UserAgent{Browser: "Opera", BrowserVersion: "79.0.4195.76738", Engine: "Blink", OS: "Android", OSVersion: "13", DeviceType: DeviceMobile},
+		},
+		{
+			"UC Browser on Android",
+			"Mozilla/5.0 (Linux; U; Android 11; en-US; V2027) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/100.0.4896.58 UCBrowser/13.4.0.1306 Mobile Safari/537.36",
+			UserAgent{Browser: "UC Browser", BrowserVersion: "13.4.0.1306", Engine: "Blink", OS: "Android", OSVersion: "11", DeviceType: DeviceMobile},
+		},
+		{
+			"Firefox on KaiOS",
+			"Mozilla/5.0 (Mobile; LYF/F300B/LYF-F300B-001-01-15-130718-i;Android; rv:48.0) Gecko/48.0 Firefox/48.0 KAIOS/2.5",
+			UserAgent{Browser: "Firefox", BrowserVersion: "48.0", Engine: "Gecko", OS: "KaiOS", OSVersion: "2.5", DeviceType: DeviceMobile},
+		},
+
+		// Apple mobile
+		{
+			"Safari on iPhone",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1",
+			UserAgent{Browser: "Safari", BrowserVersion: "17.2", Engine: "WebKit", OS: "iOS", OSVersion: "17.2", DeviceType: DeviceMobile, DeviceVendor: "Apple"},
+		},
+		{
+			"Chrome on iPhone",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1",
+			UserAgent{Browser: "Chrome", BrowserVersion: "120.0.6099.119", Engine: "WebKit", OS: "iOS", OSVersion: "17.2", DeviceType: DeviceMobile, DeviceVendor: "Apple"},
+		},
+		{
+			"Firefox on iPhone",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) FxiOS/121.0 Mobile/15E148 Safari/605.1.15",
+			UserAgent{Browser: "Firefox", BrowserVersion: "121.0", Engine: "WebKit", OS: "iOS", OSVersion: "17.2", DeviceType: DeviceMobile, DeviceVendor: "Apple"},
+		},
+		{
+			"Facebook in-app browser on iPhone",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 [FBAN/FBIOS;FBDV/iPhone14,5;FBMD/iPhone;FBSN/iOS;FBSV/17.1.2;FBSS/3;FBID/phone;FBLC/en_US;FBOP/5]",
+			UserAgent{Browser: "Facebook", Engine: "WebKit", OS: "iOS", OSVersion: "17.1.2", DeviceType: DeviceMobile, DeviceVendor: "Apple"},
+		},
+		{
+			"Facebook in-app browser on iPhone with app version",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 [FBAN/FBIOS;FBAV/444.0.0.35.111;FBBV/545833617;FBDV/iPhone14,5;FBMD/iPhone;FBSN/iOS;FBSV/17.1.2]",
+			UserAgent{Browser: "Facebook", BrowserVersion: "444.0.0.35.111", Engine: "WebKit", OS: "iOS", OSVersion: "17.1.2", DeviceType: DeviceMobile, DeviceVendor: "Apple"},
+		},
+		{
+			"Safari on iPad",
+			"Mozilla/5.0 (iPad; CPU OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1",
+			UserAgent{Browser: "Safari", BrowserVersion: "17.2", Engine: "WebKit", OS: "iPadOS", OSVersion: "17.2", DeviceType: DeviceTablet, DeviceVendor: "Apple"},
+		},
+
+		// TVs and consoles
+		{
+			"LG webOS TV",
+			"Mozilla/5.0 (Web0S; Linux/SmartTV) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/79.0.3945.79 Safari/537.36 WebAppManager",
+			UserAgent{Browser: "Chrome", BrowserVersion: "79.0.3945.79", Engine: "Blink", OS: "webOS", DeviceType: DeviceTV},
+		},
+		{
+			"Fire TV",
+			"Mozilla/5.0 (Linux; Android 9; AFTMM Build/PS7233) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+			UserAgent{Browser: "Chrome", BrowserVersion: "120.0.0.0", Engine: "Blink", OS: "Android", OSVersion: "9", DeviceType: DeviceTV, DeviceVendor: "Amazon"},
+		},
+		{
+			"PlayStation 5",
+			"Mozilla/5.0 (PlayStation; PlayStation 5/2.26) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0 Safari/605.1.15",
+			UserAgent{Browser: "Safari", BrowserVersion: "13.0", Engine: "WebKit", OS: unknownName, DeviceType: DeviceConsole, DeviceVendor: "Sony"},
+		},
+		{
+			"Xbox One",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64; Xbox; Xbox One) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.102 Safari/537.36 Edge/18.19041",
+			UserAgent{Browser: "Edge", BrowserVersion: "18.19041", Engine: "EdgeHTML", OS: "Windows", OSVersion: "10/11", DeviceType: DeviceConsole, DeviceVendor: "Microsoft"},
+		},
+
+		{"empty", "", UserAgent{Browser: unknownName, OS: unknownName}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Parse(tt.ua)
+			got.EngineVersion = ""
+			if got != tt.want {
+				t.Errorf("Parse(%q)\n got %+v\nwant %+v", tt.ua, got, tt.want)
+			}
+		})
+	}
+}